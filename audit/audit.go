@@ -0,0 +1,277 @@
+// Package audit keeps a tamper-evident log of administrative
+// requests.
+//
+// The log is a file of JSON entries, one per line.  Each entry carries
+// the hash of the one before it, and its own hash covers that, so
+// editing, removing or reordering entries anywhere but at the end of
+// the log breaks the chain, as Verify reports.  Truncation is only
+// detected by checking the hash of the last entry against one noted
+// elsewhere, e.g. by monitoring.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The hash the first entry of a log follows.
+const Genesis = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// One administrative request, as received and as handled.
+type Entry struct {
+	// Numbered from one, without gaps
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+
+	// Where the request came from, e.g. the client's address
+	Source string `json:"source"`
+
+	// Who the client was, if known
+	Identity string `json:"identity"`
+
+	// The request's text, exactly as received
+	Request string `json:"request"`
+
+	// The request as analyzed, if it could be
+	Directive string `json:"directive"`
+
+	// "ok", or the error the client was sent
+	Outcome string `json:"outcome"`
+
+	// The OCN of the last change the request made, or zero if it
+	// failed or changed nothing
+	Ocn uint64 `json:"ocn"`
+
+	// The hash of the previous entry, or Genesis, and of this one
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// An entry as a line of the log.  Requests are left legible, rather
+// than having their HTML escaped.
+func (e *Entry) encode() []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(e); err != nil {
+		// Entries consist of nothing that can fail to encode.
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+// The hash of an entry, over everything but its own Hash.
+func (e *Entry) sum() string {
+	unhashed := *e
+	unhashed.Hash = ""
+
+	sum := sha256.Sum256(unhashed.encode())
+	return hex.EncodeToString(sum[:])
+}
+
+// An error in the chain of a log, at the given line.
+type ChainError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Check the chain of a log, returning the last entry, or nil if the
+// log is empty.  A *ChainError reports where the chain is broken.
+func Verify(r io.Reader) (*Entry, error) {
+	return verifyAfter(r, nil, nil)
+}
+
+// Verify, passing each entry to fn as it is found to be in order.
+func VerifyFunc(r io.Reader, fn func(e *Entry)) (*Entry, error) {
+	return verifyAfter(r, nil, fn)
+}
+
+// Check the chain of entries following the given one, or starting the
+// log if nil.
+func verifyAfter(r io.Reader, last *Entry,
+	fn func(e *Entry)) (*Entry, error) {
+	prev := Genesis
+	if last != nil {
+		prev = last.Hash
+	}
+
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return last, nil
+		} else if err == io.EOF {
+			return last, &ChainError{line, "incomplete entry"}
+		} else if err != nil {
+			return last, err
+		}
+
+		e := new(Entry)
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(e); err != nil {
+			return last, &ChainError{line,
+				fmt.Sprintf("malformed entry: %v", err)}
+		}
+
+		switch {
+		case last == nil && e.Seq != 1:
+			return last, &ChainError{line, fmt.Sprintf(
+				"first entry is number %d", e.Seq)}
+		case last != nil && e.Seq != last.Seq+1:
+			return last, &ChainError{line, fmt.Sprintf(
+				"entry %d follows entry %d", e.Seq, last.Seq)}
+		case e.Prev != prev:
+			return last, &ChainError{line, fmt.Sprintf(
+				"entry %d does not follow the hash %s",
+				e.Seq, prev)}
+		case e.Hash != e.sum():
+			return last, &ChainError{line, fmt.Sprintf(
+				"entry %d does not match its hash", e.Seq)}
+		}
+
+		if fn != nil {
+			fn(e)
+		}
+
+		last = e
+		prev = e.Hash
+	}
+}
+
+// A log being appended to.
+//
+// Several processes may append to the same log, as happens for a
+// while when dog is upgraded: the file is locked for each entry, and
+// the chain picked up from whatever was appended in the meantime.
+type Log struct {
+	sync.Mutex
+	f *os.File
+
+	// The size of the file, and the last entry in it, as of the
+	// last append
+	size int64
+	last *Entry
+}
+
+// Open a log for appending, creating it if need be.  An existing log
+// must verify, so that its chain can be continued.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{f: f}
+	if err := l.lock(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	defer l.unlock()
+
+	if l.last, err = Verify(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	if l.size, err = f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) lock() error {
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_EX)
+}
+
+func (l *Log) unlock() {
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
+
+// Catch up on entries appended by other processes since the last
+// append.
+func (l *Log) catchUp() error {
+	fi, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() == l.size {
+		return nil
+	}
+
+	// Only the last entry matters, but the ones before it may as
+	// well be checked on the way.
+	r := io.NewSectionReader(l.f, l.size, fi.Size()-l.size)
+	if l.last, err = verifyAfter(r, l.last, nil); err != nil {
+		return err
+	}
+
+	l.size = fi.Size()
+	return nil
+}
+
+// Append an entry, filling in its number, time and hashes, and
+// flushing it to disk before returning.
+func (l *Log) Append(e *Entry) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if err := l.lock(); err != nil {
+		return err
+	}
+
+	defer l.unlock()
+
+	if err := l.catchUp(); err != nil {
+		return err
+	}
+
+	e.Seq = 1
+	e.Prev = Genesis
+	if l.last != nil {
+		e.Seq = l.last.Seq + 1
+		e.Prev = l.last.Hash
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	e.Time = e.Time.UTC()
+	e.Hash = e.sum()
+
+	n, err := l.f.Write(e.encode())
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+
+	l.last = e
+	return nil
+}
+
+func (l *Log) Close() error {
+	return l.f.Close()
+}
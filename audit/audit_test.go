@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeLog(t *testing.T, path string, requests ...string) {
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	for _, req := range requests {
+		err := l.Append(&Entry{Source: "unix:/tmp/dog.sock",
+			Request: req, Outcome: "ok"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func tempLog(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "audit.log")
+}
+
+func TestChain(t *testing.T) {
+	path := tempLog(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// Reopening continues the chain.
+	writeLog(t, path, "[route all [get]]", "[route 'a' [get]]")
+	writeLog(t, path, "[route 'b' [get]]")
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := Verify(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last.Seq != 3 || last.Request != "[route 'b' [get]]" {
+		t.Errorf("Unexpected last entry %+v", last)
+	}
+
+	lines := strings.SplitAfter(string(b), "\n")
+	for _, tc := range []struct {
+		name     string
+		lines    []string
+		brokenAt int
+	}{
+		{"edited", []string{lines[0],
+			strings.Replace(lines[1], "'a'", "'z'", 1), lines[2]}, 2},
+		{"deleted", []string{lines[0], lines[2]}, 2},
+		{"reordered", []string{lines[1], lines[0], lines[2]}, 1},
+		{"incomplete", []string{lines[0], lines[1][:20]}, 2},
+	} {
+		_, err := Verify(strings.NewReader(strings.Join(tc.lines, "")))
+		ce, ok := err.(*ChainError)
+		if !ok {
+			t.Errorf("%v: expected a chain error, got %v",
+				tc.name, err)
+		} else if ce.Line != tc.brokenAt {
+			t.Errorf("%v: expected the chain to break at line "+
+				"%v, got %v", tc.name, tc.brokenAt, ce)
+		}
+	}
+}
+
+func TestTwoWriters(t *testing.T) {
+	path := tempLog(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	first, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer first.Close()
+
+	second, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer second.Close()
+
+	for i, l := range []*Log{first, second, first, second} {
+		e := &Entry{Request: "[route all [get]]", Outcome: "ok"}
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Seq != uint64(i+1) {
+			t.Errorf("Expected entry %v, got %v", i+1, e.Seq)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if _, err := Verify(f); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenBroken(t *testing.T) {
+	path := tempLog(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	err := ioutil.WriteFile(path, []byte("{\"seq\": 2}\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path); err == nil {
+		t.Error("Expected a broken log not to be opened")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"../dogconf"
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"os"
+)
+
+// Write the reply for a failed request, classifying errors that do
+// not carry a classification of their own as syntax errors, which is
+// all that remains once analysis and execution are accounted for.
+func writeAdminError(w io.Writer, err error) error {
+	return dogconf.WriteError(w, adminErrorCode(err), err)
+}
+
+func adminErrorCode(err error) string {
+	if ae, ok := err.(*adminError); ok {
+		return ae.code
+	}
+
+	return dogconf.ErrCodeSyntax
+}
+
+// Where an administrative connection comes from: the client's
+// address, or, for local clients, the socket they connected to.
+func adminPeer(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil &&
+		addr.String() != "" && addr.String() != "@" {
+		return addr.String()
+	}
+
+	return conn.LocalAddr().Network() + ":" + conn.LocalAddr().String()
+}
+
+// Serve dogconf requests from an administrative client until it
+// disconnects, replying to each in turn.
+func handleAdminConnection(conn net.Conn, ex *executor) {
+	defer conn.Close()
+
+	cl := &adminClient{addr: adminPeer(conn)}
+
+	var tc *tls.Conn
+	if ex.p.adminTLS != nil {
+		tc = tls.Server(conn, ex.p.adminTLS)
+		if err := tc.Handshake(); err != nil {
+			log.Printf("Could not negotiate TLS with "+
+				"administrative client %v: %v", cl.addr, err)
+			return
+		}
+
+		defer tc.Close()
+	}
+
+	ex.p.adminAuth.identify(cl, conn, tc)
+	if tc != nil {
+		conn = tc
+	}
+
+	br := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	secret, err := readBearer(br)
+	if err == io.EOF {
+		return
+	} else if err == nil && secret != "" {
+		err = ex.p.adminAuth.identifyToken(cl, secret)
+	}
+
+	if err != nil {
+		// Not a request, but the attempt is worth noting.
+		log.Printf("Could not authenticate administrative "+
+			"client %v: %v", cl.addr, err)
+		ex.p.audit(cl, "", nil, 0, err)
+		writeAdminError(w, err)
+		w.Flush()
+		return
+	}
+
+	p := dogconf.NewParser("", br)
+
+	for {
+		req, err := p.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			// There is no telling where the next request
+			// begins after a syntax error, so give up on
+			// the connection.
+			log.Printf("Bad administrative request: %v", err)
+			ex.p.audit(cl, p.Text(), nil, 0, err)
+			writeAdminError(w, err)
+			w.Flush()
+			return
+		}
+
+		d, err := dogconf.Analyze(req)
+		if wd, ok := d.(*dogconf.WatchDirective); ok {
+			// A watch takes the connection over.
+			var sub *subscription
+			err := cl.authorize(wd)
+			if err == nil {
+				sub, err = ex.subscribe(wd)
+			}
+
+			ex.p.audit(cl, p.Text(), d, 0, err)
+			if err != nil {
+				err = writeAdminError(w, err)
+			} else {
+				err = ex.watch(conn, w, sub)
+			}
+
+			if err == nil {
+				err = w.Flush()
+			}
+
+			if err != nil {
+				log.Printf("Could not serve administrative "+
+					"watch: %v\n", err)
+			}
+
+			return
+		}
+
+		recs, err := ex.serve(cl, p.Text(), d, err)
+		if err != nil {
+			err = writeAdminError(w, err)
+		} else {
+			err = dogconf.WriteReply(w, recs)
+		}
+
+		if err == nil {
+			err = w.Flush()
+		}
+
+		if err != nil {
+			log.Printf("Could not reply to administrative "+
+				"client: %v", err)
+			return
+		}
+	}
+}
+
+// Authorize and execute a directive for a client, noting it in the
+// audit log along with the request's text.  The error is that of the
+// request's analysis, if it failed.
+func (ex *executor) serve(cl *adminClient, text string,
+	d dogconf.Directive, err error) ([]*dogconf.Record, error) {
+	var recs []*dogconf.Record
+	var ocn uint64
+	if err != nil {
+		err = &adminError{err, dogconf.ErrCodeSemantic}
+	} else if err = cl.authorize(d); err == nil {
+		recs, ocn, err = ex.execute(d, cl.who())
+	}
+
+	ex.p.audit(cl, text, d, ocn, err)
+	return recs, err
+}
+
+// Accept administrative clients on the listener until it is closed.
+func serveAdmin(ln net.Listener, ex *executor) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Error accepting administrative "+
+				"client: %v\n", err)
+
+			// The listener is closed upon an upgrade.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+
+			return
+		}
+
+		go handleAdminConnection(conn, ex)
+	}
+}
+
+// Execute every request in a dogconf file, in order, stopping at the
+// first that fails.
+func loadConfig(path string, ex *executor) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	p := dogconf.NewParser(path, f)
+	for {
+		req, err := p.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if _, err = ex.run(req, path); err != nil {
+			return err
+		}
+	}
+}
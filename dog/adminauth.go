@@ -0,0 +1,418 @@
+package main
+
+import (
+	"../dogconf"
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Who may do what through the administrative interface, as loaded
+// from the file given with -admin-auth, which grants one role per
+// line:
+//
+//	METHOD CREDENTIAL ROLE [ROUTES]
+//
+// METHOD is how the client is authenticated, and CREDENTIAL what
+// they must authenticate as:
+//
+//	peer   a local user, by name or uid, connected to a unix
+//	       socket, as reported by SO_PEERCRED
+//	cert   the common name of a TLS client certificate, signed by
+//	       the authority given with -admin-tls-ca
+//	token  NAME:SECRET, where clients give SECRET as a bearer
+//	       token, and are known as NAME
+//
+// ROLE is "read", permitting only 'get', 'history', 'watch',
+// 'explain' and 'dump', or "write", permitting every action.  ROUTES,
+// if given, is a comma-separated list of patterns, as for path.Match,
+// limiting the grant to routes with matching names; only routes named
+// outright can then be acted upon, not 'all' of them.
+//
+// A client may connect with several credentials, e.g. both as a
+// local user and with a token: the token or certificate is who they
+// are taken to be, as the more specific.  Clients granted nothing are
+// denied every request.
+type adminAuth struct {
+	grants []*adminGrant
+}
+
+type adminGrant struct {
+	method string
+	name   string
+
+	// The secret of a token
+	secret string
+
+	write bool
+
+	// Patterns of the names of the routes covered, or nil for
+	// every object
+	routes []string
+}
+
+// Every client is granted everything when no grants are given.
+var unrestricted = []*adminGrant{{write: true}}
+
+func loadAdminAuth(authPath string) (*adminAuth, error) {
+	f, err := os.Open(authPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	a := &adminAuth{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		g, err := parseAdminGrant(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", authPath, n, err)
+		}
+
+		a.grants = append(a.grants, g)
+	}
+
+	return a, scanner.Err()
+}
+
+func parseAdminGrant(fields []string) (*adminGrant, error) {
+	if len(fields) != 3 && len(fields) != 4 {
+		return nil, fmt.Errorf("expected 3 or 4 fields, got %d",
+			len(fields))
+	}
+
+	g := &adminGrant{method: fields[0], name: fields[1]}
+	switch g.method {
+	case "peer", "cert":
+	case "token":
+		i := strings.Index(g.name, ":")
+		if i <= 0 || i == len(g.name)-1 {
+			return nil, fmt.Errorf("expected a token as " +
+				"NAME:SECRET")
+		}
+
+		g.name, g.secret = g.name[:i], g.name[i+1:]
+	default:
+		return nil, fmt.Errorf("expected a method of 'peer', "+
+			"'cert' or 'token', got %q", g.method)
+	}
+
+	switch fields[2] {
+	case "read":
+	case "write":
+		g.write = true
+	default:
+		return nil, fmt.Errorf("expected a role of 'read' or "+
+			"'write', got %q", fields[2])
+	}
+
+	if len(fields) == 4 {
+		g.routes = splitList(fields[3])
+		for _, pattern := range g.routes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("bad route pattern "+
+					"%q: %v", pattern, err)
+			}
+		}
+	}
+
+	return g, nil
+}
+
+// The TLS configuration of the administrative address, given with
+// -admin-tls-cert and -admin-tls-key, verifying any client
+// certificates against the authorities given with -admin-tls-ca.
+func loadAdminTLS(certPath, keyPath, caPath string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caPath == "" {
+		return conf, nil
+	}
+
+	pem, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.ClientCAs = x509.NewCertPool()
+	if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %v", caPath)
+	}
+
+	// Clients may authenticate by token instead.
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+	return conf, nil
+}
+
+// The grants to a client authenticated by the given method as any of
+// the given names.
+func (a *adminAuth) lookup(method string, names ...string) []*adminGrant {
+	var found []*adminGrant
+	for _, g := range a.grants {
+		for _, name := range names {
+			if g.method == method && g.name == name {
+				found = append(found, g)
+				break
+			}
+		}
+	}
+
+	return found
+}
+
+// The name of the token with the given secret, and the grants to it.
+// The name is empty if no token has the secret.
+func (a *adminAuth) token(secret string) (string, []*adminGrant) {
+	var name string
+	var found []*adminGrant
+	for _, g := range a.grants {
+		if g.method == "token" && subtle.ConstantTimeCompare(
+			[]byte(g.secret), []byte(secret)) == 1 {
+			name = g.name
+			found = append(found, g)
+		}
+	}
+
+	return name, found
+}
+
+// The user on the other end of a unix socket, if that is what the
+// connection is.
+func peerUser(conn net.Conn) (*syscall.Ucred, bool) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, false
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+
+	return cred, err == nil
+}
+
+// Identify a client of the administrative address by the credentials
+// of their connection, and of the TLS connection over it, if
+// -admin-tls-cert was given.  Without -admin-auth, the client is
+// identified as far as possible, but granted everything.
+func (a *adminAuth) identify(cl *adminClient, conn net.Conn,
+	tc *tls.Conn) {
+	if a == nil {
+		cl.grants = unrestricted
+	}
+
+	if tc != nil {
+		certs := tc.ConnectionState().PeerCertificates
+		if len(certs) > 0 {
+			cn := certs[0].Subject.CommonName
+			cl.identity = "cert:" + cn
+			if a != nil {
+				cl.grants = a.lookup("cert", cn)
+			}
+
+			return
+		}
+	}
+
+	if cred, ok := peerUser(conn); ok {
+		uid := strconv.FormatUint(uint64(cred.Uid), 10)
+		name := uid
+		if u, err := user.LookupId(uid); err == nil {
+			name = u.Username
+		}
+
+		cl.identity = "peer:" + name
+		if a != nil {
+			cl.grants = a.lookup("peer", name, uid)
+		}
+	}
+}
+
+// Identify a client by a bearer token, which takes precedence over
+// how their connection identifies them.  Without -admin-auth, tokens
+// are ignored, as every client is granted everything anyway.
+func (a *adminAuth) identifyToken(cl *adminClient, secret string) error {
+	if a == nil {
+		return nil
+	}
+
+	name, grants := a.token(secret)
+	if name == "" {
+		return &adminError{fmt.Errorf("unknown token"),
+			dogconf.ErrCodeDenied}
+	}
+
+	cl.identity = "token:" + name
+	cl.grants = grants
+	return nil
+}
+
+// Read the bearer token a client may begin with, on a line of its
+// own:
+//
+//	bearer TOKEN
+//
+// Returns the empty string if the client begins with a request
+// instead.
+func readBearer(br *bufio.Reader) (string, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return "", err
+		}
+
+		if b[0] == '[' {
+			return "", nil
+		} else if !dogconf.IsWhitespace(rune(b[0])) {
+			break
+		}
+
+		br.ReadByte()
+	}
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "bearer") {
+		return "", fmt.Errorf("Expected a request, or " +
+			"'bearer TOKEN'")
+	}
+
+	return fields[1], nil
+}
+
+// Whether a directive only reports on objects.
+func readOnly(d dogconf.Directive) bool {
+	switch d.(type) {
+	case *dogconf.GetDirective, *dogconf.HistoryDirective,
+		*dogconf.WatchDirective, *dogconf.ExplainDirective,
+		*dogconf.DumpDirective:
+		return true
+	}
+
+	return false
+}
+
+// The kind of object a directive acts upon, and its identifier, or ""
+// for every object of the kind.
+func directiveObject(d dogconf.Directive) (dogconf.Kind, string) {
+	target := func(t dogconf.Target) string {
+		switch t := t.(type) {
+		case *dogconf.TargetOne:
+			return t.What
+		case *dogconf.TargetOcn:
+			return t.What
+		}
+
+		return ""
+	}
+
+	switch d := d.(type) {
+	case *dogconf.GetDirective:
+		return d.Kind, target(d.Target)
+	case *dogconf.CreateDirective:
+		return d.Kind, d.What
+	case *dogconf.PatchDirective:
+		return d.Kind, d.What
+	case *dogconf.DeleteDirective:
+		return d.Kind, target(d.Target)
+	case *dogconf.TerminateDirective:
+		return d.Kind, target(d.Target)
+	case *dogconf.DrainDirective:
+		return d.Kind, d.What
+	case *dogconf.WatchDirective:
+		return d.Kind, target(d.Target)
+	case *dogconf.HistoryDirective:
+		return d.Kind, target(d.Target)
+	case *dogconf.RevertDirective:
+		return d.Kind, d.What
+	case *dogconf.ExplainDirective:
+		return directiveObject(d.Directive)
+	case *dogconf.DumpDirective:
+		return d.Kind, ""
+	}
+
+	panic(fmt.Errorf("Unexpected directive type %T", d))
+}
+
+func (g *adminGrant) permits(d dogconf.Directive) bool {
+	if !g.write && !readOnly(d) {
+		return false
+	}
+
+	if g.routes == nil {
+		return true
+	}
+
+	kind, id := directiveObject(d)
+	if kind != dogconf.RouteKind || id == "" {
+		return false
+	}
+
+	for _, pattern := range g.routes {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check that the client may make the request a directive came from,
+// blaming the action of the first they may not.
+func (cl *adminClient) authorize(d dogconf.Directive) error {
+	if td, ok := d.(*dogconf.TransactionDirective); ok {
+		for _, d := range td.Directives {
+			if err := cl.authorize(d); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, g := range cl.grants {
+		if g.permits(d) {
+			return nil
+		}
+	}
+
+	kind, id := directiveObject(d)
+	object := fmt.Sprintf("%v %q", kind, id)
+	if id == "" {
+		object = fmt.Sprintf("every %v", kind)
+	}
+
+	return adminErrf(dogconf.ErrCodeDenied, d, "%v may not '%v' %v",
+		cl.who(), d.Blame().Lexeme, object)
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"../dogconf"
+	"bytes"
+	"encoding/binary"
+	"expvar"
+	"femebe"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The administrative database is served by dog itself, rather than
+// routed, for the benefit of psql.  Connecting to it, by the name given
+// with -admin-dbname, offers these commands, as simple queries:
+//
+//	SHOW ROUTES
+//	SHOW SESSIONS
+//	SHOW BACKENDS
+//	SHOW STATS
+//	SHOW LISTENERS
+//
+// Queries beginning with '[' are taken as dogconf requests instead, as
+// though sent to the administrative address, and their records
+// returned as rows, one column per attribute and status.
+//
+// With -admin-auth, clients are authenticated by password, which must
+// be one of the tokens granted a role, see adminauth.go.  Without it,
+// clients are not authenticated, so the database should be limited to
+// trusted addresses by access rules.
+
+// SQLSTATEs for the ways a dogconf request may fail.
+var adminErrStates = map[string]string{
+	dogconf.ErrCodeSyntax:   "42601",
+	dogconf.ErrCodeSemantic: "22023",
+	dogconf.ErrCodeConflict: "40001",
+	dogconf.ErrCodeNotFound: "42704",
+	dogconf.ErrCodeExists:   "42710",
+	dogconf.ErrCodeInvalid:  "22023",
+	dogconf.ErrCodeDenied:   "42501",
+}
+
+// A result to send as rows.  Cells missing from a row are NULL.
+type adminResult struct {
+	tag  string
+	cols []string
+	rows []map[string]string
+}
+
+// Serve the administrative database to a client past startup.
+func (p *proxy) serveAdminDb(c *femebe.MessageStream,
+	cl *adminClient) error {
+	var m femebe.Message
+
+	if err := p.authenticateAdminDb(c, cl); err != nil {
+		return err
+	}
+
+	m.InitFromBytes('R', []byte{0, 0, 0, 0})
+	if err := c.Send(&m); err != nil {
+		return err
+	}
+
+	for _, param := range [][2]string{
+		{"server_version", "9.6 (dog)"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+	} {
+		var buf bytes.Buffer
+		writeCString(&buf, param[0])
+		writeCString(&buf, param[1])
+		m.InitFromBytes('S', buf.Bytes())
+		if err := c.Send(&m); err != nil {
+			return err
+		}
+	}
+
+	// Messages of the extended protocol are refused once, and
+	// everything up to the next Sync discarded, simple Queries
+	// included, as Postgres does after an error.
+	refusing := false
+
+	for {
+		if err := sendReady(c, refusing); err != nil {
+			return err
+		}
+
+		for {
+			if err := c.Next(&m); err != nil {
+				return err
+			}
+
+			payload, err := m.Force()
+			if err != nil {
+				return err
+			}
+
+			switch m.MsgType() {
+			case 'X':
+				return io.EOF
+			case 'Q':
+				if refusing {
+					continue
+				}
+
+				sql, _ := readCString(payload)
+				err = p.adminQuery(c, sql, cl)
+			case 'S':
+				refusing = false
+			default:
+				if !refusing {
+					refusing = true
+					initErrorResponse(&m, "ERROR", "0A000",
+						"only simple queries are "+
+							"supported")
+					err = c.Send(&m)
+				}
+
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			break
+		}
+	}
+}
+
+func sendReady(c *femebe.MessageStream, refusing bool) error {
+	if refusing {
+		return nil
+	}
+
+	var m femebe.Message
+	m.InitFromBytes('Z', []byte{'I'})
+	if err := c.Send(&m); err != nil {
+		return err
+	}
+
+	return c.Flush()
+}
+
+// Authenticate a client of the administrative database by a token as
+// their password, if tokens are required.  Otherwise, the client is
+// known by the user they claim to be, and granted everything.
+func (p *proxy) authenticateAdminDb(c *femebe.MessageStream,
+	cl *adminClient) error {
+	if p.adminAuth == nil {
+		cl.grants = unrestricted
+		return nil
+	}
+
+	var m femebe.Message
+	m.InitFromBytes('R', []byte{0, 0, 0, 3})
+	if err := c.Send(&m); err != nil {
+		return err
+	}
+
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	if err := c.Next(&m); err != nil {
+		return err
+	}
+
+	payload, err := m.Force()
+	if err != nil {
+		return err
+	}
+
+	secret, _ := readCString(payload)
+	if m.MsgType() != 'p' {
+		err = fmt.Errorf("expected a password message")
+	} else {
+		err = p.adminAuth.identifyToken(cl, secret)
+	}
+
+	if err != nil {
+		p.audit(cl, "", nil, 0, err)
+		sendError(c, "FATAL", "28P01", fmt.Sprintf(
+			"password authentication failed for user %q: %v",
+			cl.identity, err))
+		return err
+	}
+
+	return nil
+}
+
+// Answer one simple query, which may hold several dogconf requests
+// or SHOW commands.
+func (p *proxy) adminQuery(c *femebe.MessageStream, sql string,
+	cl *adminClient) error {
+	var results []*adminResult
+	var err error
+
+	if strings.HasPrefix(strings.TrimSpace(sql), "[") {
+		results, err = p.adminRequests(sql, cl)
+	} else {
+		for _, stmt := range sqlStatements(sql) {
+			var res *adminResult
+			if res, err = p.adminShow(stmt); err != nil {
+				break
+			}
+
+			results = append(results, res)
+		}
+	}
+
+	// Results before any error are sent, as Postgres would.
+	for _, res := range results {
+		if werr := writeResult(c, res); werr != nil {
+			return werr
+		}
+	}
+
+	if err != nil {
+		state := "42601"
+		if ae, ok := err.(*adminError); ok {
+			state = adminErrStates[ae.code]
+		}
+
+		var m femebe.Message
+		initErrorResponse(&m, "ERROR", state, err.Error())
+		return c.Send(&m)
+	}
+
+	if len(results) == 0 {
+		var m femebe.Message
+		m.InitFromBytes('I', nil)
+		return c.Send(&m)
+	}
+
+	return nil
+}
+
+// Run dogconf requests, stopping at the first to fail.
+func (p *proxy) adminRequests(text string, cl *adminClient) (
+	[]*adminResult, error) {
+	parser := dogconf.NewParser("", strings.NewReader(text))
+
+	var results []*adminResult
+	for {
+		req, err := parser.Next()
+		if err == io.EOF {
+			return results, nil
+		} else if err != nil {
+			err = &adminError{err, dogconf.ErrCodeSyntax}
+			p.audit(cl, parser.Text(), nil, 0, err)
+			return results, err
+		}
+
+		d, err := dogconf.Analyze(req)
+		recs, err := p.ex.serve(cl, parser.Text(), d, err)
+		if err != nil {
+			return results, err
+		}
+
+		results = append(results, recordResult(recs))
+	}
+}
+
+func (p *proxy) adminShow(stmt string) (*adminResult, error) {
+	switch stmt {
+	case "SHOW ROUTES":
+		return p.showKind(dogconf.RouteKind), nil
+	case "SHOW LISTENERS":
+		return p.showKind(dogconf.ListenerKind), nil
+	case "SHOW BACKENDS":
+		return p.showBackends(), nil
+	case "SHOW SESSIONS":
+		return p.showSessions(), nil
+	case "SHOW STATS":
+		return showStats(), nil
+	}
+
+	return nil, fmt.Errorf("unrecognized command %q: expected SHOW "+
+		"ROUTES, SESSIONS, BACKENDS, STATS or LISTENERS, "+
+		"or a dogconf request", stmt)
+}
+
+func (p *proxy) showKind(kind dogconf.Kind) *adminResult {
+	recs := p.ex.table(kind).list()
+	for _, rec := range recs {
+		p.annotate(rec)
+	}
+
+	res := recordResult(recs)
+	res.tag = "SHOW"
+	return res
+}
+
+// Every server in use or configured, whether or not it is a backend
+// object.
+func (p *proxy) showBackends() *adminResult {
+	recs := make(map[string]*dogconf.Record)
+	for _, rec := range p.backends.list() {
+		recs[rec.Id] = rec
+	}
+
+	add := func(addr string) {
+		if addr != "" && recs[addr] == nil {
+			recs[addr] = &dogconf.Record{
+				Kind:  dogconf.BackendKind,
+				Id:    addr,
+				Attrs: map[string]string{},
+			}
+		}
+	}
+
+	for addr := range p.adm.stats().Backends {
+		add(addr)
+	}
+
+	for _, ent := range p.rt.all() {
+		add(ent.addr)
+		add(ent.canary)
+		add(ent.mirror)
+		for _, addr := range ent.replicas {
+			add(addr)
+		}
+	}
+
+	addrs := make([]string, 0, len(recs))
+	for addr := range recs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	sorted := make([]*dogconf.Record, len(addrs))
+	for i, addr := range addrs {
+		sorted[i] = recs[addr]
+		p.annotate(sorted[i])
+	}
+
+	res := recordResult(sorted)
+	res.tag = "SHOW"
+	return res
+}
+
+func (p *proxy) showSessions() *adminResult {
+	sessions := p.sessions.all()
+	sort.Sort(byId(sessions))
+
+	res := &adminResult{tag: "SHOW"}
+	for _, s := range sessions {
+		row := s.describe()
+		if res.cols == nil {
+			for col := range row {
+				if col != "id" {
+					res.cols = append(res.cols, col)
+				}
+			}
+			sort.Strings(res.cols)
+			res.cols = append([]string{"id"}, res.cols...)
+		}
+
+		res.rows = append(res.rows, row)
+	}
+
+	if res.cols == nil {
+		res.cols = []string{"id"}
+	}
+
+	return res
+}
+
+// The published metrics, each as JSON.  Those of the Go runtime are
+// left out.
+func showStats() *adminResult {
+	res := &adminResult{tag: "SHOW", cols: []string{"name", "value"}}
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "memstats" || kv.Key == "cmdline" {
+			return
+		}
+
+		res.rows = append(res.rows, map[string]string{
+			"name":  kv.Key,
+			"value": kv.Value.String(),
+		})
+	})
+
+	return res
+}
+
+// Lay out records as rows: their kind, identifier and OCN, then each
+// attribute and status any of them has, in alphabetical order.
+func recordResult(recs []*dogconf.Record) *adminResult {
+	attrs := make(map[string]bool)
+	status := make(map[string]bool)
+	res := &adminResult{tag: "SELECT " + strconv.Itoa(len(recs))}
+
+	for _, rec := range recs {
+		row := map[string]string{
+			"kind": string(rec.Kind),
+			"id":   rec.Id,
+		}
+
+		if rec.Ocn != 0 {
+			row["ocn"] = strconv.FormatUint(rec.Ocn, 10)
+		}
+
+		for k, v := range rec.Attrs {
+			attrs[k] = true
+			row[k] = v
+		}
+
+		for k, v := range rec.Status {
+			status[k] = true
+			row[k] = v
+		}
+
+		res.rows = append(res.rows, row)
+	}
+
+	res.cols = append([]string{"kind", "id", "ocn"},
+		sortedKeys(attrs)...)
+	res.cols = append(res.cols, sortedKeys(status)...)
+	return res
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Send a result as RowDescription, DataRows and CommandComplete, with
+// every column as text.
+func writeResult(c *femebe.MessageStream, res *adminResult) error {
+	var m femebe.Message
+	var buf bytes.Buffer
+
+	binary.Write(&buf, binary.BigEndian, int16(len(res.cols)))
+	for _, col := range res.cols {
+		writeCString(&buf, col)
+
+		// No table, the text type, its length and modifier, and
+		// the text format
+		binary.Write(&buf, binary.BigEndian, int32(0))
+		binary.Write(&buf, binary.BigEndian, int16(0))
+		binary.Write(&buf, binary.BigEndian, int32(25))
+		binary.Write(&buf, binary.BigEndian, int16(-1))
+		binary.Write(&buf, binary.BigEndian, int32(-1))
+		binary.Write(&buf, binary.BigEndian, int16(0))
+	}
+
+	m.InitFromBytes('T', buf.Bytes())
+	if err := c.Send(&m); err != nil {
+		return err
+	}
+
+	for _, row := range res.rows {
+		buf.Reset()
+		binary.Write(&buf, binary.BigEndian, int16(len(res.cols)))
+		for _, col := range res.cols {
+			val, ok := row[col]
+			if !ok {
+				binary.Write(&buf, binary.BigEndian, int32(-1))
+				continue
+			}
+
+			binary.Write(&buf, binary.BigEndian, int32(len(val)))
+			buf.WriteString(val)
+		}
+
+		m.InitFromBytes('D', buf.Bytes())
+		if err := c.Send(&m); err != nil {
+			return err
+		}
+	}
+
+	m.InitFromBytes('C', cString(res.tag))
+	return c.Send(&m)
+}
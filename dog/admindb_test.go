@@ -0,0 +1,75 @@
+package main
+
+import (
+	"femebe"
+	"net"
+	"testing"
+)
+
+// Connect to the administrative database, past startup.
+func testAdminDb(t *testing.T) (*femebe.MessageStream, net.Conn) {
+	ex := testExecutor()
+	cConn, sConn := net.Pipe()
+
+	go func() {
+		defer sConn.Close()
+
+		ex.p.serveAdminDb(femebe.NewServerMessageStream("Client",
+			newBufWriteCon(sConn)), &adminClient{addr: "test"})
+	}()
+
+	c := femebe.NewServerMessageStream("Server", newBufWriteCon(cConn))
+
+	var m femebe.Message
+	for m.MsgType() != 'Z' {
+		if err := c.Next(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return c, cConn
+}
+
+func send(t *testing.T, c *femebe.MessageStream, msgs ...*femebe.Message) {
+	for _, m := range msgs {
+		if err := c.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminDbRefusesUntilSync(t *testing.T) {
+	c, conn := testAdminDb(t)
+	defer conn.Close()
+
+	send(t, c,
+		clientMessage('P', "", "SELECT 1", "\x00\x00"),
+		clientMessage('Q', "SHOW ROUTES"),
+		clientMessage('S'))
+
+	// The Query is discarded along with the Parse, leaving one
+	// error and one ReadyForQuery, and the next is answered in
+	// full.
+	expect(t, c, 'E', 'Z')
+
+	send(t, c, clientMessage('Q', "SHOW ROUTES"))
+	expect(t, c, 'T', 'C', 'Z')
+}
+
+func expect(t *testing.T, c *femebe.MessageStream, types ...byte) {
+	for _, typ := range types {
+		var m femebe.Message
+		if err := c.Next(&m); err != nil {
+			t.Fatal(err)
+		}
+
+		if m.MsgType() != typ {
+			t.Fatalf("Expected a message of type %c, got %c",
+				typ, m.MsgType())
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"../audit"
+	"../dogconf"
+	"../dogconf/stable"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A client of the administrative interface: over the administrative
+// address, or the administrative database.
+type adminClient struct {
+	// Where the client connected from
+	addr string
+
+	// Who the client is, if known, e.g. "peer:postgres", see
+	// adminauth.go
+	identity string
+
+	// What the client may do
+	grants []*adminGrant
+}
+
+// How the client is named in the history of the changes they make.
+func (cl *adminClient) who() string {
+	if cl.identity == "" {
+		return cl.addr
+	}
+
+	return cl.identity + "@" + cl.addr
+}
+
+// Note an administrative request in the audit log, if one is kept:
+// its text, the directive it was analyzed into, if it got that far,
+// the OCN of the last change it made, if any, and the error it failed
+// with, if any.
+func (p *proxy) audit(cl *adminClient, text string, d dogconf.Directive,
+	ocn uint64, err error) {
+	if p.auditLog == nil {
+		return
+	}
+
+	e := &audit.Entry{
+		Time:     time.Now(),
+		Source:   cl.addr,
+		Identity: cl.identity,
+		Request:  text,
+		Outcome:  "ok",
+		Ocn:      ocn,
+	}
+
+	if d != nil {
+		e.Directive = stable.Sprintf("%#v", d)
+	}
+
+	if err != nil {
+		e.Outcome = fmt.Sprintf("%v: %v", adminErrorCode(err), err)
+	}
+
+	if err := p.auditLog.Append(e); err != nil {
+		log.Printf("Could not write audit log entry for %q "+
+			"from %v: %v", text, cl.who(), err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"../dogconf"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Settings for one backend server, shared by every route that dials
+// it.  Backends are identified by their address, exactly as written
+// in the 'addr' of routes.
+type backendEntry struct {
+	addr string
+	ocn  uint64
+
+	// Zero for no limit
+	maxConnections int
+}
+
+func newBackendEntry(addr string, ocn uint64,
+	attrs map[string]string) (*backendEntry, error) {
+	be := &backendEntry{addr: addr, ocn: ocn}
+
+	if n, ok := attrs["maxConnections"]; ok {
+		var err error
+		be.maxConnections, err = strconv.Atoi(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return be, nil
+}
+
+func (be *backendEntry) record() *dogconf.Record {
+	return &dogconf.Record{
+		Kind: dogconf.BackendKind,
+		Id:   be.addr,
+		Ocn:  be.ocn,
+		Attrs: map[string]string{
+			"maxConnections": strconv.Itoa(be.maxConnections),
+		},
+	}
+}
+
+type backendTable struct {
+	tab map[string]*backendEntry
+	sync.RWMutex
+}
+
+func newBackendTable() *backendTable {
+	return &backendTable{tab: make(map[string]*backendEntry)}
+}
+
+// The connection limit of the backend at addr, or zero if there is
+// none.
+func (bt *backendTable) limit(addr string) int {
+	bt.RLock()
+	defer bt.RUnlock()
+
+	if be := bt.tab[addr]; be != nil {
+		return be.maxConnections
+	}
+
+	return 0
+}
+
+// Implementation of objectTable, for the executor.
+
+func (bt *backendTable) lookup(id string) (*dogconf.Record, bool) {
+	bt.RLock()
+	defer bt.RUnlock()
+
+	be, ok := bt.tab[id]
+	if !ok {
+		return nil, false
+	}
+
+	return be.record(), true
+}
+
+func (bt *backendTable) list() []*dogconf.Record {
+	bt.RLock()
+	defer bt.RUnlock()
+
+	ids := make([]string, 0, len(bt.tab))
+	for id := range bt.tab {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	recs := make([]*dogconf.Record, len(ids))
+	for i, id := range ids {
+		recs[i] = bt.tab[id].record()
+	}
+
+	return recs
+}
+
+func (bt *backendTable) store(id string, ocn uint64,
+	attrs map[string]string) error {
+	be, err := newBackendEntry(id, ocn, attrs)
+	if err != nil {
+		return err
+	}
+
+	bt.Lock()
+	defer bt.Unlock()
+
+	bt.tab[id] = be
+	return nil
+}
+
+func (bt *backendTable) remove(id string) {
+	bt.Lock()
+	defer bt.Unlock()
+
+	delete(bt.tab, id)
+}
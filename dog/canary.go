@@ -0,0 +1,105 @@
+package main
+
+import (
+	"../dogconf"
+	"expvar"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// Routes with a 'canary' send 'canaryPercent' of their new sessions to
+// the canary server, and the rest to 'addr', the stable server.  Each
+// session is sent one way or the other at random, or, with
+// 'canarySticky', by its user or client address, so that the same user
+// or client is sent the same way every time, and more of them the
+// canary's way as the percentage is raised.
+//
+// Sessions, connection failures and ErrorResponses are counted for
+// each arm, under "canary" in the metrics and in the status of the
+// route.
+//
+// The canary is removed by patching 'canary' to the empty string,
+// which unsets it along with 'canaryPercent' and 'canarySticky', and
+// all new sessions go to 'addr' again.  The counts are then no longer
+// reported in the route's status, though they remain in the metrics.
+
+var canaryStats = expvar.NewMap("canary")
+var canaryStatsLock sync.Mutex
+
+// The arms of a canary route.
+const (
+	stableArm = "stable"
+	canaryArm = "canary"
+)
+
+// The statistics of one arm of a route.
+func armStats(route, arm string) *expvar.Map {
+	canaryStatsLock.Lock()
+	defer canaryStatsLock.Unlock()
+
+	routeStats, ok := canaryStats.Get(route).(*expvar.Map)
+	if !ok {
+		routeStats = new(expvar.Map).Init()
+		canaryStats.Set(route, routeStats)
+	}
+
+	stats, ok := routeStats.Get(arm).(*expvar.Map)
+	if !ok {
+		stats = new(expvar.Map).Init()
+		routeStats.Set(arm, stats)
+	}
+
+	return stats
+}
+
+// Choose the arm of a canary route for a new session, returning the
+// arm and the server to connect to.
+func (ent *routingEntry) pickArm(user string, ci *clientInfo) (
+	string, string) {
+	// Percentages are compared in hundredths.
+	var bucket uint32
+	switch ent.canarySticky {
+	case "user":
+		bucket = stickyBucket(user)
+	case "address":
+		bucket = stickyBucket(ci.ip().String())
+	default:
+		bucket = uint32(rand.Intn(10000))
+	}
+
+	if float64(bucket) < ent.canaryPercent*100 {
+		return canaryArm, ent.canary
+	}
+
+	return stableArm, ent.addr
+}
+
+// Spread keys evenly, but always the same way, among 10000 buckets.
+func stickyBucket(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % 10000
+}
+
+// Add the counts of each arm to the status of a canary route.
+func annotateCanary(rec *dogconf.Record) {
+	if rec.Attrs["canary"] == "" {
+		return
+	}
+
+	for _, arm := range []string{stableArm, canaryArm} {
+		stats := armStats(rec.Id, arm)
+		for _, name := range []string{"sessions", "connectFailures",
+			"errors"} {
+			val := "0"
+			if v := stats.Get(name); v != nil {
+				val = v.String()
+			}
+
+			// e.g. canaryErrors
+			rec.Status[arm+strings.ToUpper(name[:1])+name[1:]] = val
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"../dogconf"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+)
+
+// The executor keeps every change it has made, and hands them on when
+// dog is upgraded, so that the history of each object can be
+// reported, and objects reverted to earlier versions.  Clients
+// watching for changes are told of each as it is made, and can resume
+// where they left off after reconnecting, even to the process dog has
+// been upgraded to.  A watcher that falls behind is cut off, and
+// resumes the same way.
+
+// How many changes may wait for a watcher before it is cut off.
+const watchQueueLen = 1024
+
+// One change to an object: its creation, patching or deletion, with
+// the record as it became, when and on whose behalf it was made.
+// Deleted objects are recorded without attributes, at the OCN of
+// their deletion.
+type change struct {
+	op  string
+	rec *dogconf.Record
+	at  time.Time
+	who string
+}
+
+// The change as reported by 'history': the record with how it came
+// to be as its status.
+func (c *change) record() *dogconf.Record {
+	rec := *c.rec
+	rec.Status = map[string]string{
+		"change": c.op,
+		"at":     c.at.Format(time.RFC3339),
+		"by":     c.who,
+	}
+
+	return &rec
+}
+
+type changeLog struct {
+	// In the order they were made, and so of their OCNs
+	changes []*change
+
+	watchers map[*watcher]bool
+}
+
+// The changes to one object, or every object of a kind if id is
+// empty, made after the given OCN.
+func (cl *changeLog) since(kind dogconf.Kind, id string,
+	ocn uint64) []*change {
+	var found []*change
+	for _, c := range cl.changes {
+		if c.rec.Kind == kind && (id == "" || c.rec.Id == id) &&
+			c.rec.Ocn > ocn {
+			found = append(found, c)
+		}
+	}
+
+	return found
+}
+
+// A client following the changes to one kind of object.
+type watcher struct {
+	kind dogconf.Kind
+
+	// Or every object of the kind, if empty
+	id string
+
+	// Closed if the watcher falls behind
+	out chan *change
+}
+
+func (w *watcher) wants(c *change) bool {
+	return c.rec.Kind == w.kind && (w.id == "" || c.rec.Id == w.id)
+}
+
+// Stop sending changes to the watcher.  It must still be subscribed.
+func (cl *changeLog) cutOff(w *watcher) {
+	delete(cl.watchers, w)
+	close(w.out)
+}
+
+// Note a change made by the executor, on behalf of ex.who, passing it
+// on to watchers.  The caller must hold the executor's lock.
+func (ex *executor) changed(op string, rec *dogconf.Record) {
+	cl := &ex.changes
+	c := &change{op: op, rec: rec, at: time.Now(), who: ex.who}
+
+	if ex.staged != nil {
+		*ex.staged = append(*ex.staged, c)
+		return
+	}
+
+	cl.changes = append(cl.changes, c)
+
+	for w := range cl.watchers {
+		if !w.wants(c) {
+			continue
+		}
+
+		select {
+		case w.out <- c:
+		default:
+			log.Printf("Administrative watcher fell behind, " +
+				"cutting it off\n")
+			cl.cutOff(w)
+		}
+	}
+}
+
+// Note the deletion of an object, at the given OCN.
+func (ex *executor) deleted(rec *dogconf.Record, ocn uint64) {
+	ex.changed("delete", &dogconf.Record{
+		Kind:  rec.Kind,
+		Id:    rec.Id,
+		Ocn:   ocn,
+		Attrs: map[string]string{},
+	})
+}
+
+// A watcher newly subscribed: the objects as they are, unless
+// resuming, the changes the watcher has yet to be told of, if
+// resuming, and the OCN the two are current as of.
+type subscription struct {
+	w       *watcher
+	recs    []*dogconf.Record
+	backlog []*change
+	ocn     uint64
+}
+
+// Start following changes as a watch directs.
+func (ex *executor) subscribe(d *dogconf.WatchDirective) (
+	*subscription, error) {
+	ex.Lock()
+	defer ex.Unlock()
+
+	if ex.retired {
+		return nil, &adminError{fmt.Errorf(
+			"dog has been upgraded; reconnect to watch"),
+			dogconf.ErrCodeInvalid}
+	}
+
+	w := &watcher{kind: d.Kind, out: make(chan *change, watchQueueLen)}
+	sub := &subscription{w: w, ocn: ex.ocn}
+	tab := ex.table(d.Kind)
+
+	switch t := d.Target.(type) {
+	case *dogconf.TargetAll:
+		if !d.Resume {
+			sub.recs = tab.list()
+		}
+	case *dogconf.TargetOne:
+		w.id = t.What
+		if rec, ok := tab.lookup(t.What); ok && !d.Resume {
+			sub.recs = []*dogconf.Record{rec}
+		}
+	default:
+		panic(fmt.Errorf("Unexpected target type %T for watch",
+			d.Target))
+	}
+
+	cl := &ex.changes
+	if d.Resume {
+		if d.Since > ex.ocn {
+			return nil, adminErrf(dogconf.ErrCodeInvalid, d,
+				"OCN %v has not been reached; the latest is %v",
+				d.Since, ex.ocn)
+		}
+
+		sub.backlog = cl.since(w.kind, w.id, d.Since)
+	}
+
+	if cl.watchers == nil {
+		cl.watchers = make(map[*watcher]bool)
+	}
+
+	cl.watchers[w] = true
+	return sub, nil
+}
+
+func (ex *executor) unsubscribe(w *watcher) {
+	ex.Lock()
+	defer ex.Unlock()
+
+	if ex.changes.watchers[w] {
+		ex.changes.cutOff(w)
+	}
+}
+
+// Cut off every watcher, e.g. once an upgrade has handed the objects
+// to another process.  The caller must hold the executor's lock.
+func (ex *executor) dropWatchers() {
+	for w := range ex.changes.watchers {
+		ex.changes.cutOff(w)
+	}
+}
+
+// Serve a subscribed watch on an administrative connection, until the
+// client disconnects or falls behind.  Nothing more is read from the
+// connection.
+func (ex *executor) watch(conn net.Conn, bw *bufio.Writer,
+	sub *subscription) error {
+	w, ocn := sub.w, sub.ocn
+	defer ex.unsubscribe(w)
+
+	if err := dogconf.WriteReply(bw, sub.recs); err != nil {
+		return err
+	}
+
+	for _, c := range sub.backlog {
+		if err := dogconf.WriteChange(bw, c.op, c.rec); err != nil {
+			return err
+		}
+	}
+
+	if err := dogconf.WriteSynced(bw, ocn); err != nil {
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(gone)
+	}()
+
+	for {
+		select {
+		case <-gone:
+			return nil
+		case c, ok := <-w.out:
+			if !ok {
+				writeAdminError(bw, &adminError{fmt.Errorf(
+					"watch cut off after OCN %v; resume "+
+						"with 'since'", ocn),
+					dogconf.ErrCodeConflict})
+				return bw.Flush()
+			}
+
+			ocn = c.rec.Ocn
+			err := dogconf.WriteChange(bw, c.op, c.rec)
+			if err == nil && len(w.out) == 0 {
+				err = bw.Flush()
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// Settings for retrying servers that cannot be connected to, such as
+// ones that are restarting.
+type dialRetry struct {
+	// Total time allowed for retrying, zero to make only one
+	// attempt
+	budget time.Duration
+
+	// Limits on the wait before each retry, which doubles from
+	// the first until reaching the maximum.  Neither is taken to
+	// be below minDialBackoff.
+	initial time.Duration
+	max     time.Duration
+}
+
+// The least limit on the wait before a retry, lest a server that
+// cannot be reached be redialed in a tight loop.
+const minDialBackoff = 10 * time.Millisecond
+
+// Resolve a server address into all the addresses to try in turn.
+// Unix socket paths and IP addresses stand alone, while host names
+// produce an address for every A and AAAA record.
+func candidateAddrs(place string) ([]string, error) {
+	if strings.Contains(place, "/") {
+		return []string{place}, nil
+	}
+
+	host, port, err := net.SplitHostPort(place)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+
+	return addrs, nil
+}
+
+// Connect to the server at place, trying each of its candidate
+// addresses in order, with the timeout applying to each.  When every
+// candidate fails, the whole set is retried after an exponentially
+// growing, jittered wait, until the retry budget is spent.
+//
+// Returns the connection, along with the address finally used and
+// the number of retries it took, for logging.
+func dialServer(place string, timeout time.Duration,
+	r dialRetry) (conn net.Conn, addr string, retries int, err error) {
+	start := time.Now()
+	backoff := r.initial
+	if backoff < minDialBackoff {
+		backoff = minDialBackoff
+	}
+
+	for {
+		var addrs []string
+		addrs, err = candidateAddrs(place)
+		if err == nil {
+			for _, addr = range addrs {
+				conn, err = autoDial(addr, timeout)
+				if err == nil {
+					return conn, addr, retries, nil
+				}
+			}
+		}
+
+		// Wait a random time up to the backoff ("full
+		// jitter"), so that clients disconnected together do
+		// not retry together.
+		wait := time.Duration(rand.Int63n(int64(backoff)))
+
+		if time.Since(start)+wait > r.budget {
+			return nil, "", retries, fmt.Errorf(
+				"gave up after %d retries: %v", retries, err)
+		}
+
+		time.Sleep(wait)
+		retries++
+
+		backoff *= 2
+		if backoff > r.max {
+			backoff = r.max
+		}
+
+		if backoff < minDialBackoff {
+			backoff = minDialBackoff
+		}
+	}
+}
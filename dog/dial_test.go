@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDialZeroBackoff(t *testing.T) {
+	// Nothing listens here, so each attempt fails at once.
+	place := filepath.Join(t.TempDir(), "missing.sock")
+
+	budget := 200 * time.Millisecond
+	_, _, retries, err := dialServer(place, time.Second,
+		dialRetry{budget: budget})
+	if err == nil {
+		t.Fatal("Dialing nothing succeeded")
+	}
+
+	// Waits average half the least backoff, so some forty retries
+	// are expected, where a tight loop would make thousands.
+	if most := int(8 * budget / minDialBackoff); retries > most {
+		t.Errorf("Retried %d times in %v, expected at most %d",
+			retries, budget, most)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"../dogconf"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Routes naming 'hosts' have their 'addr' kept pointing at one of
+// them in the route's 'role': the primary, a standby, or any host that
+// answers.  Each host is asked pg_is_in_recovery() every interval, and
+// when the route's host no longer plays its role, another that does
+// is put in its place, as though the route had been patched.  Only
+// new sessions go to the new host.
+//
+// The route's host is kept for as long as it qualifies, even if others
+// do too.  When several hosts claim to be the primary and the route's
+// is not among them, none is chosen, lest the route follow the wrong
+// side of a split.
+//
+// Discovery is turned off by patching 'hosts' to the empty string,
+// which unsets it along with 'role', leaving 'addr' where it was last
+// pointed.
+
+var discoveryStats = expvar.NewMap("discovery")
+
+type discoverer struct {
+	p        *proxy
+	ex       *executor
+	interval time.Duration
+
+	// The user to log in as, to the database of each route
+	user string
+
+	// Why each route's host could not be resolved last time, so
+	// that problems are logged only as they start
+	problems map[string]string
+}
+
+func newDiscoverer(p *proxy, ex *executor, interval time.Duration,
+	user string) *discoverer {
+	return &discoverer{
+		p:        p,
+		ex:       ex,
+		interval: interval,
+		user:     user,
+		problems: make(map[string]string),
+	}
+}
+
+// What a host was found to be.
+type hostRole struct {
+	inRecovery bool
+	err        error
+}
+
+// Resolve the host of every route each interval, forever.
+func (d *discoverer) run() {
+	for {
+		d.discoverAll()
+		time.Sleep(d.interval)
+	}
+}
+
+func (d *discoverer) discoverAll() {
+	var routes []*routingEntry
+	hosts := make(map[string]*routingEntry)
+	for _, ent := range d.p.rt.all() {
+		if len(ent.hosts) == 0 {
+			continue
+		}
+
+		routes = append(routes, ent)
+		for _, addr := range ent.hosts {
+			hosts[addr] = ent
+		}
+	}
+
+	// Each host is asked once, through the first route naming it.
+	var wg sync.WaitGroup
+	var rolesLock sync.Mutex
+	roles := make(map[string]hostRole)
+
+	for addr, ent := range hosts {
+		wg.Add(1)
+		go func(addr string, ent *routingEntry) {
+			defer wg.Done()
+
+			role := d.ask(addr, ent)
+
+			rolesLock.Lock()
+			roles[addr] = role
+			rolesLock.Unlock()
+		}(addr, ent)
+	}
+
+	wg.Wait()
+
+	problems := make(map[string]string)
+	for _, ent := range routes {
+		addr, err := resolveHost(ent, roles)
+		if err == nil && addr != ent.addr {
+			err = d.retarget(ent, addr)
+		}
+
+		if err != nil {
+			problems[ent.id] = err.Error()
+			if d.problems[ent.id] != err.Error() {
+				log.Printf("Could not resolve the %v of route "+
+					"%q: %v\n", ent.role, ent.id, err)
+			}
+		}
+	}
+
+	d.problems = problems
+}
+
+func (d *discoverer) ask(addr string, ent *routingEntry) hostRole {
+	rows, err := d.p.probe(addr, ent, d.user, d.interval,
+		"SELECT pg_is_in_recovery()")
+	if err != nil {
+		return hostRole{err: err}
+	}
+
+	switch rows[0][0] {
+	case "t":
+		return hostRole{inRecovery: true}
+	case "f":
+		return hostRole{inRecovery: false}
+	}
+
+	return hostRole{err: fmt.Errorf("unexpected answer %q to "+
+		"pg_is_in_recovery()", rows[0][0])}
+}
+
+// The host a route should use, given the roles of its hosts.
+func resolveHost(ent *routingEntry, roles map[string]hostRole) (
+	string, error) {
+	var matching []string
+	for _, addr := range ent.hosts {
+		role := roles[addr]
+		if role.err != nil {
+			continue
+		}
+
+		switch {
+		case ent.role == "any",
+			ent.role == "primary" && !role.inRecovery,
+			ent.role == "standby" && role.inRecovery:
+			matching = append(matching, addr)
+		}
+	}
+
+	for _, addr := range matching {
+		if addr == ent.addr {
+			return addr, nil
+		}
+	}
+
+	switch {
+	case len(matching) == 0:
+		return "", fmt.Errorf("no host is in that role")
+	case ent.role == "primary" && len(matching) > 1:
+		return "", fmt.Errorf("several hosts claim to be the "+
+			"primary: %v", strings.Join(matching, ", "))
+	}
+
+	return matching[0], nil
+}
+
+// Point a route at another host, as of the version of the route the
+// host was resolved for.
+func (d *discoverer) retarget(ent *routingEntry, addr string) error {
+	ocn, err := d.ex.amend(dogconf.RouteKind, ent.id, ent.ocn,
+		map[string]string{"addr": addr}, "discovery")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Route %q now goes to %v, its %v, at OCN %d\n",
+		ent.id, addr, ent.role, ocn)
+	discoveryStats.Add("retargets", 1)
+	return nil
+}
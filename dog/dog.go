@@ -1,17 +1,25 @@
 package main
 
 import (
+	"../audit"
+	"../dogconf"
 	"bufio"
 	"crypto/tls"
+	"expvar"
 	"femebe"
 	"femebe/pgproto"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Automatically chooses between unix sockets and tcp sockets for
@@ -25,18 +33,206 @@ func autoListen(place string) (net.Listener, error) {
 }
 
 // Automatically chooses between unix sockets and tcp sockets for
-// dialing.
-func autoDial(place string) (net.Conn, error) {
+// dialing.  A zero timeout waits as long as the operating system
+// allows.
+func autoDial(place string, timeout time.Duration) (net.Conn, error) {
 	if strings.Contains(place, "/") {
-		return net.Dial("unix", place)
+		return net.DialTimeout("unix", place, timeout)
 	}
 
-	return net.Dial("tcp", place)
+	return net.DialTimeout("tcp", place, timeout)
+}
+
+// State shared between every client session and the administrative
+// interface.
+type proxy struct {
+	rt       *routingTable
+	rules    *ruleTable
+	backends *backendTable
+
+	listeners *listenerTable
+	sessions  *sessionTable
+
+	// Listening sockets inherited from systemd or an upgrade, and
+	// the administrative and metrics sockets, to pass on to an
+	// upgrade
+	sockets   *socketPool
+	adminLn   net.Listener
+	httpLn    net.Listener
+	metricsLn net.Listener
+
+	adm *admission
+
+	// How long clients may wait for admission
+	queueTimeout time.Duration
+
+	// How long clients may take to send a startup packet
+	startupTimeout time.Duration
+
+	// Timeouts for sessions, unless overridden by their route
+	timeouts sessionTimeouts
+
+	// How to retry servers that cannot be connected to
+	retry dialRetry
+
+	// Passwords for logging in to servers on dog's own account
+	passwords *passfile
+
+	// Advanced to take replicas in turn
+	nextReplica uint32
+
+	// The routes being drained, each by one loop, see drain.go
+	draining     map[string]bool
+	drainingLock sync.Mutex
+
+	// Measures the lag of replicas
+	health *healthChecker
+
+	// Clients connecting to this database are served by dog
+	// itself, see admindb.go, or none if empty
+	adminDbname string
+	ex          *executor
+
+	// Who may do what through the administrative interface, if
+	// anyone is restricted, and how the administrative address is
+	// served over TLS, if it is; see adminauth.go
+	adminAuth *adminAuth
+	adminTLS  *tls.Config
+
+	// Where administrative requests are recorded, if anywhere,
+	// see audit.go
+	auditLog *audit.Log
+}
+
+// How to log in to servers on dog's own account, for sessions on the
+// route.
+func (p *proxy) login(ent *routingEntry) *serverLogin {
+	return &serverLogin{
+		passwords: p.passwords,
+		timeouts:  p.timeouts.override(ent.timeouts),
+		retry:     p.retry,
+	}
+}
+
+func newProxy(maxConnections int, queueTimeout time.Duration,
+	startupTimeout time.Duration, timeouts sessionTimeouts,
+	retry dialRetry) *proxy {
+	p := &proxy{
+		rt:             newRoutingTable(),
+		rules:          newRuleTable(),
+		backends:       newBackendTable(),
+		queueTimeout:   queueTimeout,
+		startupTimeout: startupTimeout,
+		timeouts:       timeouts,
+		retry:          retry,
+		draining:       make(map[string]bool),
+	}
+
+	p.sockets = newSocketPool()
+	p.sessions = newSessionTable()
+	p.listeners = newListenerTable(p.sockets.listen, p.serveListener)
+	p.adm = newAdmission(maxConnections,
+		func(route, backend string) (int, int) {
+			return p.rt.limit(route), p.backends.limit(backend)
+		})
+
+	return p
+}
+
+// Add the run-time status of an object to its record, for 'get'.
+func (p *proxy) annotate(rec *dogconf.Record) {
+	var u usage
+
+	switch rec.Kind {
+	case dogconf.RouteKind:
+		u = p.adm.routeUsage(rec.Id)
+		defer p.annotateReplicas(rec)
+		defer annotateCanary(rec)
+	case dogconf.BackendKind:
+		u = p.adm.backendUsage(rec.Id)
+		defer p.annotateLag(rec)
+	case dogconf.ListenerKind:
+		rec.Status = map[string]string{
+			"bound": p.listeners.bound(rec.Id),
+		}
+
+		return
+	default:
+		return
+	}
+
+	rec.Status = map[string]string{
+		"active": strconv.Itoa(u.Active),
+		"queued": strconv.Itoa(u.Queued),
+	}
+}
+
+// Add the lag of each replica of a route, e.g.
+// replicaLag='10.0.0.2:5432=1.5s,10.0.0.3:5432=unknown'.
+func (p *proxy) annotateReplicas(rec *dogconf.Record) {
+	replicas := splitList(rec.Attrs["replicas"])
+	if len(replicas) == 0 {
+		return
+	}
+
+	lags := make([]string, len(replicas))
+	for i, addr := range replicas {
+		lags[i] = addr + "=" + p.health.lagString(addr)
+	}
+
+	rec.Status["replicaLag"] = strings.Join(lags, ",")
+}
+
+// Add the lag of a backend that is checked as a replica.
+func (p *proxy) annotateLag(rec *dogconf.Record) {
+	h := p.health.health(rec.Id)
+	if h == nil {
+		return
+	}
+
+	rec.Status["lag"] = p.health.lagString(rec.Id)
+	rec.Status["lagBytes"] = strconv.FormatInt(h.lagBytes, 10)
 }
 
 type session struct {
 	ingress func()
 	egress  func()
+
+	act activity
+
+	// Identifies the session in logs, unique within the process
+	id uint64
+
+	// Where the session came from and is going, for handing it to
+	// another process
+	route      string
+	backend    string
+	listener   string
+	clientAddr string
+	client     *ProxyPair
+	server     *ProxyPair
+
+	// Who the client logged in as, and to which database, before
+	// any rewriting
+	user     string
+	database string
+
+	// Coordinates handing the session to another process, see
+	// detach
+	detachLock      sync.Mutex
+	detachRequested bool
+	finished        bool
+	detached        chan *handoff
+
+	// Set when transactions are split between servers
+	split *splitter
+
+	// Set when the session is copied to a mirror
+	mirror *mirror
+
+	// The statistics of the canary arm the session was sent down,
+	// if any
+	arm *expvar.Map
 }
 
 func (s *session) start() {
@@ -44,20 +240,57 @@ func (s *session) start() {
 	go s.egress()
 }
 
+// Note a message relayed from the client.
+func (s *session) fromClient(m *femebe.Message) {
+	s.act.fromClient(m)
+	if s.mirror != nil {
+		s.mirror.fromClient(m)
+	}
+}
+
+// Note a message relayed from the server.
+func (s *session) fromServer(m *femebe.Message) {
+	s.act.fromServer(m)
+	if s.arm != nil && m.MsgType() == 'E' {
+		s.arm.Add("errors", 1)
+	}
+
+	if s.mirror != nil {
+		s.mirror.fromServer(m)
+	}
+}
+
 type ProxyPair struct {
 	*femebe.MessageStream
 	net.Conn
+
+	// Serializes messages sent by dog on its own behalf, such as
+	// errors, with those relayed by the movers.
+	sendLock sync.Mutex
 }
 
 func NewSimpleProxySession(errch chan error,
 	client *ProxyPair, server *ProxyPair) *session {
-	mover := func(from, to *ProxyPair) func() {
+	s := &session{
+		act:      activity{start: time.Now()},
+		client:   client,
+		server:   server,
+		detached: make(chan *handoff, 1),
+	}
+
+	mover := func(from, to *ProxyPair,
+		observe func(m *femebe.Message)) func() {
 		return func() {
 			var err error
 
 			defer func() {
-				from.Close()
-				to.Close()
+				// Connections being handed to another
+				// process must be left open.
+				if !s.detaching() {
+					from.Close()
+					to.Close()
+				}
+
 				errch <- err
 			}()
 
@@ -69,25 +302,26 @@ func NewSimpleProxySession(errch chan error,
 					return
 				}
 
+				observe(&m)
+
+				to.sendLock.Lock()
 				err = to.Send(&m)
-				if err != nil {
-					return
+				if err == nil && !from.HasNext() {
+					err = to.Flush()
 				}
+				to.sendLock.Unlock()
 
-				if !from.HasNext() {
-					err = to.Flush()
-					if err != nil {
-						return
-					}
+				if err != nil {
+					return
 				}
 			}
 		}
 	}
 
-	return &session{
-		ingress: mover(client, server),
-		egress:  mover(server, client),
-	}
+	s.ingress = mover(client, server, s.fromClient)
+	s.egress = mover(server, client, s.fromServer)
+
+	return s
 }
 
 type bufWriteCon struct {
@@ -105,7 +339,7 @@ func newBufWriteCon(c net.Conn) *bufWriteCon {
 //
 // This redelegates to more specific proxy handlers that contain the
 // main proxy loop logic.
-func handleConnection(cConn net.Conn, rt *routingTable) {
+func handleConnection(cConn net.Conn, p *proxy, le *listenerEntry) {
 	var err error
 
 	// Log disconnections
@@ -119,14 +353,43 @@ func handleConnection(cConn net.Conn, rt *routingTable) {
 
 	defer cConn.Close()
 
+	// A client is not allowed to take forever about starting up:
+	// one that stops after half a packet would otherwise pin this
+	// goroutine indefinitely.
+	if p.startupTimeout > 0 {
+		cConn.SetReadDeadline(time.Now().Add(p.startupTimeout))
+	}
+
+	// Behind a load balancer, the client's real address comes
+	// first, and everything after uses it in place of the load
+	// balancer's.
+	if le.proxyProtocol {
+		if cConn, err = readProxyHeader(cConn); err != nil {
+			return
+		}
+	}
+
+	log.Printf("Session from %v on listener %q\n",
+		cConn.RemoteAddr(), le.id)
+
+	var encrypted bool
+	if cConn, encrypted, err = negotiateClientTLS(cConn, le); err != nil {
+		log.Printf("Could not negotiate TLS with client: %v\n", err)
+		return
+	}
+
 	c := femebe.NewClientMessageStream(
 		"Client", newBufWriteCon(cConn))
 
 	// Must interpret Startup and Cancel requests.
-	//
-	// SSL Negotiation requests not handled for now.
+
 	var firstPacket femebe.Message
-	c.Next(&firstPacket)
+	if err = c.Next(&firstPacket); err != nil {
+		log.Printf("Could not read startup packet: %v\n", err)
+		return
+	}
+
+	cConn.SetReadDeadline(time.Time{})
 
 	// Handle Startup packets
 	var sup *pgproto.Startup
@@ -135,18 +398,127 @@ func handleConnection(cConn net.Conn, rt *routingTable) {
 		return
 	}
 
+	// Check access rules before doing anything on the client's
+	// behalf, and in particular before dialing any server.
+	ci := &clientInfo{
+		addr:     cConn.RemoteAddr(),
+		tls:      encrypted,
+		database: sup.Params["database"],
+		user:     sup.Params["user"],
+		listener: le.id,
+	}
+
+	if le.tlsMode == "require" && !encrypted {
+		msg := fmt.Sprintf("listener %q requires TLS", le.id)
+		log.Print(msg)
+		err = sendError(c, "FATAL", "28000", msg)
+		return
+	}
+
+	if ok, rule := p.rules.admit(ci); !ok {
+		msg := fmt.Sprintf("no access rule admits "+
+			"host %q, user %q, database %q",
+			ci.addr, ci.user, ci.database)
+		if rule != nil {
+			msg = fmt.Sprintf("access rule %q rejects "+
+				"host %q, user %q, database %q",
+				rule.id, ci.addr, ci.user, ci.database)
+		}
+
+		log.Print(msg)
+		err = sendError(c, "FATAL", "28000", msg)
+		return
+	}
+
+	if p.adminDbname != "" && ci.database == p.adminDbname {
+		log.Printf("Serving the administrative database to %v\n",
+			ci.addr)
+		err = p.serveAdminDb(c,
+			&adminClient{addr: ci.addr.String(), identity: ci.user})
+		return
+	}
+
 	var ent *routingEntry
-	if ent = rt.rewrite(sup); ent == nil {
+	if ent = p.rt.rewrite(sup); ent == nil {
 		log.Print("Could not route startup packet")
 		return
 	}
 
-	unencryptServerConn, err := autoDial(ent.addr)
+	if ent.lock {
+		err = sendError(c, "FATAL", "57P03", fmt.Sprintf(
+			"route %q is locked", ent.id))
+		return
+	}
+
+	// Canary routes send some sessions to another primary.
+	target := ent.addr
+	var arm *expvar.Map
+	if ent.canary != "" {
+		var name string
+		name, target = ent.pickArm(sup.Params["user"], ci)
+		arm = armStats(ent.id, name)
+		arm.Add("sessions", 1)
+	}
+
+	// Read-only sessions on routes splitting reads go to a
+	// replica, and other sessions to the primary.
+	split := ent.splitReads
+	if split && readOnlySession(sup, ent) {
+		split = false
+		splitStats.Add("readOnlySessions", 1)
+
+		if addr, ok := p.pickReplica(ent); ok {
+			target = addr
+		} else {
+			log.Printf("No replica of route %q is within its "+
+				"maximum lag, using the primary\n", ent.id)
+		}
+	}
+
+	release, err := p.adm.acquire(ent.id, target, p.queueTimeout)
+	if err != nil {
+		log.Printf("Could not admit session: %v\n", err)
+		err = sendError(c, "FATAL", "53300", err.Error())
+		return
+	}
+
+	defer release()
+
+	timeouts := p.timeouts.override(ent.timeouts)
+
+	unencryptServerConn, addr, retries, err := dialServer(
+		target, timeouts.dial, p.retry)
 	if err != nil {
-		log.Printf("Could not connect to server: %v\n", err)
+		log.Printf("Could not connect to server %v: %v\n",
+			target, err)
+		if arm != nil {
+			arm.Add("connectFailures", 1)
+		}
+
+		err = sendError(c, "FATAL", "08001", fmt.Sprintf(
+			"could not connect to server for route %q", ent.id))
 		return
 	}
 
+	log.Printf("Connected to server %v at %v after %d retries\n",
+		target, addr, retries)
+
+	if ent.proxyProtocol != "none" {
+		err = writeProxyHeader(unencryptServerConn, ent.proxyProtocol,
+			cConn.RemoteAddr(), cConn.LocalAddr())
+		if err != nil {
+			log.Printf("Could not send PROXY header: %v\n", err)
+			unencryptServerConn.Close()
+			return
+		}
+	}
+
+	// The deadline also covers sending the startup packet, as the
+	// TLS handshake may not complete until then.
+	if timeouts.tls > 0 {
+		unencryptServerConn.SetDeadline(time.Now().Add(timeouts.tls))
+	}
+
 	tlsConf := tls.Config{}
 	tlsConf.InsecureSkipVerify = true
 
@@ -154,6 +526,7 @@ func handleConnection(cConn net.Conn, rt *routingTable) {
 		unencryptServerConn, "prefer", &tlsConf)
 	if err != nil {
 		log.Printf("Could not negotiate TLS: %v\n", err)
+		unencryptServerConn.Close()
 		return
 	}
 
@@ -175,14 +548,53 @@ func handleConnection(cConn net.Conn, rt *routingTable) {
 		return
 	}
 
+	unencryptServerConn.SetDeadline(time.Time{})
+
+	client := &ProxyPair{MessageStream: c, Conn: cConn}
+	server := &ProxyPair{MessageStream: s, Conn: sConn}
+
 	done := make(chan error)
-	NewSimpleProxySession(done,
-		&ProxyPair{c, cConn},
-		&ProxyPair{s, sConn}).start()
+	var sess *session
+	if split {
+		sess = newSplitSession(done, client, server, p, ent, sup.Params)
+	} else {
+		sess = NewSimpleProxySession(done, client, server)
+	}
+
+	if ent.mirror != "" {
+		sess.mirror = p.newMirror(ent, sup.Params)
+	}
+
+	sess.arm = arm
+	sess.route = ent.id
+	sess.backend = target
+	sess.listener = le.id
+	sess.clientAddr = cConn.RemoteAddr().String()
+	sess.user = ci.user
+	sess.database = ci.database
+	p.relay(sess, done, timeouts)
+}
+
+// Run a session until both sides exit, enforcing its timeouts.
+func (p *proxy) relay(sess *session, done chan error,
+	timeouts sessionTimeouts) {
+	p.sessions.add(sess)
+	defer p.sessions.remove(sess)
+
+	stop := make(chan struct{})
+	sess.start()
+	go sess.watchdog(timeouts, sess.client, sess.server, stop)
 
 	// Both sides must exit to finish
 	_ = <-done
 	_ = <-done
+	close(stop)
+
+	if sess.mirror != nil {
+		sess.mirror.abandon()
+	}
+
+	sess.finish()
 }
 
 func parseRoutingEntry(tupleRaw string) (*routingEntry, error) {
@@ -196,7 +608,12 @@ func parseRoutingEntry(tupleRaw string) (*routingEntry, error) {
 			TUPSZ, partL, tupleRaw)
 	}
 
-	return &routingEntry{parts[0], parts[1], parts[2]}, nil
+	return &routingEntry{
+		id:        parts[0],
+		dbnameIn:  parts[0],
+		addr:      parts[1],
+		dbnameOut: parts[2],
+	}, nil
 }
 
 // Signal handling: this is pretty ghetto now, but at least we can
@@ -219,44 +636,240 @@ func installSignalHandlers() {
 	}()
 }
 
+// Install the objects given on the command line and in the
+// configuration file.
+func bootstrapObjects(ex *executor, proxyProtocol bool, configPath string) {
+	// The listener given on the command line is like any other, and
+	// may be changed by the configuration.
+	listenerAttrs := map[string]string{
+		"addr":          flag.Arg(0),
+		"proxyProtocol": "f",
+	}
+
+	if proxyProtocol {
+		listenerAttrs["proxyProtocol"] = "t"
+	}
+
+	err := ex.bootstrap(dogconf.ListenerKind, "default", listenerAttrs,
+		"command line")
+	if err != nil {
+		log.Fatalf("Could not listen on address: %v", err)
+	}
+
+	for _, rawTup := range flag.Args()[1:] {
+		re, err := parseRoutingEntry(rawTup)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = ex.bootstrap(dogconf.RouteKind, re.id, re.record().Attrs,
+			"command line")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if configPath != "" {
+		if err := loadConfig(configPath, ex); err != nil {
+			log.Fatalf("Could not load configuration: %v", err)
+		}
+	}
+}
+
 // Startup and main client acceptance loop
 func main() {
 	installSignalHandlers()
 
-	if len(os.Args) < 3 {
+	adminAddr := flag.String("admin", "",
+		"address to accept dogconf requests on")
+	httpAddr := flag.String("admin-http", "",
+		"address to accept the same requests on, over HTTP")
+	configPath := flag.String("config", "",
+		"file of dogconf requests to execute at startup")
+	metricsAddr := flag.String("metrics", "",
+		"address to serve metrics on, over HTTP")
+	maxConnections := flag.Int("max-connections", 0,
+		"limit on sessions across all routes, zero for none")
+	queueTimeout := flag.Duration("queue-timeout", 30*time.Second,
+		"how long clients may wait for a connection limit")
+	startupTimeout := flag.Duration("startup-timeout", 10*time.Second,
+		"how long clients may take to send a startup packet")
+
+	var timeouts sessionTimeouts
+	flag.DurationVar(&timeouts.dial, "dial-timeout", 10*time.Second,
+		"how long to wait to connect to a server")
+	flag.DurationVar(&timeouts.tls, "tls-timeout", 10*time.Second,
+		"how long to wait to negotiate TLS with a server")
+	flag.DurationVar(&timeouts.auth, "auth-timeout", time.Minute,
+		"how long a session may take to authenticate")
+	flag.DurationVar(&timeouts.idleInTransaction,
+		"idle-in-transaction-timeout", 0,
+		"how long a session may sit idle within a transaction")
+	flag.DurationVar(&timeouts.idle, "idle-timeout", 0,
+		"how long a session may sit idle")
+
+	var retry dialRetry
+	flag.DurationVar(&retry.budget, "dial-retry-budget", 5*time.Second,
+		"how long to keep retrying a server, zero for no retries")
+	flag.DurationVar(&retry.initial, "dial-backoff", 100*time.Millisecond,
+		"longest wait before the first retry of a server, at least "+
+			minDialBackoff.String())
+	flag.DurationVar(&retry.max, "dial-backoff-max", 2*time.Second,
+		"longest wait before any retry of a server, at least "+
+			minDialBackoff.String())
+	proxyProtocol := flag.Bool("proxy-protocol", false,
+		"require clients of LISTENADDR to send a PROXY protocol header")
+	passfilePath := flag.String("passfile", "",
+		"passwords for logging in to servers, as in .pgpass")
+	healthInterval := flag.Duration("health-interval", 5*time.Second,
+		"how often to check the lag of replicas, zero for never")
+	healthUser := flag.String("health-user", "postgres",
+		"the user to check the lag and role of servers as")
+	discoveryInterval := flag.Duration("discovery-interval",
+		2*time.Second, "how often to ask the hosts of routes "+
+			"their role, zero for never")
+	adminDbname := flag.String("admin-dbname", "",
+		"serve SHOW commands and dogconf requests to clients of "+
+			"this database, which is not routed")
+	adminAuthPath := flag.String("admin-auth", "",
+		"file of the roles granted to administrative clients; "+
+			"without it, every client may do anything")
+	adminTLSCert := flag.String("admin-tls-cert", "",
+		"certificate to serve the administrative address with, "+
+			"over TLS")
+	adminTLSKey := flag.String("admin-tls-key", "",
+		"key of -admin-tls-cert")
+	adminTLSCA := flag.String("admin-tls-ca", "",
+		"authorities signing administrative client certificates")
+	auditLogPath := flag.String("audit-log", "",
+		"file to record administrative requests in, "+
+			"checked with dogaudit")
+	upgradeSessions := flag.Bool("upgrade-sessions", false,
+		"hand idle sessions to the new process upon upgrade (SIGUSR2)")
+	flag.Parse()
+
+	// Spread out the retries of separate proxy processes, too.
+	rand.Seed(time.Now().UnixNano())
+
+	if flag.NArg() < 1 {
 		log.Printf(
-			"Usage: dog LISTENADDR " +
-				"(DBNAMEIN,ADDR,DBNAMEOUT)+")
+			"Usage: dog [flags] LISTENADDR " +
+				"(DBNAMEIN,ADDR,DBNAMEOUT)*")
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	ln, err := autoListen(os.Args[1])
+	p := newProxy(*maxConnections, *queueTimeout,
+		*startupTimeout, timeouts, retry)
+	ex := newExecutor(p)
+	p.ex = ex
+	p.adminDbname = *adminDbname
+
+	if *adminAuthPath != "" {
+		var err error
+		if p.adminAuth, err = loadAdminAuth(*adminAuthPath); err != nil {
+			log.Fatalf("Could not load administrative grants: %v",
+				err)
+		}
+	}
+
+	if *adminTLSCert != "" {
+		var err error
+		p.adminTLS, err = loadAdminTLS(*adminTLSCert, *adminTLSKey,
+			*adminTLSCA)
+		if err != nil {
+			log.Fatalf("Could not load administrative TLS "+
+				"certificate: %v", err)
+		}
+	}
+
+	if *auditLogPath != "" {
+		var err error
+		if p.auditLog, err = audit.Open(*auditLogPath); err != nil {
+			log.Fatalf("Could not open audit log: %v", err)
+		}
+	}
+
+	if *passfilePath != "" {
+		pf, err := loadPassfile(*passfilePath)
+		if err != nil {
+			log.Fatalf("Could not load passfile: %v", err)
+		}
+
+		p.passwords = pf
+	}
+
+	p.health = newHealthChecker(p, *healthInterval, *healthUser)
+	if *healthInterval > 0 {
+		go p.health.run()
+	}
+
+	if err := inheritSystemdSockets(p.sockets); err != nil {
+		log.Fatalf("Could not use sockets from systemd: %v", err)
+	}
+
+	parent, err := inheritFromParent(p.sockets)
 	if err != nil {
-		log.Printf("Could not listen on address: %v", err)
-		os.Exit(1)
+		log.Fatalf("Could not take over from upgraded process: %v", err)
 	}
 
-	rt := newRoutingTable()
-	for _, rawTup := range os.Args[2:] {
-		re, err := parseRoutingEntry(rawTup)
+	if parent != nil {
+		// The old process's objects stand in for the command
+		// line and configuration file.
+		err := ex.restore(parent.records, parent.ocn, parent.changes)
 		if err != nil {
-			log.Fatal(err)
-		} else {
-			rt.post(re)
+			log.Fatalf("Could not take over objects from "+
+				"upgraded process: %v", err)
 		}
+	} else {
+		bootstrapObjects(ex, *proxyProtocol, *configPath)
 	}
 
-	for {
-		conn, err := ln.Accept()
+	if *adminAddr != "" {
+		p.adminLn, err = p.sockets.listen("", *adminAddr)
+		if err != nil {
+			log.Fatalf("Could not listen on administrative "+
+				"address: %v", err)
+		}
+
+		go serveAdmin(p.adminLn, ex)
+	}
 
+	if *httpAddr != "" {
+		p.httpLn, err = p.sockets.listen("", *httpAddr)
 		if err != nil {
-			log.Printf("Error: %v\n", err)
-			continue
+			log.Fatalf("Could not listen on administrative "+
+				"HTTP address: %v", err)
 		}
 
-		go handleConnection(conn, rt)
+		go serveRest(p.httpLn, ex)
 	}
 
-	log.Println("simpleproxy quits successfully")
-	return
+	// Metrics are also shown by the administrative database.
+	publishMetrics(p)
+
+	if *metricsAddr != "" {
+		p.metricsLn, err = p.sockets.listen("", *metricsAddr)
+		if err != nil {
+			log.Fatalf("Could not listen on metrics address: %v",
+				err)
+		}
+
+		go serveMetrics(p.metricsLn)
+	}
+
+	p.sockets.closeUnclaimed()
+
+	if parent != nil {
+		go parent.ready(p)
+	}
+
+	if *discoveryInterval > 0 {
+		go newDiscoverer(p, ex, *discoveryInterval, *healthUser).run()
+	}
+
+	handleUpgradeSignal(p, ex, *upgradeSessions)
+
+	// Clients are accepted by the listeners' own goroutines.
+	select {}
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// End the sessions of a route as each goes idle between transactions,
+// for as long as the route stays locked and has sessions left.
+// Unlocking the route calls the drain off, leaving the sessions that
+// remain be.  A route already being drained is left to the loop
+// draining it.
+func (p *proxy) drainRoute(route string) {
+	p.drainingLock.Lock()
+	defer p.drainingLock.Unlock()
+
+	if p.draining[route] {
+		return
+	}
+
+	p.draining[route] = true
+	log.Printf("Draining route %q\n", route)
+	go p.drainLoop(route)
+}
+
+func (p *proxy) drainLoop(route string) {
+	for {
+		sessions, done := p.drainProgress(route)
+		if done {
+			return
+		}
+
+		for _, s := range sessions {
+			if s.idle() {
+				s.terminate()
+			}
+		}
+
+		time.Sleep(watchdogInterval)
+	}
+}
+
+// The sessions left on a route being drained, or whether the drain is
+// over.  The route is checked under the lock, so that a drain asked
+// for as this one ends is not taken for this one.
+func (p *proxy) drainProgress(route string) ([]*session, bool) {
+	p.drainingLock.Lock()
+	defer p.drainingLock.Unlock()
+
+	ent := p.rt.entry(route)
+	if ent == nil || !ent.lock {
+		log.Printf("Stopped draining route %q\n", route)
+		delete(p.draining, route)
+		return nil, true
+	}
+
+	sessions := p.sessions.onRoute(route)
+	if len(sessions) == 0 {
+		log.Printf("Route %q is drained\n", route)
+		delete(p.draining, route)
+		return nil, true
+	}
+
+	return sessions, false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"../dogconf"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testExecutor() *executor {
+	p := newProxy(0, 0, 0, sessionTimeouts{}, dialRetry{})
+	p.ex = newExecutor(p)
+	return p.ex
+}
+
+// Load a dogconf file of the given text into a new executor.
+func loadTestConfig(t *testing.T, text string) *executor {
+	path := filepath.Join(t.TempDir(), "routes.dogconf")
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ex := testExecutor()
+	if err := loadConfig(path, ex); err != nil {
+		t.Fatalf("Could not load %q: %v", text, err)
+	}
+
+	return ex
+}
+
+// Dump the routes, as the text dogctl writes out.
+func dumpRoutes(t *testing.T, ex *executor) string {
+	req, err := dogconf.NewParser("", strings.NewReader(
+		"[route all [dump]]")).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := dogconf.Analyze(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs, ocn, err := ex.execute(d, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ocn != 0 {
+		t.Errorf("Dumping changed the routes, to OCN %v", ocn)
+	}
+
+	var text string
+	for _, rec := range recs {
+		text += rec.Status["create"] + "\n"
+	}
+
+	return text
+}
+
+// The routes of an executor, without their OCNs, which depend on the
+// order they were made in.
+func routeAttrs(ex *executor) map[string]map[string]string {
+	routes := make(map[string]map[string]string)
+	for _, rec := range ex.p.rt.list() {
+		routes[rec.Id] = rec.Attrs
+	}
+
+	return routes
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	ex := loadTestConfig(t, `
+[route 'zeta' [create [addr='127.0.0.1:5432', lock='t',
+    maxConnections='5', idleTimeout='30s', dialTimeout='0']]]
+[route 'it''s' [create [addr='127.0.0.1:5433',
+    dbnameIn='o''neil''s [db], "x"', dbnameRewritten='é t',
+    splitReads='t', replicas='127.0.0.1:2,127.0.0.1:3',
+    readOnlyUsers='ro', maxLag='1m30s', proxyProtocol='v2']]]
+[route 'alpha' [create [addr='127.0.0.1:5434',
+    hosts='127.0.0.1:5434,127.0.0.1:5435', role='standby',
+    mirror='127.0.0.1:6', mirrorSelectsOnly='on',
+    canary='127.0.0.1:7', canaryPercent='2.50',
+    canarySticky='user']]]
+[route 'zeta' @ 1 [patch [maxConnections='6']]]
+`)
+
+	dump := dumpRoutes(t, ex)
+
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(dump), "\n") {
+		ids = append(ids, strings.Fields(line)[1])
+	}
+
+	expected := []string{"'alpha'", "'it''s'", "'zeta'"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected routes in order %v, got %v", expected, ids)
+	}
+
+	loaded := loadTestConfig(t, dump)
+	if was, is := routeAttrs(ex), routeAttrs(loaded); !reflect.DeepEqual(
+		was, is) {
+		t.Errorf("Routes changed through a dump:\n%v\nbecame\n%v",
+			was, is)
+	}
+
+	if again := dumpRoutes(t, loaded); again != dump {
+		t.Errorf("Dumped again as\n%v\nrather than\n%v", again, dump)
+	}
+}
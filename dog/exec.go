@@ -0,0 +1,630 @@
+package main
+
+import (
+	"../dogconf"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// The operations the executor needs to manage one kind of object.
+type objectTable interface {
+	// The current version of an object, if it exists
+	lookup(id string) (*dogconf.Record, bool)
+
+	// Every current object, in the order they should be reported
+	list() []*dogconf.Record
+
+	// Install an object with the given attributes, replacing any
+	// previous version.  The attributes are presumed to have
+	// passed semantic analysis, but may still be rejected, e.g.
+	// for conflicting with other objects.
+	store(id string, ocn uint64, attrs map[string]string) error
+
+	remove(id string)
+}
+
+// An error to be reported to an administrative client, classified by
+// one of the dogconf.ErrCode constants.
+type adminError struct {
+	error
+	code string
+}
+
+// Return an adminError decorated with the position of the blamed
+// token, in the style of the semantic analyzer.
+func adminErrf(code string, blam dogconf.Blamer,
+	format string, args ...interface{}) error {
+	return &adminError{
+		error: fmt.Errorf("%s: %s",
+			blam.Blame().Pos, fmt.Sprintf(format, args...)),
+		code: code,
+	}
+}
+
+// Applies semantically analyzed dogconf directives onto the run-time
+// state of the proxy.
+//
+// Changes are serialized, each being assigned the next OCN from a
+// sequence shared between all kinds of objects, so that the OCN of
+// an object identifies not only its version, but when it was made.
+type executor struct {
+	sync.Mutex
+	ocn uint64
+
+	// Set once an upgrade has handed the objects to another
+	// process, after which changes here would be lost
+	retired bool
+
+	// Recent changes, for watchers
+	changes changeLog
+
+	// Where changes are put aside during a transaction, until
+	// they are committed
+	staged *[]*change
+
+	// On whose behalf changes are being made, while the lock is
+	// held, e.g. the address of an administrative client
+	who string
+
+	p *proxy
+}
+
+func newExecutor(p *proxy) *executor {
+	return &executor{p: p}
+}
+
+// Every kind of object, in the order they are restored after an
+// upgrade.
+var objectKinds = []dogconf.Kind{
+	dogconf.ListenerKind,
+	dogconf.RuleKind,
+	dogconf.BackendKind,
+	dogconf.RouteKind,
+}
+
+func (ex *executor) table(kind dogconf.Kind) objectTable {
+	switch kind {
+	case dogconf.RouteKind:
+		return ex.p.rt
+	case dogconf.RuleKind:
+		return ex.p.rules
+	case dogconf.BackendKind:
+		return ex.p.backends
+	case dogconf.ListenerKind:
+		return ex.p.listeners
+	}
+
+	panic(fmt.Errorf("No table for objects of kind %v", kind))
+}
+
+// Analyze and execute one parsed request, made on behalf of who.
+func (ex *executor) run(req *dogconf.RequestSyntax, who string) (
+	[]*dogconf.Record, error) {
+	d, err := dogconf.Analyze(req)
+	if err != nil {
+		return nil, &adminError{err, dogconf.ErrCodeSemantic}
+	}
+
+	recs, _, err := ex.execute(d, who)
+	return recs, err
+}
+
+// Execute a directive, returning the records to reply with, and the
+// OCN of the last change it made, or zero if it made none.
+func (ex *executor) execute(d dogconf.Directive, who string) (
+	[]*dogconf.Record, uint64, error) {
+	var recs []*dogconf.Record
+	var err error
+
+	switch d := d.(type) {
+	case *dogconf.GetDirective:
+		recs, err = ex.get(d)
+	case *dogconf.TerminateDirective:
+		recs, err = ex.terminate(d)
+	case *dogconf.HistoryDirective:
+		recs, err = ex.history(d)
+	case *dogconf.ExplainDirective:
+		recs, err = ex.explain(d)
+	case *dogconf.DumpDirective:
+		recs, err = ex.dump(d)
+	case *dogconf.WatchDirective:
+		err = adminErrf(dogconf.ErrCodeInvalid, d,
+			"'watch' is only served on the administrative address")
+	default:
+		// Everything else changes state
+		return ex.change(d, who)
+	}
+
+	return recs, 0, err
+}
+
+// Execute a directive that changes state, as execute.
+func (ex *executor) change(d dogconf.Directive, who string) (
+	[]*dogconf.Record, uint64, error) {
+	ex.Lock()
+	defer ex.Unlock()
+
+	ex.who = who
+
+	if ex.retired {
+		return nil, 0, &adminError{fmt.Errorf("dog has been " +
+			"upgraded; reconnect to make changes"),
+			dogconf.ErrCodeInvalid}
+	}
+
+	// Limits may have been raised, letting waiting clients in.
+	defer ex.p.adm.reconsider()
+
+	var recs []*dogconf.Record
+	var err error
+
+	ocn := ex.ocn
+	switch d := d.(type) {
+	case *dogconf.CreateDirective:
+		recs, err = ex.create(ex.table(d.Kind), d)
+	case *dogconf.PatchDirective:
+		recs, err = ex.patch(ex.table(d.Kind), d)
+	case *dogconf.DeleteDirective:
+		recs, err = ex.delete(ex.table(d.Kind), d)
+	case *dogconf.TransactionDirective:
+		recs, err = ex.transaction(d)
+	case *dogconf.DrainDirective:
+		recs, err = ex.drain(d)
+	case *dogconf.RevertDirective:
+		recs, err = ex.revert(d)
+	default:
+		panic(fmt.Errorf("Attempting to execute "+
+			"un-enumerated directive type %T", d))
+	}
+
+	if err != nil || ex.ocn == ocn {
+		return recs, 0, err
+	}
+
+	return recs, ex.ocn, nil
+}
+
+// Install an object outside of any dogconf request, such as the
+// routes given on the command line.
+func (ex *executor) bootstrap(kind dogconf.Kind, id string,
+	attrs map[string]string, who string) error {
+	ex.Lock()
+	defer ex.Unlock()
+
+	ex.who = who
+
+	if _, exists := ex.table(kind).lookup(id); exists {
+		return fmt.Errorf("%v %q already exists", kind, id)
+	}
+
+	if err := ex.table(kind).store(id, ex.ocn+1, attrs); err != nil {
+		return err
+	}
+
+	ex.ocn++
+	rec, _ := ex.table(kind).lookup(id)
+	ex.changed("create", rec)
+	return nil
+}
+
+// Install the objects handed over by an upgrade, as they were,
+// OCNs included, along with the changes that made them.
+func (ex *executor) restore(recs []*dogconf.Record, ocn uint64,
+	changes []*change) error {
+	ex.Lock()
+	defer ex.Unlock()
+
+	ex.changes.changes = changes
+
+	for _, rec := range recs {
+		err := ex.table(rec.Kind).store(rec.Id, rec.Ocn, rec.Attrs)
+		if err != nil {
+			return fmt.Errorf("%v %q: %v", rec.Kind, rec.Id, err)
+		}
+	}
+
+	ex.ocn = ocn
+	return nil
+}
+
+// Change the attributes of an object on dog's own account, as a
+// 'patch' would, provided it is still at the given OCN.  Returns the
+// object's new OCN.
+func (ex *executor) amend(kind dogconf.Kind, id string, ocn uint64,
+	attrs map[string]string, who string) (uint64, error) {
+	ex.Lock()
+	defer ex.Unlock()
+
+	ex.who = who
+
+	if ex.retired {
+		return 0, fmt.Errorf("dog has been upgraded")
+	}
+
+	defer ex.p.adm.reconsider()
+
+	tab := ex.table(kind)
+	rec, ok := tab.lookup(id)
+	if !ok {
+		return 0, fmt.Errorf("%v %q no longer exists", kind, id)
+	}
+
+	if rec.Ocn != ocn {
+		return 0, fmt.Errorf("%v %q is at OCN %v, not %v",
+			kind, id, rec.Ocn, ocn)
+	}
+
+	for k, v := range attrs {
+		rec.Attrs[k] = v
+	}
+
+	if err := tab.store(id, ex.ocn+1, rec.Attrs); err != nil {
+		return 0, err
+	}
+
+	ex.ocn++
+	rec, _ = tab.lookup(id)
+	ex.changed("patch", rec)
+	return ex.ocn, nil
+}
+
+func (ex *executor) get(d *dogconf.GetDirective) ([]*dogconf.Record, error) {
+	if d.Kind == dogconf.SessionKind {
+		return ex.getSessions(d)
+	}
+
+	tab := ex.table(d.Kind)
+
+	switch t := d.Target.(type) {
+	case *dogconf.TargetAll:
+		recs := tab.list()
+		for _, rec := range recs {
+			ex.p.annotate(rec)
+		}
+
+		return recs, nil
+	case *dogconf.TargetOne:
+		rec, ok := tab.lookup(t.What)
+		if !ok {
+			return nil, adminErrf(dogconf.ErrCodeNotFound, t,
+				"%v %q does not exist", d.Kind, t.What)
+		}
+
+		ex.p.annotate(rec)
+		return []*dogconf.Record{rec}, nil
+	}
+
+	panic(fmt.Errorf("Unexpected target type %T for get", d.Target))
+}
+
+// Sessions are not objects of the executor's, but are reported in
+// the same way.
+func (ex *executor) getSessions(d *dogconf.GetDirective) (
+	[]*dogconf.Record, error) {
+	switch t := d.Target.(type) {
+	case *dogconf.TargetAll:
+		sessions := ex.p.sessions.all()
+		sort.Sort(byId(sessions))
+
+		recs := make([]*dogconf.Record, len(sessions))
+		for i, s := range sessions {
+			recs[i] = s.record()
+		}
+
+		return recs, nil
+	case *dogconf.TargetOne:
+		id, _ := strconv.ParseUint(t.What, 10, 64)
+		s, ok := ex.p.sessions.get(id)
+		if !ok {
+			return nil, adminErrf(dogconf.ErrCodeNotFound, t,
+				"session %q does not exist", t.What)
+		}
+
+		return []*dogconf.Record{s.record()}, nil
+	}
+
+	panic(fmt.Errorf("Unexpected target type %T for get", d.Target))
+}
+
+func (ex *executor) create(tab objectTable, d *dogconf.CreateDirective) (
+	[]*dogconf.Record, error) {
+	if _, exists := tab.lookup(d.What); exists {
+		return nil, adminErrf(dogconf.ErrCodeExists, &d.TargetOne,
+			"%v %q already exists", d.Kind, d.What)
+	}
+
+	if err := tab.store(d.What, ex.ocn+1, d.Attrs); err != nil {
+		return nil, adminErrf(dogconf.ErrCodeInvalid, d, "%v", err)
+	}
+
+	ex.ocn++
+	rec, _ := tab.lookup(d.What)
+	ex.changed("create", rec)
+	return []*dogconf.Record{rec}, nil
+}
+
+// Check that the target of a directive exists at the OCN given.
+func checkOcn(tab objectTable, kind dogconf.Kind,
+	t *dogconf.TargetOcn) (*dogconf.Record, error) {
+	rec, ok := tab.lookup(t.What)
+	if !ok {
+		return nil, adminErrf(dogconf.ErrCodeNotFound, t,
+			"%v %q does not exist", kind, t.What)
+	}
+
+	if rec.Ocn != t.Ocn {
+		return nil, adminErrf(dogconf.ErrCodeConflict, t,
+			"%v %q is at OCN %v, not %v",
+			kind, t.What, rec.Ocn, t.Ocn)
+	}
+
+	return rec, nil
+}
+
+func (ex *executor) patch(tab objectTable, d *dogconf.PatchDirective) (
+	[]*dogconf.Record, error) {
+	rec, err := checkOcn(tab, d.Kind, &d.TargetOcn)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := rec.Attrs
+	for k, v := range d.Attrs {
+		if v == "" {
+			delete(attrs, k)
+		} else {
+			attrs[k] = v
+		}
+	}
+
+	if err := tab.store(d.What, ex.ocn+1, attrs); err != nil {
+		return nil, adminErrf(dogconf.ErrCodeInvalid, d, "%v", err)
+	}
+
+	ex.ocn++
+	rec, _ = tab.lookup(d.What)
+	ex.changed("patch", rec)
+	return []*dogconf.Record{rec}, nil
+}
+
+func (ex *executor) delete(tab objectTable, d *dogconf.DeleteDirective) (
+	[]*dogconf.Record, error) {
+	var removed []*dogconf.Record
+	switch t := d.Target.(type) {
+	case *dogconf.TargetAll:
+		removed = tab.list()
+		for _, rec := range removed {
+			tab.remove(rec.Id)
+		}
+	case *dogconf.TargetOcn:
+		rec, err := checkOcn(tab, d.Kind, t)
+		if err != nil {
+			return nil, err
+		}
+
+		tab.remove(t.What)
+		removed = []*dogconf.Record{rec}
+	default:
+		panic(fmt.Errorf("Unexpected target type %T for delete",
+			d.Target))
+	}
+
+	ex.ocn++
+	for _, rec := range removed {
+		ex.deleted(rec, ex.ocn)
+	}
+
+	return nil, nil
+}
+
+// End sessions: one, every one, or those of a route.  Returns the
+// sessions ended, as they were.
+func (ex *executor) terminate(d *dogconf.TerminateDirective) (
+	[]*dogconf.Record, error) {
+	var sessions []*session
+
+	switch t := d.Target.(type) {
+	case *dogconf.TargetAll:
+		sessions = ex.p.sessions.all()
+		sort.Sort(byId(sessions))
+	case *dogconf.TargetOne:
+		if d.Kind == dogconf.RouteKind {
+			if ex.p.rt.entry(t.What) == nil {
+				return nil, adminErrf(dogconf.ErrCodeNotFound,
+					t, "route %q does not exist", t.What)
+			}
+
+			sessions = ex.p.sessions.onRoute(t.What)
+			break
+		}
+
+		id, _ := strconv.ParseUint(t.What, 10, 64)
+		s, ok := ex.p.sessions.get(id)
+		if !ok {
+			return nil, adminErrf(dogconf.ErrCodeNotFound, t,
+				"session %q does not exist", t.What)
+		}
+
+		sessions = []*session{s}
+	default:
+		panic(fmt.Errorf("Unexpected target type %T for terminate",
+			d.Target))
+	}
+
+	recs := make([]*dogconf.Record, len(sessions))
+	for i, s := range sessions {
+		recs[i] = s.record()
+		s.terminate()
+	}
+
+	return recs, nil
+}
+
+// Lock a route, as a 'patch' would, and end each of its sessions as it
+// goes idle.
+func (ex *executor) drain(d *dogconf.DrainDirective) (
+	[]*dogconf.Record, error) {
+	rec, err := checkOcn(ex.p.rt, d.Kind, &d.TargetOcn)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.Attrs["lock"] = "t"
+	if err := ex.p.rt.store(d.What, ex.ocn+1, rec.Attrs); err != nil {
+		return nil, adminErrf(dogconf.ErrCodeInvalid, d, "%v", err)
+	}
+
+	ex.ocn++
+	ex.p.drainRoute(d.What)
+
+	rec, _ = ex.p.rt.lookup(d.What)
+	ex.changed("patch", rec)
+	return []*dogconf.Record{rec}, nil
+}
+
+// Apply changes to routes together, or not at all.  They are applied
+// in order to a copy of the routing table, each with its own OCN, so
+// that later changes may build on earlier ones, and the copy put in
+// place only if every one succeeds.
+func (ex *executor) transaction(d *dogconf.TransactionDirective) (
+	[]*dogconf.Record, error) {
+	tab := ex.p.rt.clone()
+	ocn := ex.ocn
+
+	var changes []*change
+	ex.staged = &changes
+	defer func() { ex.staged = nil }()
+
+	var recs []*dogconf.Record
+	for _, sd := range d.Directives {
+		var applied []*dogconf.Record
+		var err error
+
+		switch sd := sd.(type) {
+		case *dogconf.CreateDirective:
+			applied, err = ex.create(tab, sd)
+		case *dogconf.PatchDirective:
+			applied, err = ex.patch(tab, sd)
+		case *dogconf.DeleteDirective:
+			applied, err = ex.delete(tab, sd)
+		default:
+			panic(fmt.Errorf("Unexpected directive type %T "+
+				"in transaction", sd))
+		}
+
+		if err != nil {
+			ex.ocn = ocn
+			return nil, err
+		}
+
+		recs = append(recs, applied...)
+	}
+
+	ex.p.rt.replace(tab)
+
+	ex.staged = nil
+	for _, c := range changes {
+		ex.changed(c.op, c.rec)
+	}
+
+	return recs, nil
+}
+
+// Every version of one object, or of every object of a kind, as made
+// by each change.
+func (ex *executor) history(d *dogconf.HistoryDirective) (
+	[]*dogconf.Record, error) {
+	ex.Lock()
+	defer ex.Unlock()
+
+	var id string
+	if t, ok := d.Target.(*dogconf.TargetOne); ok {
+		id = t.What
+	}
+
+	changes := ex.changes.since(d.Kind, id, 0)
+	if len(changes) == 0 && id != "" {
+		return nil, adminErrf(dogconf.ErrCodeNotFound, d.Target,
+			"%v %q has no history", d.Kind, id)
+	}
+
+	recs := make([]*dogconf.Record, len(changes))
+	for i, c := range changes {
+		recs[i] = c.record()
+	}
+
+	return recs, nil
+}
+
+// Every object of a kind, as of one OCN, with only the attributes it
+// could be created with again.  The request that would do so is given
+// as each record's "create" status, so that every frontend hands out
+// the same text.
+func (ex *executor) dump(d *dogconf.DumpDirective) (
+	[]*dogconf.Record, error) {
+	ex.Lock()
+	defer ex.Unlock()
+
+	recs := ex.table(d.Kind).list()
+	for _, rec := range recs {
+		rec.Status = map[string]string{
+			"create": dogconf.FormatCreate(rec),
+		}
+	}
+
+	return recs, nil
+}
+
+// Put an object back as it was at an earlier version, as a new
+// version.  Deleted objects are created again, provided they are
+// still as deleted, at the OCN of their deletion.
+func (ex *executor) revert(d *dogconf.RevertDirective) (
+	[]*dogconf.Record, error) {
+	changes := ex.changes.since(d.Kind, d.What, 0)
+	if len(changes) == 0 {
+		return nil, adminErrf(dogconf.ErrCodeNotFound, &d.TargetOcn,
+			"%v %q has no history", d.Kind, d.What)
+	}
+
+	latest := changes[len(changes)-1]
+	if latest.rec.Ocn != d.Ocn {
+		return nil, adminErrf(dogconf.ErrCodeConflict, &d.TargetOcn,
+			"%v %q is at OCN %v, not %v",
+			d.Kind, d.What, latest.rec.Ocn, d.Ocn)
+	}
+
+	var to *change
+	for _, c := range changes {
+		if c.rec.Ocn == d.To && c.op != "delete" {
+			to = c
+		}
+	}
+
+	if to == nil {
+		return nil, adminErrf(dogconf.ErrCodeNotFound, d,
+			"%v %q has no version at OCN %v", d.Kind, d.What, d.To)
+	}
+
+	attrs := make(map[string]string)
+	for k, v := range to.rec.Attrs {
+		attrs[k] = v
+	}
+
+	tab := ex.table(d.Kind)
+	if err := tab.store(d.What, ex.ocn+1, attrs); err != nil {
+		return nil, adminErrf(dogconf.ErrCodeInvalid, d, "%v", err)
+	}
+
+	ex.ocn++
+
+	op := "patch"
+	if latest.op == "delete" {
+		op = "create"
+	}
+
+	rec, _ := tab.lookup(d.What)
+	ex.changed(op, rec)
+	return []*dogconf.Record{rec}, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"../dogconf"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A change to routes can be explained rather than made, e.g.
+//
+//	[route 'x' @ 5 [explain [patch [addr='10.0.0.2:5432']]]]
+//
+// It is worked out just as it would be in a transaction, against a
+// copy of the routing table that is then thrown away, so that it is
+// checked against the routes as they are, and refused for the same
+// reasons.  Each route it would change is reported as it would
+// become, at the OCN it would be given, with the explanation as its
+// status:
+//
+//	change    'create', 'patch' or 'delete'
+//	current   the OCN the route is at now, unless it is to be created
+//	conflict  't' if the OCN given is not the route's current one, in
+//	          which case the change is worked out against the
+//	          current version instead
+//	sessions  how many sessions are running on the route
+//	diff      for a patch, each attribute it would change, e.g.
+//	          "lock: 'f' -> 't'"
+//
+// A deleted route is reported with the attributes it had.
+
+func (ex *executor) explain(d *dogconf.ExplainDirective) (
+	[]*dogconf.Record, error) {
+	ex.Lock()
+	defer ex.Unlock()
+
+	tab := ex.p.rt.clone()
+
+	// The OCNs handed out are taken back, along with the changes.
+	ocn := ex.ocn
+	defer func() { ex.ocn = ocn }()
+
+	var changes []*change
+	ex.staged = &changes
+	defer func() { ex.staged = nil }()
+
+	var conflict bool
+	var err error
+
+	switch sd := d.Directive.(type) {
+	case *dogconf.CreateDirective:
+		_, err = ex.create(tab, sd)
+	case *dogconf.PatchDirective:
+		patch := *sd
+		conflict = toCurrentOcn(tab, &patch.TargetOcn)
+		_, err = ex.patch(tab, &patch)
+	case *dogconf.DeleteDirective:
+		del := *sd
+		if t, ok := sd.Target.(*dogconf.TargetOcn); ok {
+			target := *t
+			conflict = toCurrentOcn(tab, &target)
+			del.Target = &target
+		}
+
+		_, err = ex.delete(tab, &del)
+	default:
+		panic(fmt.Errorf("Unexpected directive type %T to explain",
+			d.Directive))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	recs := make([]*dogconf.Record, len(changes))
+	for i, c := range changes {
+		rec := *c.rec
+		rec.Status = map[string]string{
+			"change":   c.op,
+			"conflict": "f",
+			"sessions": strconv.Itoa(
+				len(ex.p.sessions.onRoute(rec.Id))),
+		}
+
+		if conflict {
+			rec.Status["conflict"] = "t"
+		}
+
+		if was, ok := ex.p.rt.lookup(rec.Id); ok {
+			rec.Status["current"] = strconv.FormatUint(was.Ocn, 10)
+
+			switch c.op {
+			case "patch":
+				rec.Status["diff"] = attrDiff(was.Attrs,
+					rec.Attrs)
+			case "delete":
+				rec.Attrs = was.Attrs
+			}
+		}
+
+		recs[i] = &rec
+	}
+
+	return recs, nil
+}
+
+// Bring a target up to the current OCN of its route, if it exists,
+// reporting whether it had to be.
+func toCurrentOcn(tab objectTable, t *dogconf.TargetOcn) bool {
+	rec, ok := tab.lookup(t.What)
+	if !ok || rec.Ocn == t.Ocn {
+		return false
+	}
+
+	t.Ocn = rec.Ocn
+	return true
+}
+
+// Describe the attributes that differ between two versions of an
+// object, in sorted order, e.g. "addr: 'a:5432' -> 'b:5432', lock:
+// 'f' -> 't'".
+func attrDiff(was, is map[string]string) string {
+	names := make(map[string]bool)
+	for k := range was {
+		names[k] = true
+	}
+
+	for k := range is {
+		names[k] = true
+	}
+
+	keys := make([]string, 0, len(names))
+	for k := range names {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var diffs []string
+	for _, k := range keys {
+		if was[k] != is[k] {
+			diffs = append(diffs, k+": "+dogconf.QuoteStr(was[k])+
+				" -> "+dogconf.QuoteStr(is[k]))
+		}
+	}
+
+	return strings.Join(diffs, ", ")
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The health checker measures how far each replica of a route
+// splitting reads has fallen behind, by logging in to it, and to the
+// primary, with a password from the passfile.
+//
+// Lag is measured as the time since the replica last replayed a
+// transaction, or zero if it has replayed all it has received, as by
+// pg_last_xact_replay_timestamp().  The distance in bytes of WAL
+// between the primary and the replica is reported, too.
+//
+// Routes with a 'maxLag' send reads only to replicas measured to be
+// within it, as of a recent check: those further behind, that could
+// not be checked, or that are yet to be checked, are passed over until
+// they catch up.  If no replica qualifies, the primary serves reads.
+// The limit is removed by patching 'maxLag' to the empty string, and
+// goes along with the route's 'replicas' when they are unset.
+
+const replicaLagQuery = `SELECT pg_last_wal_replay_lsn(),
+	CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn()
+	THEN 0
+	ELSE extract(epoch FROM now() - pg_last_xact_replay_timestamp())
+	END`
+
+const primaryLSNQuery = `SELECT pg_current_wal_lsn()`
+
+// The outcome of the latest check of one replica.
+type replicaHealth struct {
+	checked time.Time
+
+	// Why the check failed, or empty if it did not
+	err string
+
+	lag time.Duration
+
+	// Bytes of WAL behind the primary, or -1 if unknown
+	lagBytes int64
+}
+
+type healthChecker struct {
+	sync.RWMutex
+
+	p        *proxy
+	interval time.Duration
+
+	// The user to log in as, to the database of each route
+	user string
+
+	// By replica address
+	tab map[string]*replicaHealth
+
+	// Why each primary could not be checked last time, so that
+	// failures are logged only as they start
+	primaryErrs map[string]string
+}
+
+func newHealthChecker(p *proxy, interval time.Duration,
+	user string) *healthChecker {
+	return &healthChecker{
+		p:        p,
+		interval: interval,
+		user:     user,
+		tab:      make(map[string]*replicaHealth),
+
+		primaryErrs: make(map[string]string),
+	}
+}
+
+// The latest check of the replica at addr, or nil if there has been
+// none.
+func (hc *healthChecker) health(addr string) *replicaHealth {
+	hc.RLock()
+	defer hc.RUnlock()
+
+	return hc.tab[addr]
+}
+
+// Whether the replica at addr may be sent reads of a route allowing
+// the given lag.
+func (hc *healthChecker) eligible(addr string, maxLag time.Duration) bool {
+	if maxLag == 0 {
+		return true
+	}
+
+	h := hc.health(addr)
+
+	// Results older than a few checks are as good as none, as when
+	// checks hang.
+	return h != nil && h.err == "" && h.lag <= maxLag &&
+		time.Since(h.checked) < 3*hc.interval
+}
+
+// Check every replica each interval, forever.
+func (hc *healthChecker) run() {
+	for {
+		hc.checkAll()
+		time.Sleep(hc.interval)
+	}
+}
+
+func (hc *healthChecker) checkAll() {
+	// Each replica is checked once, through the first route naming
+	// it, and each primary once for all its replicas.
+	replicas := make(map[string]*routingEntry)
+	primaries := make(map[string]*routingEntry)
+	for _, ent := range hc.p.rt.all() {
+		if !ent.splitReads {
+			continue
+		}
+
+		primaries[ent.addr] = ent
+		for _, addr := range ent.replicas {
+			replicas[addr] = ent
+		}
+	}
+
+	var wg sync.WaitGroup
+	var lsnLock sync.Mutex
+	primaryLSN := make(map[string]uint64)
+	primaryErrs := make(map[string]string)
+
+	for addr, ent := range primaries {
+		wg.Add(1)
+		go func(addr string, ent *routingEntry) {
+			defer wg.Done()
+
+			lsn, err := hc.checkPrimary(addr, ent)
+
+			lsnLock.Lock()
+			defer lsnLock.Unlock()
+
+			if err != nil {
+				primaryErrs[addr] = err.Error()
+				return
+			}
+
+			primaryLSN[addr] = lsn
+		}(addr, ent)
+	}
+
+	wg.Wait()
+
+	for addr, msg := range primaryErrs {
+		if hc.primaryErrs[addr] != msg {
+			log.Printf("Could not check primary %v: %v\n",
+				addr, msg)
+		}
+	}
+
+	hc.primaryErrs = primaryErrs
+
+	results := make(map[string]*replicaHealth)
+	for addr, ent := range replicas {
+		h := &replicaHealth{lagBytes: -1}
+		results[addr] = h
+
+		wg.Add(1)
+		go func(addr string, ent *routingEntry) {
+			defer wg.Done()
+
+			err := hc.checkReplica(addr, ent, h, primaryLSN)
+			h.checked = time.Now()
+			if err != nil {
+				h.err = err.Error()
+				splitStats.Add("replicaCheckFailures", 1)
+			}
+		}(addr, ent)
+	}
+
+	wg.Wait()
+
+	for addr, h := range results {
+		prev := hc.health(addr)
+		switch {
+		case h.err != "" && (prev == nil || prev.err != h.err):
+			log.Printf("Could not check replica %v: %v\n",
+				addr, h.err)
+		case h.err == "" && prev != nil && prev.err != "":
+			log.Printf("Checked replica %v again\n", addr)
+		}
+	}
+
+	// Replicas no longer named by any route are forgotten.
+	hc.Lock()
+	hc.tab = results
+	hc.Unlock()
+}
+
+// The current WAL location of a primary.
+func (hc *healthChecker) checkPrimary(addr string,
+	ent *routingEntry) (uint64, error) {
+	rows, err := hc.query(addr, ent, primaryLSNQuery)
+	if err != nil {
+		return 0, err
+	}
+
+	return parseLSN(rows[0][0])
+}
+
+func (hc *healthChecker) checkReplica(addr string, ent *routingEntry,
+	h *replicaHealth, primaryLSN map[string]uint64) error {
+	rows, err := hc.query(addr, ent, replicaLagQuery)
+	if err != nil {
+		return err
+	}
+
+	if len(rows[0]) != 2 {
+		return fmt.Errorf("unexpected result of health check")
+	}
+
+	if rows[0][0] == "" {
+		return fmt.Errorf("not in recovery")
+	}
+
+	if rows[0][1] == "" {
+		return fmt.Errorf("no transactions replayed yet")
+	}
+
+	secs, err := strconv.ParseFloat(rows[0][1], 64)
+	if err != nil {
+		return fmt.Errorf("bad lag %q", rows[0][1])
+	}
+
+	h.lag = time.Duration(secs * float64(time.Second))
+	if h.lag < 0 {
+		h.lag = 0
+	}
+
+	replayed, err := parseLSN(rows[0][0])
+	if err != nil {
+		return err
+	}
+
+	if current, ok := primaryLSN[ent.addr]; ok {
+		h.lagBytes = 0
+		if current > replayed {
+			h.lagBytes = int64(current - replayed)
+		}
+	}
+
+	return nil
+}
+
+func (hc *healthChecker) query(addr string, ent *routingEntry,
+	sql string) ([][]string, error) {
+	return hc.p.probe(addr, ent, hc.user, hc.interval, sql)
+}
+
+// Run a query returning one row on the server at addr, logging in as
+// user to the route's database, all within the given time.
+func (p *proxy) probe(addr string, ent *routingEntry, user string,
+	limit time.Duration, sql string) ([][]string, error) {
+	// Checks must not outlast their interval, whatever the
+	// timeouts of sessions.
+	sl := p.login(ent)
+	if sl.timeouts.dial == 0 || sl.timeouts.dial > limit {
+		sl.timeouts.dial = limit
+	}
+
+	if sl.timeouts.auth == 0 || sl.timeouts.auth > limit {
+		sl.timeouts.auth = limit
+	}
+
+	sl.retry = dialRetry{}
+
+	s, err := sl.connect(addr, map[string]string{
+		"user":             user,
+		"database":         ent.dbnameOut,
+		"application_name": "dog health check",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.Close()
+
+	s.Conn.SetDeadline(time.Now().Add(limit))
+
+	rows, err := simpleQuery(s, sql)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) != 1 || len(rows[0]) < 1 {
+		return nil, fmt.Errorf("unexpected result of health check")
+	}
+
+	return rows, nil
+}
+
+// Parse a WAL location, as written by Postgres, e.g. '16/B374D848'.
+func parseLSN(lsn string) (uint64, error) {
+	parts := strings.SplitN(lsn, "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("bad WAL location %q", lsn)
+	}
+
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad WAL location %q", lsn)
+	}
+
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad WAL location %q", lsn)
+	}
+
+	return hi<<32 | lo, nil
+}
+
+// The lag of the replica at addr as reported by dogconf and metrics,
+// e.g. '1.5s', or 'unknown'.
+func (hc *healthChecker) lagString(addr string) string {
+	h := hc.health(addr)
+	if h == nil || h.err != "" {
+		return "unknown"
+	}
+
+	return h.lag.String()
+}
+
+// The replica lag for metrics, by address.
+func (hc *healthChecker) stats() map[string]interface{} {
+	hc.RLock()
+	defer hc.RUnlock()
+
+	stats := make(map[string]interface{})
+	for addr, h := range hc.tab {
+		stats[addr] = map[string]interface{}{
+			"lagSeconds": h.lag.Seconds(),
+			"lagBytes":   h.lagBytes,
+			"checked":    h.checked,
+			"error":      h.err,
+		}
+	}
+
+	return stats
+}
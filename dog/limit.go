@@ -0,0 +1,242 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The number of sessions using, and waiting to use, a route or a
+// backend.
+type usage struct {
+	Active int `json:"active"`
+	Queued int `json:"queued"`
+}
+
+// A client waiting to be admitted.
+type waiter struct {
+	route   string
+	backend string
+
+	// Closed upon admission
+	ready    chan struct{}
+	admitted bool
+}
+
+// Admits sessions subject to connection limits: one across the whole
+// proxy, one per route and one per backend.  Clients over any limit
+// wait their turn in a single FIFO queue, so that a stampede on one
+// route cannot take every connection a backend has to offer.
+type admission struct {
+	sync.Mutex
+
+	// Limit on sessions across the whole proxy, zero for none
+	max   int
+	total int
+
+	// Look up the current limits of a route and backend, zero for
+	// none.  Consulted on every attempt at admission, so that
+	// changes apply to clients already waiting.
+	limits func(route, backend string) (int, int)
+
+	routes   map[string]*usage
+	backends map[string]*usage
+	queue    list.List
+}
+
+func newAdmission(max int,
+	limits func(route, backend string) (int, int)) *admission {
+	return &admission{
+		max:      max,
+		limits:   limits,
+		routes:   make(map[string]*usage),
+		backends: make(map[string]*usage),
+	}
+}
+
+// Find the usage for key, creating it if necessary.
+func use(m map[string]*usage, key string) *usage {
+	u := m[key]
+	if u == nil {
+		u = new(usage)
+		m[key] = u
+	}
+
+	return u
+}
+
+// Forget the usage for key once it is idle, to avoid accruing entries
+// for routes and backends that no longer exist.
+func tidy(m map[string]*usage, key string) {
+	if u := m[key]; u != nil && u.Active == 0 && u.Queued == 0 {
+		delete(m, key)
+	}
+}
+
+// Wait for admission of a session on the route to the backend at
+// addr, queueing behind earlier clients if any limit has been
+// reached, for at most the timeout.  Upon admission, the returned
+// function must be called to give up the session's place when it
+// ends.
+func (a *admission) acquire(route, addr string,
+	timeout time.Duration) (func(), error) {
+	w := &waiter{route: route, backend: addr, ready: make(chan struct{})}
+
+	a.Lock()
+	elem := a.queue.PushBack(w)
+	use(a.routes, route).Queued++
+	use(a.backends, addr).Queued++
+	a.dispatch()
+	a.Unlock()
+
+	release := func() { a.release(w) }
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-timer.C:
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	// Admission may have raced with the timeout.
+	if w.admitted {
+		return release, nil
+	}
+
+	a.queue.Remove(elem)
+	use(a.routes, route).Queued--
+	use(a.backends, addr).Queued--
+	tidy(a.routes, route)
+	tidy(a.backends, addr)
+
+	return nil, fmt.Errorf("too many connections for route %q; "+
+		"gave up waiting after %v", route, timeout)
+}
+
+func (a *admission) release(w *waiter) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.total--
+	use(a.routes, w.route).Active--
+	use(a.backends, w.backend).Active--
+	tidy(a.routes, w.route)
+	tidy(a.backends, w.backend)
+
+	a.dispatch()
+}
+
+// Admit waiting clients, e.g. after limits have been raised.
+func (a *admission) reconsider() {
+	a.Lock()
+	defer a.Unlock()
+
+	a.dispatch()
+}
+
+// Admit waiting clients in order of arrival, as far as the limits
+// allow.  A client held back by its route or backend holds back the
+// later clients of the same route or backend, so that none are
+// overtaken, but not the clients of others.  The caller must hold the
+// lock.
+func (a *admission) dispatch() {
+	heldRoutes := make(map[string]bool)
+	heldBackends := make(map[string]bool)
+
+	for e := a.queue.Front(); e != nil; {
+		if a.max > 0 && a.total >= a.max {
+			return
+		}
+
+		next := e.Next()
+		w := e.Value.(*waiter)
+		r := use(a.routes, w.route)
+		b := use(a.backends, w.backend)
+		routeMax, backendMax := a.limits(w.route, w.backend)
+
+		routeFull := routeMax > 0 && r.Active >= routeMax
+		backendFull := backendMax > 0 && b.Active >= backendMax
+
+		if routeFull {
+			heldRoutes[w.route] = true
+		}
+
+		if backendFull {
+			heldBackends[w.backend] = true
+		}
+
+		if !heldRoutes[w.route] && !heldBackends[w.backend] {
+			a.queue.Remove(e)
+			r.Queued--
+			r.Active++
+			b.Queued--
+			b.Active++
+			a.total++
+
+			w.admitted = true
+			close(w.ready)
+		}
+
+		e = next
+	}
+}
+
+func (a *admission) routeUsage(route string) usage {
+	a.Lock()
+	defer a.Unlock()
+
+	if u := a.routes[route]; u != nil {
+		return *u
+	}
+
+	return usage{}
+}
+
+func (a *admission) backendUsage(addr string) usage {
+	a.Lock()
+	defer a.Unlock()
+
+	if u := a.backends[addr]; u != nil {
+		return *u
+	}
+
+	return usage{}
+}
+
+// A consistent copy of the admission state, for reporting.
+type admissionStats struct {
+	Total    int              `json:"total"`
+	Max      int              `json:"max"`
+	Queued   int              `json:"queued"`
+	Routes   map[string]usage `json:"routes"`
+	Backends map[string]usage `json:"backends"`
+}
+
+func (a *admission) stats() *admissionStats {
+	a.Lock()
+	defer a.Unlock()
+
+	s := &admissionStats{
+		Total:    a.total,
+		Max:      a.max,
+		Queued:   a.queue.Len(),
+		Routes:   make(map[string]usage),
+		Backends: make(map[string]usage),
+	}
+
+	for k, u := range a.routes {
+		s.Routes[k] = *u
+	}
+
+	for k, u := range a.backends {
+		s.Backends[k] = *u
+	}
+
+	return s
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"../dogconf"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+)
+
+// An address clients are accepted on, with its own settings.  Like
+// routes, entries are never modified once posted; the socket itself
+// lives on through patches that leave the address alone, so that
+// clients are not turned away while settings change.
+type listenerEntry struct {
+	id   string
+	ocn  uint64
+	addr string
+
+	// Whether clients must begin with a PROXY protocol header
+	proxyProtocol bool
+
+	// One of "disable", "allow" (when the client asks for it) or
+	// "require"
+	tlsMode string
+	tlsCert string
+	tlsKey  string
+
+	// Nil when TLS is disabled
+	tlsConf *tls.Config
+}
+
+// Build a listenerEntry from dogconf attributes, which are presumed
+// to have passed semantic analysis.  The certificate is loaded here,
+// so that a bad one is rejected before it can affect any client.
+func newListenerEntry(id string, ocn uint64,
+	attrs map[string]string) (*listenerEntry, error) {
+	le := &listenerEntry{
+		id:            id,
+		ocn:           ocn,
+		addr:          attrs["addr"],
+		proxyProtocol: attrs["proxyProtocol"] == "t",
+		tlsMode:       attrs["tls"],
+		tlsCert:       attrs["tlsCert"],
+		tlsKey:        attrs["tlsKey"],
+	}
+
+	if le.addr == "" {
+		return nil, fmt.Errorf("listener %q has no 'addr'", id)
+	}
+
+	if le.tlsMode == "" {
+		le.tlsMode = "disable"
+	}
+
+	if le.tlsMode != "disable" {
+		if le.tlsCert == "" || le.tlsKey == "" {
+			return nil, fmt.Errorf("listener %q needs 'tlsCert' "+
+				"and 'tlsKey' to use TLS", id)
+		}
+
+		cert, err := tls.LoadX509KeyPair(le.tlsCert, le.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+
+		le.tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return le, nil
+}
+
+func (le *listenerEntry) record() *dogconf.Record {
+	proxyProtocol := "f"
+	if le.proxyProtocol {
+		proxyProtocol = "t"
+	}
+
+	rec := &dogconf.Record{
+		Kind: dogconf.ListenerKind,
+		Id:   le.id,
+		Ocn:  le.ocn,
+		Attrs: map[string]string{
+			"addr":          le.addr,
+			"proxyProtocol": proxyProtocol,
+			"tls":           le.tlsMode,
+		},
+	}
+
+	if le.tlsCert != "" {
+		rec.Attrs["tlsCert"] = le.tlsCert
+	}
+
+	if le.tlsKey != "" {
+		rec.Attrs["tlsKey"] = le.tlsKey
+	}
+
+	return rec
+}
+
+// The code of the SSLRequest and GSSENCRequest packets, which clients
+// send in place of a startup packet to ask for encryption.
+const (
+	sslRequestCode    = 80877103
+	gssencRequestCode = 80877104
+)
+
+// A connection whose first bytes have already been read, and are to
+// be read again.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (rc *replayConn) Read(b []byte) (int, error) {
+	return rc.r.Read(b)
+}
+
+// Answer any request by the client for encryption, according to the
+// listener's settings, returning the connection to carry on the
+// session with and whether it is encrypted.
+func negotiateClientTLS(conn net.Conn,
+	le *listenerEntry) (net.Conn, bool, error) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return nil, false, err
+		}
+
+		code := binary.BigEndian.Uint32(hdr[4:])
+		if binary.BigEndian.Uint32(hdr[:4]) != 8 ||
+			(code != sslRequestCode && code != gssencRequestCode) {
+			// An ordinary startup packet
+			return &replayConn{
+				Conn: conn,
+				r:    io.MultiReader(bytes.NewReader(hdr[:]), conn),
+			}, false, nil
+		}
+
+		// Refused requests are followed by another attempt,
+		// e.g. an SSLRequest after a GSSENCRequest, or the
+		// startup packet.
+		if code == gssencRequestCode || le.tlsConf == nil {
+			if _, err := conn.Write([]byte{'N'}); err != nil {
+				return nil, false, err
+			}
+
+			continue
+		}
+
+		if _, err := conn.Write([]byte{'S'}); err != nil {
+			return nil, false, err
+		}
+
+		tlsConn := tls.Server(conn, le.tlsConf)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, false, err
+		}
+
+		return tlsConn, true, nil
+	}
+}
+
+type listenerTable struct {
+	// Listeners by identifier, and their sockets
+	tab   map[string]*listenerEntry
+	socks map[string]net.Listener
+
+	// Open a socket for a listener, and accept clients on it
+	// until it is closed
+	listen func(id, addr string) (net.Listener, error)
+	serve  func(id string, ln net.Listener)
+
+	sync.RWMutex
+}
+
+func newListenerTable(listen func(id, addr string) (net.Listener, error),
+	serve func(id string, ln net.Listener)) *listenerTable {
+	return &listenerTable{
+		tab:    make(map[string]*listenerEntry),
+		socks:  make(map[string]net.Listener),
+		listen: listen,
+		serve:  serve,
+	}
+}
+
+// The current settings of the listener, for a client accepted on ln,
+// or nil if ln has since been closed by a change of address or
+// removal.
+func (lt *listenerTable) current(id string, ln net.Listener) *listenerEntry {
+	lt.RLock()
+	defer lt.RUnlock()
+
+	if lt.socks[id] != ln {
+		return nil
+	}
+
+	return lt.tab[id]
+}
+
+// The address the listener is actually bound to, which differs from
+// its 'addr' when that leaves the port to the operating system.
+func (lt *listenerTable) bound(id string) string {
+	lt.RLock()
+	defer lt.RUnlock()
+
+	if ln := lt.socks[id]; ln != nil {
+		return ln.Addr().String()
+	}
+
+	return ""
+}
+
+// Implementation of objectTable, for the executor.
+
+func (lt *listenerTable) lookup(id string) (*dogconf.Record, bool) {
+	lt.RLock()
+	defer lt.RUnlock()
+
+	le, ok := lt.tab[id]
+	if !ok {
+		return nil, false
+	}
+
+	return le.record(), true
+}
+
+func (lt *listenerTable) list() []*dogconf.Record {
+	lt.RLock()
+	defer lt.RUnlock()
+
+	ids := make([]string, 0, len(lt.tab))
+	for id := range lt.tab {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	recs := make([]*dogconf.Record, len(ids))
+	for i, id := range ids {
+		recs[i] = lt.tab[id].record()
+	}
+
+	return recs
+}
+
+// Install a listener, opening a socket unless the previous version
+// already has one on the same address.  Sessions accepted on a
+// socket that is closed carry on regardless.
+func (lt *listenerTable) store(id string, ocn uint64,
+	attrs map[string]string) error {
+	le, err := newListenerEntry(id, ocn, attrs)
+	if err != nil {
+		return err
+	}
+
+	lt.Lock()
+	defer lt.Unlock()
+
+	if old := lt.tab[id]; old != nil && old.addr == le.addr {
+		lt.tab[id] = le
+		return nil
+	}
+
+	ln, err := lt.listen(id, le.addr)
+	if err != nil {
+		return err
+	}
+
+	if old := lt.socks[id]; old != nil {
+		old.Close()
+	}
+
+	lt.tab[id] = le
+	lt.socks[id] = ln
+	go lt.serve(id, ln)
+
+	return nil
+}
+
+func (lt *listenerTable) remove(id string) {
+	lt.Lock()
+	defer lt.Unlock()
+
+	if ln := lt.socks[id]; ln != nil {
+		ln.Close()
+	}
+
+	delete(lt.tab, id)
+	delete(lt.socks, id)
+}
+
+// The sockets of every listener, by identifier.
+func (lt *listenerTable) sockets() map[string]net.Listener {
+	lt.RLock()
+	defer lt.RUnlock()
+
+	socks := make(map[string]net.Listener, len(lt.socks))
+	for id, ln := range lt.socks {
+		socks[id] = ln
+	}
+
+	return socks
+}
+
+// Stop accepting clients on every listener, once another process has
+// taken over their sockets.  Unix sockets are left in place for it.
+func (lt *listenerTable) closeAll() {
+	lt.Lock()
+	defer lt.Unlock()
+
+	for id, ln := range lt.socks {
+		closeShared(ln)
+		delete(lt.socks, id)
+	}
+}
+
+// Accept clients on a listener's socket until it is closed.
+func (p *proxy) serveListener(id string, ln net.Listener) {
+	log.Printf("Listening on %v for listener %q\n", ln.Addr(), id)
+
+	for {
+		conn, err := ln.Accept()
+
+		le := p.listeners.current(id, ln)
+		if le == nil {
+			if conn != nil {
+				conn.Close()
+			}
+
+			log.Printf("Stopped listening on %v\n", ln.Addr())
+			return
+		}
+
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			continue
+		}
+
+		go handleConnection(conn, p, le)
+	}
+}
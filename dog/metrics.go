@@ -0,0 +1,25 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Run-time statistics are published through expvar, which serves
+// them as JSON at /debug/vars.
+
+func publishMetrics(p *proxy) {
+	expvar.Publish("admission", expvar.Func(func() interface{} {
+		return p.adm.stats()
+	}))
+	expvar.Publish("replicas", expvar.Func(func() interface{} {
+		return p.health.stats()
+	}))
+}
+
+func serveMetrics(ln net.Listener) {
+	err := http.Serve(ln, nil)
+	log.Printf("Metrics listener exits: %v\n", err)
+}
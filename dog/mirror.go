@@ -0,0 +1,319 @@
+package main
+
+import (
+	"expvar"
+	"femebe"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Routes with a 'mirror' copy what their clients send to a second
+// server, over a connection dog logs in to on each client's behalf
+// with a password from the passfile.  The mirror's responses are
+// discarded, but compared with the primary's: how long each took, and
+// whether either failed, are counted by route under "mirror" in the
+// metrics.
+//
+// With 'mirrorSelectsOnly', only simple Queries made of nothing but
+// SELECTs are copied, each standing alone.  Otherwise everything
+// after startup is.
+//
+// The mirror must never hold up the session.  Messages are handed to
+// it through a queue, and should the queue fill, as when the mirror is
+// slow or still connecting, the message is dropped.  Copying
+// everything cannot survive losing a message, so the mirror is then
+// abandoned for the rest of the session.
+//
+// Mirroring is stopped by patching 'mirror' to the empty string, which
+// unsets it, along with 'mirrorSelectsOnly'.  Sessions already being
+// mirrored go on being so until they end.
+
+var mirrorStats = expvar.NewMap("mirror")
+var mirrorStatsLock sync.Mutex
+
+// How many messages may wait for the mirror.
+const mirrorQueueLen = 256
+
+// The mirror statistics of a route.
+func routeMirrorStats(route string) *expvar.Map {
+	mirrorStatsLock.Lock()
+	defer mirrorStatsLock.Unlock()
+
+	if stats, ok := mirrorStats.Get(route).(*expvar.Map); ok {
+		return stats
+	}
+
+	stats := new(expvar.Map).Init()
+	mirrorStats.Set(route, stats)
+	return stats
+}
+
+// A client message that ends in a ReadyForQuery, and how the primary,
+// and the mirror if it was copied there, responded to it.
+type mirroredRequest struct {
+	copied bool
+	sent   time.Time
+
+	primaryDone, mirrorDone time.Time
+	primaryErr, mirrorErr   bool
+}
+
+type mirror struct {
+	sync.Mutex
+
+	addr        string
+	selectsOnly bool
+	stats       *expvar.Map
+
+	// Copies of messages for the mirror, closed when the session
+	// ends or the mirror is abandoned
+	out    chan *femebe.Message
+	closed bool
+
+	// Set once the primary is first ready for a query, before which
+	// the client is authenticating to it
+	ready bool
+
+	// Requests awaiting the primary, and those awaiting the mirror
+	primaryQ, mirrorQ []*mirroredRequest
+
+	// Whether an ErrorResponse has come from each since its last
+	// ReadyForQuery
+	primaryErr, mirrorErr bool
+}
+
+// Start mirroring a session of the route, logging in to the mirror
+// with the given startup parameters.
+func (p *proxy) newMirror(ent *routingEntry,
+	params map[string]string) *mirror {
+	m := &mirror{
+		addr:        ent.mirror,
+		selectsOnly: ent.mirrorSelectsOnly,
+		stats:       routeMirrorStats(ent.id),
+		out:         make(chan *femebe.Message, mirrorQueueLen),
+	}
+
+	go m.run(p.login(ent), params)
+
+	return m
+}
+
+// Connect to the mirror and relay messages to it, in the background.
+func (m *mirror) run(sl *serverLogin, params map[string]string) {
+	conn, err := sl.connect(m.addr, params)
+	if err != nil {
+		log.Printf("Could not connect to mirror %v: %v\n", m.addr, err)
+		m.stats.Add("connectFailures", 1)
+		m.abandon()
+
+		return
+	}
+
+	defer conn.Close()
+
+	go m.receive(conn)
+
+	for msg := range m.out {
+		err := conn.Send(msg)
+		if err == nil && len(m.out) == 0 {
+			err = conn.Flush()
+		}
+
+		if err != nil {
+			log.Printf("Lost mirror %v: %v\n", m.addr, err)
+			m.abandon()
+			return
+		}
+	}
+}
+
+// Read and discard the mirror's responses, noting how each went.
+func (m *mirror) receive(conn *ProxyPair) {
+	var msg femebe.Message
+
+	for {
+		if err := conn.Next(&msg); err != nil {
+			return
+		}
+
+		switch msg.MsgType() {
+		case 'E':
+			m.Lock()
+			m.mirrorErr = true
+			m.Unlock()
+		case 'Z':
+			m.mirrorReady()
+		}
+	}
+}
+
+func (m *mirror) mirrorReady() {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(m.mirrorQ) == 0 {
+		return
+	}
+
+	req := m.mirrorQ[0]
+	m.mirrorQ = m.mirrorQ[1:]
+
+	req.mirrorDone = time.Now()
+	req.mirrorErr = m.mirrorErr
+	m.mirrorErr = false
+
+	m.compare(req)
+}
+
+// Note a message on its way from the client to the primary, copying it
+// to the mirror if it should be.
+func (m *mirror) fromClient(msg *femebe.Message) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.ready {
+		return
+	}
+
+	var req *mirroredRequest
+	switch msg.MsgType() {
+	case 'Q', 'S', 'F':
+		req = &mirroredRequest{sent: time.Now()}
+		m.primaryQ = append(m.primaryQ, req)
+	}
+
+	if m.closed || (m.selectsOnly && !onlySelects(msg)) {
+		return
+	}
+
+	payload, err := msg.Force()
+	if err != nil {
+		return
+	}
+
+	var c femebe.Message
+	c.InitFromBytes(msg.MsgType(), append([]byte(nil), payload...))
+
+	select {
+	case m.out <- &c:
+		if req != nil {
+			req.copied = true
+			m.mirrorQ = append(m.mirrorQ, req)
+		}
+	default:
+		m.stats.Add("dropped", 1)
+		if !m.selectsOnly {
+			log.Printf("Mirror %v fell behind, abandoning it\n",
+				m.addr)
+			m.abandonLocked()
+		}
+	}
+}
+
+// Whether a message is a simple Query of nothing but SELECTs.
+func onlySelects(msg *femebe.Message) bool {
+	if msg.MsgType() != 'Q' {
+		return false
+	}
+
+	payload, err := msg.Force()
+	if err != nil {
+		return false
+	}
+
+	sql, _ := readCString(payload)
+	stmts := sqlStatements(sql)
+	for _, stmt := range stmts {
+		if !strings.HasPrefix(stmt, "SELECT") {
+			return false
+		}
+	}
+
+	return len(stmts) > 0
+}
+
+// Note a message on its way from the primary to the client.
+func (m *mirror) fromServer(msg *femebe.Message) {
+	m.Lock()
+	defer m.Unlock()
+
+	switch msg.MsgType() {
+	case 'E':
+		m.primaryErr = true
+		return
+	case 'Z':
+	default:
+		return
+	}
+
+	if !m.ready {
+		m.ready = true
+		m.primaryErr = false
+		return
+	}
+
+	if len(m.primaryQ) == 0 {
+		return
+	}
+
+	req := m.primaryQ[0]
+	m.primaryQ = m.primaryQ[1:]
+
+	req.primaryDone = time.Now()
+	req.primaryErr = m.primaryErr
+	m.primaryErr = false
+
+	m.compare(req)
+}
+
+// Record how the primary and mirror compared on a request, once both
+// have responded.  The caller must hold the lock.
+func (m *mirror) compare(req *mirroredRequest) {
+	if !req.copied || req.primaryDone.IsZero() ||
+		req.mirrorDone.IsZero() {
+		return
+	}
+
+	primary := req.primaryDone.Sub(req.sent)
+	mirrored := req.mirrorDone.Sub(req.sent)
+
+	m.stats.Add("requests", 1)
+	m.stats.Add("primaryMicroseconds", int64(primary/time.Microsecond))
+	m.stats.Add("mirrorMicroseconds", int64(mirrored/time.Microsecond))
+	if mirrored > primary {
+		m.stats.Add("mirrorSlower", 1)
+	}
+
+	switch {
+	case req.primaryErr && !req.mirrorErr:
+		m.stats.Add("primaryOnlyErrors", 1)
+	case req.mirrorErr && !req.primaryErr:
+		m.stats.Add("mirrorOnlyErrors", 1)
+	}
+}
+
+// Stop mirroring, for the rest of the session.
+func (m *mirror) abandon() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.abandonLocked()
+}
+
+func (m *mirror) abandonLocked() {
+	if m.closed {
+		return
+	}
+
+	m.closed = true
+	close(m.out)
+
+	// Requests already copied will never be compared.
+	for _, req := range m.mirrorQ {
+		req.copied = false
+	}
+
+	m.mirrorQ = nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Passwords for the connections dog makes to servers on its own
+// account, such as to replicas, in the format of libpq's .pgpass:
+//
+//	hostname:port:database:username:password
+//
+// where any of the first four fields may be "*", and colons and
+// backslashes within fields are escaped with a backslash.  Unix
+// sockets match the hostname "localhost".
+type passfile struct {
+	entries [][]string
+}
+
+func loadPassfile(path string) (*passfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	pf := &passfile{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := splitPassLine(line)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%v:%d: expected 5 fields, got %d",
+				path, n, len(fields))
+		}
+
+		pf.entries = append(pf.entries, fields)
+	}
+
+	return pf, scanner.Err()
+}
+
+// Split a line at unescaped colons, removing the escapes.
+func splitPassLine(line string) []string {
+	var fields []string
+	var field []byte
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && i+1 < len(line):
+			i++
+			field = append(field, line[i])
+		case c == ':':
+			fields = append(fields, string(field))
+			field = nil
+		default:
+			field = append(field, c)
+		}
+	}
+
+	return append(fields, string(field))
+}
+
+// The host and port of a server address, as written in a passfile.
+func passHostPort(addr string) (string, string) {
+	if strings.Contains(addr, "/") {
+		// Sockets are named like /tmp/.s.PGSQL.5432
+		ext := filepath.Ext(addr)
+		return "localhost", strings.TrimPrefix(ext, ".")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+
+	return host, port
+}
+
+// The password to log in to the server at addr with, or false if
+// there is none.  As with libpq, the first matching line wins.
+func (pf *passfile) lookup(addr, database, user string) (string, bool) {
+	if pf == nil {
+		return "", false
+	}
+
+	host, port := passHostPort(addr)
+	want := []string{host, port, database, user}
+
+	for _, e := range pf.entries {
+		matches := true
+		for i, w := range want {
+			if e[i] != "*" && e[i] != w {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return e[4], true
+		}
+	}
+
+	return "", false
+}
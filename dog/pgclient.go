@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"femebe"
+	"femebe/pgproto"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connections dog makes to servers on its own account, rather than
+// relaying the authentication of a client, log in with the passwords
+// in the passfile.
+
+// Settings for connecting to servers on dog's own account.
+type serverLogin struct {
+	passwords *passfile
+	timeouts  sessionTimeouts
+	retry     dialRetry
+}
+
+// Connect and log in to the server at addr with the given startup
+// parameters, which must include "user" and "database".  Returns once
+// the server is ready for a query; messages sent during startup, such
+// as ParameterStatus, are not passed on.
+func (sl *serverLogin) connect(addr string,
+	params map[string]string) (*ProxyPair, error) {
+	conn, _, _, err := dialServer(addr, sl.timeouts.dial, sl.retry)
+	if err != nil {
+		return nil, err
+	}
+
+	if sl.timeouts.auth > 0 {
+		conn.SetDeadline(time.Now().Add(sl.timeouts.auth))
+	}
+
+	tlsConf := tls.Config{InsecureSkipVerify: true}
+	sConn, err := femebe.NegotiateTLS(conn, "prefer", &tlsConf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := &ProxyPair{
+		MessageStream: femebe.NewServerMessageStream(
+			"Server", newBufWriteCon(sConn)),
+		Conn: sConn,
+	}
+
+	if err := sl.login(s, addr, params); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return s, nil
+}
+
+func (sl *serverLogin) login(s *ProxyPair, addr string,
+	params map[string]string) error {
+	sup := &pgproto.Startup{Params: make(map[string]string)}
+	for k, v := range params {
+		sup.Params[k] = v
+	}
+
+	var m femebe.Message
+	sup.FillMessage(&m)
+	if err := s.Send(&m); err != nil {
+		return err
+	}
+
+	if err := s.Flush(); err != nil {
+		return err
+	}
+
+	user, database := params["user"], params["database"]
+	var scram *scramClient
+
+	for {
+		if err := s.Next(&m); err != nil {
+			return err
+		}
+
+		payload, err := m.Force()
+		if err != nil {
+			return err
+		}
+
+		switch m.MsgType() {
+		case 'R':
+			if len(payload) < 4 {
+				return fmt.Errorf("malformed authentication request")
+			}
+
+			code := binary.BigEndian.Uint32(payload)
+			data := payload[4:]
+			if code == 0 {
+				// AuthenticationOk
+				continue
+			}
+
+			password, ok := sl.passwords.lookup(addr, database, user)
+			if !ok {
+				return fmt.Errorf("no password for user %q "+
+					"on %v", user, addr)
+			}
+
+			var resp []byte
+			switch code {
+			case 3:
+				resp = cString(password)
+			case 5:
+				resp = cString(md5Password(user, password, data))
+			case 10:
+				scram, resp, err = startScram(data)
+			case 11:
+				if scram == nil {
+					return fmt.Errorf("unexpected SASL challenge")
+				}
+
+				resp, err = scram.respond(password, data)
+			case 12:
+				if scram == nil {
+					return fmt.Errorf("unexpected SASL outcome")
+				}
+
+				err = scram.verify(data)
+				if err == nil {
+					continue
+				}
+			default:
+				return fmt.Errorf("unsupported authentication "+
+					"method %d", code)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			m.InitFromBytes('p', resp)
+			if err := s.Send(&m); err != nil {
+				return err
+			}
+
+			if err := s.Flush(); err != nil {
+				return err
+			}
+		case 'E':
+			return fmt.Errorf("server refused login: %v",
+				errorMessage(payload))
+		case 'Z':
+			return nil
+		}
+
+		// ParameterStatus, BackendKeyData and notices concern
+		// nobody but dog.
+	}
+}
+
+// Run a simple query on a connection made by connect, returning the
+// rows of its result as text.  NULLs read as empty strings.
+func simpleQuery(s *ProxyPair, sql string) ([][]string, error) {
+	var m femebe.Message
+	m.InitFromBytes('Q', cString(sql))
+	if err := s.Send(&m); err != nil {
+		return nil, err
+	}
+
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	var rows [][]string
+	var qerr error
+
+	for {
+		if err := s.Next(&m); err != nil {
+			return nil, err
+		}
+
+		payload, err := m.Force()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m.MsgType() {
+		case 'D':
+			row, err := dataRow(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			rows = append(rows, row)
+		case 'E':
+			qerr = fmt.Errorf("query failed: %v", errorMessage(payload))
+		case 'Z':
+			return rows, qerr
+		}
+	}
+}
+
+// The columns of a DataRow, as text.
+func dataRow(payload []byte) ([]string, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("malformed data row")
+	}
+
+	n := int(binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+
+	row := make([]string, n)
+	for i := range row {
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("malformed data row")
+		}
+
+		size := int32(binary.BigEndian.Uint32(payload))
+		payload = payload[4:]
+		if size < 0 {
+			continue
+		}
+
+		if int(size) > len(payload) {
+			return nil, fmt.Errorf("malformed data row")
+		}
+
+		row[i] = string(payload[:size])
+		payload = payload[size:]
+	}
+
+	return row, nil
+}
+
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// The client side of SCRAM-SHA-256, as of RFC 5802 and 7677, without
+// channel binding.
+type scramClient struct {
+	clientNonce string
+	clientFirst string
+	authMessage string
+	saltedPass  []byte
+}
+
+func startScram(mechanisms []byte) (*scramClient, []byte, error) {
+	found := false
+	for _, mech := range bytes.Split(mechanisms, []byte{0}) {
+		if string(mech) == "SCRAM-SHA-256" {
+			found = true
+		}
+	}
+
+	if !found {
+		return nil, nil, fmt.Errorf("unsupported SASL mechanisms %q",
+			mechanisms)
+	}
+
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	sc := &scramClient{clientNonce: base64.StdEncoding.EncodeToString(nonce)}
+
+	// The user name is taken from the startup packet instead.
+	sc.clientFirst = "n=,r=" + sc.clientNonce
+	msg := "n,," + sc.clientFirst
+
+	var resp bytes.Buffer
+	writeCString(&resp, "SCRAM-SHA-256")
+	binary.Write(&resp, binary.BigEndian, int32(len(msg)))
+	resp.WriteString(msg)
+
+	return sc, resp.Bytes(), nil
+}
+
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) > 2 && part[1] == '=' {
+			attrs[part[:1]] = part[2:]
+		}
+	}
+
+	return attrs
+}
+
+func hmacSHA256(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func (sc *scramClient) respond(password string,
+	serverFirst []byte) ([]byte, error) {
+	attrs := scramAttrs(string(serverFirst))
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, sc.clientNonce) {
+		return nil, fmt.Errorf("SCRAM server nonce does not " +
+			"extend ours")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, fmt.Errorf("bad SCRAM salt: %v", err)
+	}
+
+	iters, err := strconv.Atoi(attrs["i"])
+	if err != nil || iters < 1 {
+		return nil, fmt.Errorf("bad SCRAM iteration count %q",
+			attrs["i"])
+	}
+
+	// Hi() of RFC 5802, which is PBKDF2 producing a single block
+	u := hmacSHA256([]byte(password), append(salt, 0, 0, 0, 1))
+	sc.saltedPass = append([]byte(nil), u...)
+	for i := 1; i < iters; i++ {
+		u = hmacSHA256([]byte(password), u)
+		for j := range u {
+			sc.saltedPass[j] ^= u[j]
+		}
+	}
+
+	clientFinalBare := "c=biws,r=" + nonce
+	sc.authMessage = sc.clientFirst + "," + string(serverFirst) +
+		"," + clientFinalBare
+
+	clientKey := hmacSHA256(sc.saltedPass, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	sig := hmacSHA256(storedKey[:], []byte(sc.authMessage))
+
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ sig[i]
+	}
+
+	return []byte(clientFinalBare + ",p=" +
+		base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Check that the server, too, knows the password.
+func (sc *scramClient) verify(serverFinal []byte) error {
+	attrs := scramAttrs(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM authentication failed: %v", e)
+	}
+
+	serverKey := hmacSHA256(sc.saltedPass, []byte("Server Key"))
+	want := hmacSHA256(serverKey, []byte(sc.authMessage))
+
+	got, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(got, want) {
+		return fmt.Errorf("server failed SCRAM verification")
+	}
+
+	return nil
+}
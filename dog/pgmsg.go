@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"femebe"
+)
+
+// Helpers for composing the protocol messages dog sends on its own
+// behalf, rather than relaying them between client and server.
+
+func writeCString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.WriteByte(0)
+}
+
+func cString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// Split the null-terminated string at the start of b from the rest.
+func readCString(b []byte) (string, []byte) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return string(b), nil
+	}
+
+	return string(b[:i]), b[i+1:]
+}
+
+// The message of an ErrorResponse.
+func errorMessage(payload []byte) string {
+	for _, field := range bytes.Split(payload, []byte{0}) {
+		if len(field) > 0 && field[0] == 'M' {
+			return string(field[1:])
+		}
+	}
+
+	return "unknown error"
+}
+
+// Fill m with an ErrorResponse carrying the given severity (e.g.
+// "FATAL"), SQLSTATE code and message.
+func initErrorResponse(m *femebe.Message, severity, code, msg string) {
+	var buf bytes.Buffer
+
+	buf.WriteByte('S')
+	writeCString(&buf, severity)
+	buf.WriteByte('C')
+	writeCString(&buf, code)
+	buf.WriteByte('M')
+	writeCString(&buf, msg)
+	buf.WriteByte(0)
+
+	m.InitFromBytes('E', buf.Bytes())
+}
+
+// Report an error to the client, as Postgres would.
+func sendError(c *femebe.MessageStream, severity, code, msg string) error {
+	var m femebe.Message
+	initErrorResponse(&m, severity, code, msg)
+
+	if err := c.Send(&m); err != nil {
+		return err
+	}
+
+	return c.Flush()
+}
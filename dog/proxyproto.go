@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Support for the PROXY protocol, as used by load balancers such as
+// HAProxy to pass on the addresses of the clients behind them.  See
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+// The signature beginning every version 2 header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest permissible version 1 header, including the CRLF.
+const proxyV1MaxLen = 107
+
+// A connection accepted from a load balancer, reporting the addresses
+// of the client behind it.  Whatever was read past the header is kept
+// for later reads.
+type proxiedConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	local  net.Addr
+	remote net.Addr
+}
+
+func (pc *proxiedConn) Read(b []byte) (int, error) {
+	return pc.r.Read(b)
+}
+
+func (pc *proxiedConn) LocalAddr() net.Addr {
+	return pc.local
+}
+
+func (pc *proxiedConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// Read the PROXY header, of either version, that must begin the
+// connection, returning a connection reporting the addresses it
+// gives.  Headers that carry no addresses, e.g. health checks by the
+// load balancer itself, leave the connection's own addresses in
+// place.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	pc := &proxiedConn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		local:  conn.LocalAddr(),
+		remote: conn.RemoteAddr(),
+	}
+
+	sig, err := pc.r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, fmt.Errorf("could not read PROXY header: %v", err)
+	}
+
+	if bytes.Equal(sig, proxyV2Sig) {
+		err = pc.readV2()
+	} else if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		err = pc.readV1()
+	} else {
+		err = fmt.Errorf("connection does not begin with " +
+			"a PROXY header")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+// Parse a header such as "PROXY TCP4 192.0.2.1 192.0.2.2 5678 5432".
+func (pc *proxiedConn) readV1() error {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return fmt.Errorf("PROXY header is too long")
+		}
+
+		c, err := pc.r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("could not read PROXY header: %v",
+				err)
+		}
+
+		line = append(line, c)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("malformed PROXY header %q", line)
+	}
+
+	src, err := proxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+
+	dst, err := proxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+
+	pc.remote, pc.local = src, dst
+	return nil
+}
+
+func proxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("bad address %q in PROXY header", ip)
+	}
+
+	var err error
+	addr.Port, err = strconv.Atoi(port)
+	if err != nil || addr.Port < 0 || addr.Port > 65535 {
+		return nil, fmt.Errorf("bad port %q in PROXY header", port)
+	}
+
+	return addr, nil
+}
+
+// Parse the binary header, which follows the signature with the
+// version and command, the address family and protocol, and the
+// length of the addresses that follow.
+func (pc *proxiedConn) readV2() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(pc.r, hdr[:]); err != nil {
+		return fmt.Errorf("could not read PROXY header: %v", err)
+	}
+
+	verCmd, famProto := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(pc.r, body); err != nil {
+		return fmt.Errorf("could not read PROXY header: %v", err)
+	}
+
+	if verCmd>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d",
+			verCmd>>4)
+	}
+
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL: sent by the load balancer on its own behalf
+		return nil
+	case 1:
+		// PROXY
+	default:
+		return fmt.Errorf("unsupported PROXY command %d", verCmd&0xf)
+	}
+
+	var ipLen int
+	switch famProto {
+	case 0x11:
+		// TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21:
+		// TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// Other families and protocols carry nothing we can
+		// use, and the header is to be accepted regardless.
+		return nil
+	}
+
+	if len(body) < 2*ipLen+4 {
+		return fmt.Errorf("PROXY header is too short for its addresses")
+	}
+
+	pc.remote = &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+
+	pc.local = &net.TCPAddr{
+		IP:   net.IP(body[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+
+	return nil
+}
+
+// Write a PROXY header of the given version ("v1" or "v2") announcing
+// a connection from src to dst.  Addresses other than TCP ones, such
+// as unix sockets, are announced as unknown.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcTCP, _ := src.(*net.TCPAddr)
+	dstTCP, _ := dst.(*net.TCPAddr)
+
+	var srcIP, dstIP net.IP
+	if srcTCP != nil && dstTCP != nil {
+		srcIP, dstIP = srcTCP.IP.To4(), dstTCP.IP.To4()
+		if srcIP == nil || dstIP == nil {
+			srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+		}
+	}
+
+	switch version {
+	case "v1":
+		return writeProxyV1(w, srcIP, dstIP, srcTCP, dstTCP)
+	case "v2":
+		return writeProxyV2(w, srcIP, dstIP, srcTCP, dstTCP)
+	}
+
+	return fmt.Errorf("unknown PROXY protocol version %q", version)
+}
+
+func writeProxyV1(w io.Writer, srcIP, dstIP net.IP,
+	src, dst *net.TCPAddr) error {
+	var err error
+	switch {
+	case srcIP == nil:
+		_, err = io.WriteString(w, "PROXY UNKNOWN\r\n")
+	case len(srcIP) == net.IPv4len:
+		_, err = fmt.Fprintf(w, "PROXY TCP4 %v %v %d %d\r\n",
+			srcIP, dstIP, src.Port, dst.Port)
+	default:
+		_, err = fmt.Fprintf(w, "PROXY TCP6 %v %v %d %d\r\n",
+			srcIP, dstIP, src.Port, dst.Port)
+	}
+
+	return err
+}
+
+func writeProxyV2(w io.Writer, srcIP, dstIP net.IP,
+	src, dst *net.TCPAddr) error {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Sig)
+
+	switch {
+	case srcIP == nil:
+		// LOCAL, with no addresses
+		buf.Write([]byte{0x20, 0x00, 0, 0})
+	default:
+		famProto := byte(0x11)
+		if len(srcIP) == net.IPv6len {
+			famProto = 0x21
+		}
+
+		buf.Write([]byte{0x21, famProto})
+		binary.Write(&buf, binary.BigEndian,
+			uint16(2*len(srcIP)+4))
+		buf.Write(srcIP)
+		buf.Write(dstIP)
+		binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+		binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"../dogconf"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Routes are also offered as HTTP resources, on the address given
+// with -admin-http, for tooling that cannot speak dogconf:
+//
+//	GET    /routes        every route
+//	GET    /routes/ID     one route
+//	PUT    /routes/ID     create a route
+//	PATCH  /routes/ID     patch a route, given If-Match: OCN
+//	DELETE /routes/ID     delete a route, given If-Match: OCN
+//
+// Attributes are sent as a JSON object of strings.  Routes are
+// returned as JSON objects of their kind, id, ocn, attrs and status,
+// with their OCN as the ETag.
+//
+// Each HTTP request is rendered as the dogconf request it stands for,
+// which is then served just as though it came over the administrative
+// address: analyzed, authorized, executed and audited the same way.
+// Errors are returned as a JSON object of their code and message,
+// along with the dogconf request, to make sense of the positions in
+// the message.
+//
+// Clients are authenticated as on the administrative address, by
+// bearer token in the Authorization header, TLS client certificate,
+// or the peer credentials of a unix socket.
+
+// The HTTP status for each way a request may fail.
+var restErrStatuses = map[string]int{
+	dogconf.ErrCodeSyntax:   http.StatusBadRequest,
+	dogconf.ErrCodeSemantic: http.StatusBadRequest,
+	dogconf.ErrCodeConflict: http.StatusPreconditionFailed,
+	dogconf.ErrCodeNotFound: http.StatusNotFound,
+	dogconf.ErrCodeExists:   http.StatusConflict,
+	dogconf.ErrCodeInvalid:  http.StatusUnprocessableEntity,
+	dogconf.ErrCodeDenied:   http.StatusForbidden,
+}
+
+// Attribute bodies larger than this are refused.
+const restMaxBody = 1 << 20
+
+// A record as rendered in JSON.
+type restRecord struct {
+	Kind   dogconf.Kind      `json:"kind"`
+	Id     string            `json:"id"`
+	Ocn    uint64            `json:"ocn"`
+	Attrs  map[string]string `json:"attrs"`
+	Status map[string]string `json:"status,omitempty"`
+}
+
+func newRestRecord(rec *dogconf.Record) *restRecord {
+	return &restRecord{
+		Kind:   rec.Kind,
+		Id:     rec.Id,
+		Ocn:    rec.Ocn,
+		Attrs:  rec.Attrs,
+		Status: rec.Status,
+	}
+}
+
+type restError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Request string `json:"request,omitempty"`
+}
+
+// The key under which connections are kept in the contexts of their
+// requests, to authenticate clients by.
+type restConnKey struct{}
+
+type restServer struct {
+	ex *executor
+}
+
+// Serve the HTTP interface on the listener until it is closed.
+func serveRest(ln net.Listener, ex *executor) {
+	if ex.p.adminTLS != nil {
+		ln = tls.NewListener(ln, ex.p.adminTLS)
+	}
+
+	mux := http.NewServeMux()
+	rs := &restServer{ex: ex}
+	mux.HandleFunc("/routes", rs.serveRoutes)
+	mux.HandleFunc("/routes/", rs.serveRoute)
+
+	srv := &http.Server{
+		Handler: mux,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, restConnKey{}, c)
+		},
+	}
+
+	err := srv.Serve(ln)
+	log.Printf("Administrative HTTP listener exits: %v\n", err)
+}
+
+func writeRestJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Could not reply to administrative HTTP "+
+			"client: %v", err)
+	}
+}
+
+func writeRestError(w http.ResponseWriter, err error, text string) {
+	code := adminErrorCode(err)
+	status, ok := restErrStatuses[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	writeRestJSON(w, status,
+		&restError{Code: code, Message: err.Error(), Request: text})
+}
+
+// Errors in HTTP requests that do not amount to dogconf requests.
+func restErrf(format string, args ...interface{}) error {
+	return &adminError{fmt.Errorf(format, args...),
+		dogconf.ErrCodeSyntax}
+}
+
+// Identify the client making a request.
+func (rs *restServer) client(r *http.Request) (*adminClient, error) {
+	cl := &adminClient{addr: r.RemoteAddr}
+
+	conn, _ := r.Context().Value(restConnKey{}).(net.Conn)
+	tc, _ := conn.(*tls.Conn)
+	if tc != nil {
+		conn = tc.NetConn()
+	}
+
+	if conn != nil {
+		if cl.addr == "" || cl.addr == "@" {
+			cl.addr = adminPeer(conn)
+		}
+
+		rs.ex.p.adminAuth.identify(cl, conn, tc)
+	}
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		fields := strings.Fields(auth)
+		if len(fields) != 2 || !strings.EqualFold(fields[0], "bearer") {
+			return cl, &adminError{fmt.Errorf("expected " +
+				"Authorization: Bearer TOKEN"),
+				dogconf.ErrCodeDenied}
+		}
+
+		err := rs.ex.p.adminAuth.identifyToken(cl, fields[1])
+		if err != nil {
+			return cl, err
+		}
+	}
+
+	return cl, nil
+}
+
+// Serve the dogconf request an HTTP request stands for, replying with
+// the records it results in, as a list or, if one is wanted, the
+// first.
+func (rs *restServer) run(w http.ResponseWriter, r *http.Request,
+	text string, status int, one bool) {
+	cl, err := rs.client(r)
+	if err != nil {
+		rs.ex.p.audit(cl, "", nil, 0, err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeRestJSON(w, http.StatusUnauthorized,
+			&restError{Code: adminErrorCode(err),
+				Message: err.Error()})
+		return
+	}
+
+	p := dogconf.NewParser("", strings.NewReader(text))
+	req, err := p.Next()
+	if err != nil {
+		// The request was rendered badly.
+		err = &adminError{err, dogconf.ErrCodeSyntax}
+		rs.ex.p.audit(cl, text, nil, 0, err)
+		writeRestError(w, err, text)
+		return
+	}
+
+	d, err := dogconf.Analyze(req)
+	recs, err := rs.ex.serve(cl, text, d, err)
+	if err != nil {
+		writeRestError(w, err, text)
+		return
+	}
+
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+
+	rrecs := make([]*restRecord, len(recs))
+	for i, rec := range recs {
+		rrecs[i] = newRestRecord(rec)
+	}
+
+	if !one {
+		writeRestJSON(w, status, rrecs)
+		return
+	}
+
+	if len(rrecs) == 0 {
+		// Every action on one object should report it, so the
+		// fault is dog's, not the client's.
+		log.Printf("No record in reply to administrative HTTP "+
+			"request %v\n", text)
+		writeRestJSON(w, http.StatusInternalServerError, &restError{
+			Code:    "internal",
+			Message: "no record in reply",
+			Request: text,
+		})
+		return
+	}
+
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatUint(
+		rrecs[0].Ocn, 10)))
+	writeRestJSON(w, status, rrecs[0])
+}
+
+func (rs *restServer) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		restNotAllowed(w, r, "GET")
+		return
+	}
+
+	rs.run(w, r, "[route all [get]]", http.StatusOK, false)
+}
+
+func (rs *restServer) serveRoute(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/routes/")
+	if id == "" {
+		writeRestJSON(w, http.StatusNotFound, &restError{
+			Code:    dogconf.ErrCodeNotFound,
+			Message: "expected /routes/ID"})
+		return
+	}
+
+	target := "[route " + dogconf.QuoteStr(id)
+	switch r.Method {
+	case "GET":
+		rs.run(w, r, target+" [get]]", http.StatusOK, true)
+	case "PUT":
+		attrs, err := restAttrs(r)
+		if err != nil {
+			writeRestError(w, err, "")
+			return
+		}
+
+		rs.run(w, r, target+" [create "+attrs+"]]",
+			http.StatusCreated, true)
+	case "PATCH":
+		attrs, err := restAttrs(r)
+		if err == nil {
+			target, err = restTarget(r, target)
+		}
+
+		if err != nil {
+			writeRestError(w, err, "")
+			return
+		}
+
+		rs.run(w, r, target+" [patch "+attrs+"]]",
+			http.StatusOK, true)
+	case "DELETE":
+		target, err := restTarget(r, target)
+		if err != nil {
+			writeRestError(w, err, "")
+			return
+		}
+
+		rs.run(w, r, target+" [delete]]", http.StatusNoContent, false)
+	default:
+		restNotAllowed(w, r, "GET, PUT, PATCH, DELETE")
+	}
+}
+
+func restNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	writeRestJSON(w, http.StatusMethodNotAllowed, &restError{
+		Code: dogconf.ErrCodeSyntax,
+		Message: fmt.Sprintf("%v is not supported on %v",
+			r.Method, r.URL.Path)})
+}
+
+// The target of a request, at the OCN given by If-Match, as needed to
+// change the route.
+func restTarget(r *http.Request, target string) (string, error) {
+	match := r.Header.Get("If-Match")
+	if match == "" {
+		return "", restErrf("%v needs If-Match: OCN", r.Method)
+	}
+
+	// Taken either bare or quoted, as an ETag.
+	if unquoted, err := strconv.Unquote(match); err == nil {
+		match = unquoted
+	}
+
+	ocn, err := strconv.ParseUint(match, 10, 64)
+	if err != nil {
+		return "", restErrf("If-Match should be an OCN, got %q",
+			r.Header.Get("If-Match"))
+	}
+
+	return target + " @ " + strconv.FormatUint(ocn, 10), nil
+}
+
+// The attributes in the body of a request, as a dogconf property
+// list.
+func restAttrs(r *http.Request) (string, error) {
+	var attrs map[string]string
+
+	dec := json.NewDecoder(io.LimitReader(r.Body, restMaxBody))
+	if err := dec.Decode(&attrs); err != nil {
+		return "", restErrf("expected a JSON object of "+
+			"attributes: %v", err)
+	}
+
+	for name := range attrs {
+		// Anything else would be taken as dogconf.
+		if !dogconf.IsIdent(name) {
+			return "", restErrf("bad attribute name %q", name)
+		}
+	}
+
+	return dogconf.FormatProps(attrs), nil
+}
@@ -1,39 +1,361 @@
 package main
 
 import (
+	"../dogconf"
 	"femebe/pgproto"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// A route, as installed in the routingTable.  Entries are never
+// modified once posted: changes are made by posting a replacement, so
+// sessions may hold onto the entry they were routed with.
 type routingEntry struct {
+	id        string
+	ocn       uint64
 	dbnameIn  string
 	addr      string
 	dbnameOut string
+
+	// Locked routes refuse new sessions
+	lock bool
+
+	// Limit on concurrent sessions, zero for none
+	maxConnections int
+
+	// Overrides of the proxy-wide session timeouts, by attribute
+	// name (e.g. "idleTimeout")
+	timeouts map[string]time.Duration
+
+	// The version of PROXY protocol header to send servers, or
+	// "none"
+	proxyProtocol string
+
+	// Whether to send read-only work to replicas, see split.go
+	splitReads    bool
+	replicas      []string
+	readOnlyUsers []string
+
+	// Replicas further behind than this are not sent reads; zero
+	// for no limit
+	maxLag time.Duration
+
+	// Hosts among which 'addr' is kept pointing at one in the
+	// role, see discover.go
+	hosts []string
+	role  string
+
+	// Where to copy sessions to, if anywhere, see mirror.go
+	mirror            string
+	mirrorSelectsOnly bool
+
+	// Where to send a percentage of sessions instead of 'addr',
+	// if anywhere, see canary.go
+	canary        string
+	canaryPercent float64
+	canarySticky  string
+}
+
+// Build a routingEntry from dogconf attributes, which are presumed to
+// have passed semantic analysis.
+func newRoutingEntry(id string, ocn uint64,
+	attrs map[string]string) (*routingEntry, error) {
+	re := &routingEntry{
+		id:        id,
+		ocn:       ocn,
+		dbnameIn:  attrs["dbnameIn"],
+		addr:      attrs["addr"],
+		dbnameOut: attrs["dbnameRewritten"],
+		lock:      attrs["lock"] == "t",
+
+		proxyProtocol: attrs["proxyProtocol"],
+		splitReads:    attrs["splitReads"] == "t",
+		replicas:      splitList(attrs["replicas"]),
+		readOnlyUsers: splitList(attrs["readOnlyUsers"]),
+		hosts:         splitList(attrs["hosts"]),
+		role:          attrs["role"],
+
+		mirror:            attrs["mirror"],
+		mirrorSelectsOnly: attrs["mirrorSelectsOnly"] == "t",
+
+		canary:       attrs["canary"],
+		canarySticky: attrs["canarySticky"],
+	}
+
+	if n, ok := attrs["maxConnections"]; ok {
+		var err error
+		re.maxConnections, err = strconv.Atoi(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if val, ok := attrs["canaryPercent"]; ok {
+		var err error
+		re.canaryPercent, err = strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if val, ok := attrs["maxLag"]; ok {
+		var err error
+		re.maxLag, err = time.ParseDuration(val)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	re.timeouts = make(map[string]time.Duration)
+	for name := range timeoutAttrs {
+		if val, ok := attrs[name]; ok {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+
+			re.timeouts[name] = d
+		}
+	}
+
+	if re.addr == "" {
+		return nil, fmt.Errorf("route %q has no 'addr'", id)
+	}
+
+	// By default, route the database sharing the route's name,
+	// without rewriting it.
+	if re.dbnameIn == "" {
+		re.dbnameIn = id
+	}
+
+	if re.dbnameOut == "" {
+		re.dbnameOut = re.dbnameIn
+	}
+
+	if re.proxyProtocol == "" {
+		re.proxyProtocol = "none"
+	}
+
+	if re.splitReads && len(re.replicas) == 0 {
+		return nil, fmt.Errorf("route %q splits reads, "+
+			"but has no 'replicas'", id)
+	}
+
+	if re.canary == "" && (attrs["canaryPercent"] != "" ||
+		attrs["canarySticky"] != "") {
+		return nil, fmt.Errorf("route %q has canary settings, "+
+			"but no 'canary'", id)
+	}
+
+	if re.canarySticky == "" {
+		re.canarySticky = "none"
+	}
+
+	if re.role != "" && len(re.hosts) == 0 {
+		return nil, fmt.Errorf("route %q has a 'role', "+
+			"but no 'hosts'", id)
+	}
+
+	if len(re.hosts) > 0 && re.role == "" {
+		re.role = "primary"
+	}
+
+	return re, nil
+}
+
+// Split a comma-separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func (re *routingEntry) record() *dogconf.Record {
+	lock := "f"
+	if re.lock {
+		lock = "t"
+	}
+
+	rec := &dogconf.Record{
+		Kind: dogconf.RouteKind,
+		Id:   re.id,
+		Ocn:  re.ocn,
+		Attrs: map[string]string{
+			"addr":            re.addr,
+			"dbnameIn":        re.dbnameIn,
+			"dbnameRewritten": re.dbnameOut,
+			"lock":            lock,
+			"maxConnections":  strconv.Itoa(re.maxConnections),
+			"proxyProtocol":   re.proxyProtocol,
+		},
+	}
+
+	if re.splitReads {
+		rec.Attrs["splitReads"] = "t"
+	} else {
+		rec.Attrs["splitReads"] = "f"
+	}
+
+	if len(re.replicas) > 0 {
+		rec.Attrs["replicas"] = strings.Join(re.replicas, ",")
+	}
+
+	if len(re.readOnlyUsers) > 0 {
+		rec.Attrs["readOnlyUsers"] = strings.Join(re.readOnlyUsers, ",")
+	}
+
+	if len(re.hosts) > 0 {
+		rec.Attrs["hosts"] = strings.Join(re.hosts, ",")
+		rec.Attrs["role"] = re.role
+	}
+
+	if re.mirror != "" {
+		rec.Attrs["mirror"] = re.mirror
+		if re.mirrorSelectsOnly {
+			rec.Attrs["mirrorSelectsOnly"] = "t"
+		} else {
+			rec.Attrs["mirrorSelectsOnly"] = "f"
+		}
+	}
+
+	if re.canary != "" {
+		rec.Attrs["canary"] = re.canary
+		rec.Attrs["canaryPercent"] = strconv.FormatFloat(
+			re.canaryPercent, 'f', -1, 64)
+		rec.Attrs["canarySticky"] = re.canarySticky
+	}
+
+	if re.maxLag > 0 {
+		rec.Attrs["maxLag"] = re.maxLag.String()
+	}
+
+	// Timeouts are only reported where overridden, as the absence
+	// of an override is not the same as any particular value.
+	for name, d := range re.timeouts {
+		rec.Attrs[name] = d.String()
+	}
+
+	return rec
 }
 
 type routingTable struct {
+	// Routes by identifier
 	tab map[string]*routingEntry
+
+	// The same routes, by the database name clients connect to
+	byDbname map[string]*routingEntry
+
 	sync.RWMutex
 }
 
 func newRoutingTable() *routingTable {
 	return &routingTable{
-		tab: make(map[string]*routingEntry),
+		tab:      make(map[string]*routingEntry),
+		byDbname: make(map[string]*routingEntry),
 	}
 }
 
-func (rt *routingTable) post(route *routingEntry) {
+// A copy of the table, to change without affecting routing.  Routes
+// themselves are never changed in place, so are shared.
+func (rt *routingTable) clone() *routingTable {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	c := newRoutingTable()
+	for id, re := range rt.tab {
+		c.tab[id] = re
+	}
+
+	for dbname, re := range rt.byDbname {
+		c.byDbname[dbname] = re
+	}
+
+	return c
+}
+
+// Take on the routes of another table, all at once.
+func (rt *routingTable) replace(other *routingTable) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	other.RLock()
+	defer other.RUnlock()
+
+	rt.tab = other.tab
+	rt.byDbname = other.byDbname
+}
+
+// Install a route, replacing any previous version of it.  Fails if
+// another route already claims the same incoming database name.
+func (rt *routingTable) post(route *routingEntry) error {
 	rt.Lock()
 	defer rt.Unlock()
 
-	rt.tab[route.dbnameIn] = route
+	if other := rt.byDbname[route.dbnameIn]; other != nil &&
+		other.id != route.id {
+		return fmt.Errorf("database %q is already routed by %q",
+			route.dbnameIn, other.id)
+	}
+
+	if old := rt.tab[route.id]; old != nil {
+		delete(rt.byDbname, old.dbnameIn)
+	}
+
+	rt.tab[route.id] = route
+	rt.byDbname[route.dbnameIn] = route
+
+	return nil
+}
+
+// The connection limit of the route with the given id, or zero if
+// there is none.
+func (rt *routingTable) limit(id string) int {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	if re := rt.tab[id]; re != nil {
+		return re.maxConnections
+	}
+
+	return 0
+}
+
+// The current version of the route with the given id, or nil if
+// there is none.
+func (rt *routingTable) entry(id string) *routingEntry {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	return rt.tab[id]
+}
+
+// Every route, in no particular order.
+func (rt *routingTable) all() []*routingEntry {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	routes := make([]*routingEntry, 0, len(rt.tab))
+	for _, re := range rt.tab {
+		routes = append(routes, re)
+	}
+
+	return routes
 }
 
 func (rt *routingTable) match(dbnameIn string) *routingEntry {
 	rt.RLock()
 	defer rt.RUnlock()
 
-	return rt.tab[dbnameIn]
+	return rt.byDbname[dbnameIn]
 }
 
 func (rt *routingTable) rewrite(s *pgproto.Startup) (route *routingEntry) {
@@ -44,3 +366,55 @@ func (rt *routingTable) rewrite(s *pgproto.Startup) (route *routingEntry) {
 
 	return route
 }
+
+// Implementation of objectTable, for the executor.
+
+func (rt *routingTable) lookup(id string) (*dogconf.Record, bool) {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	re, ok := rt.tab[id]
+	if !ok {
+		return nil, false
+	}
+
+	return re.record(), true
+}
+
+func (rt *routingTable) list() []*dogconf.Record {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	ids := make([]string, 0, len(rt.tab))
+	for id := range rt.tab {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	recs := make([]*dogconf.Record, len(ids))
+	for i, id := range ids {
+		recs[i] = rt.tab[id].record()
+	}
+
+	return recs
+}
+
+func (rt *routingTable) store(id string, ocn uint64,
+	attrs map[string]string) error {
+	re, err := newRoutingEntry(id, ocn, attrs)
+	if err != nil {
+		return err
+	}
+
+	return rt.post(re)
+}
+
+func (rt *routingTable) remove(id string) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	if old := rt.tab[id]; old != nil {
+		delete(rt.byDbname, old.dbnameIn)
+		delete(rt.tab, id)
+	}
+}
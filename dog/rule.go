@@ -0,0 +1,298 @@
+package main
+
+import (
+	"../dogconf"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An access rule, in the spirit of a line of pg_hba.conf: clients
+// are checked against the rules in order, and the first rule that
+// matches decides whether the client is allowed to connect.
+type accessRule struct {
+	id    string
+	ocn   uint64
+	order int
+
+	// One of "local" (unix sockets), "host" (tcp), "hostssl" or
+	// "hostnossl".
+	connType string
+
+	// Comma-separated lists of names, or "all"
+	database string
+	user     string
+	listener string
+
+	// A CIDR address, or "all", and its parsed form for
+	// matching.  The network is nil for "all".
+	address string
+	network *net.IPNet
+
+	allow bool
+}
+
+// Build an accessRule from dogconf attributes, which are presumed to
+// have passed semantic analysis.
+func newAccessRule(id string, ocn uint64,
+	attrs map[string]string) (*accessRule, error) {
+	r := &accessRule{
+		id:       id,
+		ocn:      ocn,
+		connType: attrs["type"],
+		database: attrs["database"],
+		user:     attrs["user"],
+		listener: attrs["listener"],
+		address:  attrs["address"],
+		allow:    attrs["method"] == "allow",
+	}
+
+	if o, ok := attrs["order"]; ok {
+		var err error
+		r.order, err = strconv.Atoi(o)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.database == "" {
+		r.database = "all"
+	}
+
+	if r.user == "" {
+		r.user = "all"
+	}
+
+	if r.listener == "" {
+		r.listener = "all"
+	}
+
+	if r.address == "" {
+		r.address = "all"
+	}
+
+	if r.address != "all" {
+		if r.connType == "local" {
+			return nil, fmt.Errorf("rule %q of type 'local' "+
+				"cannot match an address", id)
+		}
+
+		var err error
+		_, r.network, err = net.ParseCIDR(r.address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func (r *accessRule) record() *dogconf.Record {
+	method := "reject"
+	if r.allow {
+		method = "allow"
+	}
+
+	return &dogconf.Record{
+		Kind: dogconf.RuleKind,
+		Id:   r.id,
+		Ocn:  r.ocn,
+		Attrs: map[string]string{
+			"order":    strconv.Itoa(r.order),
+			"type":     r.connType,
+			"database": r.database,
+			"user":     r.user,
+			"listener": r.listener,
+			"address":  r.address,
+			"method":   method,
+		},
+	}
+}
+
+// Describes an incoming client, for the purpose of checking it
+// against the access rules.
+type clientInfo struct {
+	addr     net.Addr
+	tls      bool
+	database string
+	user     string
+
+	// The listener the client connected to
+	listener string
+}
+
+// The IP address of the client, or nil if it has none, as for unix
+// socket clients.
+func (ci *clientInfo) ip() net.IP {
+	if tcpAddr, ok := ci.addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+
+	return nil
+}
+
+func (r *accessRule) matches(ci *clientInfo) bool {
+	_, isUnix := ci.addr.(*net.UnixAddr)
+
+	switch r.connType {
+	case "local":
+		if !isUnix {
+			return false
+		}
+	case "host":
+		if isUnix {
+			return false
+		}
+	case "hostssl":
+		if isUnix || !ci.tls {
+			return false
+		}
+	case "hostnossl":
+		if isUnix || ci.tls {
+			return false
+		}
+	}
+
+	if r.network != nil {
+		ip := ci.ip()
+		if ip == nil || !r.network.Contains(ip) {
+			return false
+		}
+	}
+
+	return matchList(r.database, ci.database) &&
+		matchList(r.user, ci.user) &&
+		matchList(r.listener, ci.listener)
+}
+
+// Check a name against a comma-separated list of names that may
+// include the wildcard "all".
+func matchList(list string, name string) bool {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "all" || item == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ruleTable struct {
+	// Sorted by order, then id: the order of evaluation
+	rules []*accessRule
+
+	sync.RWMutex
+}
+
+func newRuleTable() *ruleTable {
+	return &ruleTable{}
+}
+
+// Decide whether a client may connect, returning the rule that made
+// the decision.  When there are no rules at all, every client is
+// admitted without a deciding rule, as before access rules existed;
+// otherwise, a client matching no rule is rejected.
+func (t *ruleTable) admit(ci *clientInfo) (bool, *accessRule) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if len(t.rules) == 0 {
+		return true, nil
+	}
+
+	for _, r := range t.rules {
+		if r.matches(ci) {
+			return r.allow, r
+		}
+	}
+
+	return false, nil
+}
+
+// Position of the rule with the given id, or -1.  The caller must
+// hold the lock.
+func (t *ruleTable) find(id string) int {
+	for i, r := range t.rules {
+		if r.id == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Implementation of objectTable, for the executor.
+
+func (t *ruleTable) lookup(id string) (*dogconf.Record, bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	i := t.find(id)
+	if i < 0 {
+		return nil, false
+	}
+
+	return t.rules[i].record(), true
+}
+
+// Rules are listed in order of evaluation, rather than by id.
+func (t *ruleTable) list() []*dogconf.Record {
+	t.RLock()
+	defer t.RUnlock()
+
+	recs := make([]*dogconf.Record, len(t.rules))
+	for i, r := range t.rules {
+		recs[i] = r.record()
+	}
+
+	return recs
+}
+
+func (t *ruleTable) store(id string, ocn uint64,
+	attrs map[string]string) error {
+	r, err := newAccessRule(id, ocn, attrs)
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if i := t.find(id); i >= 0 {
+		t.rules[i] = r
+	} else {
+		t.rules = append(t.rules, r)
+	}
+
+	sort.Sort(byEvaluation(t.rules))
+
+	return nil
+}
+
+func (t *ruleTable) remove(id string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if i := t.find(id); i >= 0 {
+		t.rules = append(t.rules[:i], t.rules[i+1:]...)
+	}
+}
+
+// Sorts rules by the order in which they are evaluated.
+type byEvaluation []*accessRule
+
+func (rs byEvaluation) Len() int { return len(rs) }
+
+func (rs byEvaluation) Less(i, j int) bool {
+	if rs[i].order != rs[j].order {
+		return rs[i].order < rs[j].order
+	}
+
+	return rs[i].id < rs[j].id
+}
+
+func (rs byEvaluation) Swap(i, j int) { rs[i], rs[j] = rs[j], rs[i] }
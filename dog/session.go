@@ -0,0 +1,405 @@
+package main
+
+import (
+	"../dogconf"
+	"femebe"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The sessions running in this process.
+type sessionTable struct {
+	sync.Mutex
+	next uint64
+	tab  map[uint64]*session
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{tab: make(map[uint64]*session)}
+}
+
+// Register a session, assigning it an id.
+func (st *sessionTable) add(s *session) {
+	st.Lock()
+	defer st.Unlock()
+
+	st.next++
+	s.id = st.next
+	st.tab[s.id] = s
+}
+
+func (st *sessionTable) remove(s *session) {
+	st.Lock()
+	defer st.Unlock()
+
+	delete(st.tab, s.id)
+}
+
+// Every running session, in no particular order.
+func (st *sessionTable) all() []*session {
+	st.Lock()
+	defer st.Unlock()
+
+	sessions := make([]*session, 0, len(st.tab))
+	for _, s := range st.tab {
+		sessions = append(sessions, s)
+	}
+
+	return sessions
+}
+
+func (st *sessionTable) get(id uint64) (*session, bool) {
+	st.Lock()
+	defer st.Unlock()
+
+	s, ok := st.tab[id]
+	return s, ok
+}
+
+// The running sessions of a route, in order of id.
+func (st *sessionTable) onRoute(route string) []*session {
+	var sessions []*session
+	for _, s := range st.all() {
+		if s.route == route {
+			sessions = append(sessions, s)
+		}
+	}
+
+	sort.Sort(byId(sessions))
+	return sessions
+}
+
+func (st *sessionTable) count() int {
+	st.Lock()
+	defer st.Unlock()
+
+	return len(st.tab)
+}
+
+// An idle session, as handed to the process dog is being upgraded to.
+type handoff struct {
+	Route      string    `json:"route"`
+	Backend    string    `json:"backend"`
+	Listener   string    `json:"listener"`
+	ClientAddr string    `json:"clientAddr"`
+	User       string    `json:"user"`
+	Database   string    `json:"database"`
+	Start      time.Time `json:"start"`
+
+	// Duplicates of the client and server connections
+	client *os.File
+	server *os.File
+}
+
+// Connections that can be duplicated, for passing to another process.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Find the socket underneath a client or server connection, if it can
+// be handed to another process as is.  Connections with state of our
+// own, such as TLS, cannot be.
+func rawConn(c net.Conn) (filer, bool) {
+	for {
+		switch cc := c.(type) {
+		case *proxiedConn:
+			if cc.r.Buffered() > 0 {
+				return nil, false
+			}
+
+			c = cc.Conn
+		case *replayConn:
+			c = cc.Conn
+		case filer:
+			return cc, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Sorts sessions by id, and so by when they started.
+type byId []*session
+
+func (s byId) Len() int           { return len(s) }
+func (s byId) Less(i, j int) bool { return s[i].id < s[j].id }
+func (s byId) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// What a session is doing, for reporting.
+func (s *session) describe() map[string]string {
+	s.act.Lock()
+	defer s.act.Unlock()
+
+	var state string
+	switch {
+	case s.act.txnStatus == 0:
+		state = "starting"
+	case s.act.idleSince.IsZero():
+		state = "active"
+	case s.act.txnStatus == 'T':
+		state = "idle in transaction"
+	case s.act.txnStatus == 'E':
+		state = "idle in failed transaction"
+	default:
+		state = "idle"
+	}
+
+	last := s.act.start
+	if !s.act.last.IsZero() {
+		last = s.act.last
+	}
+
+	count := func(n int64) string {
+		return strconv.FormatInt(n, 10)
+	}
+
+	return map[string]string{
+		"id":                 strconv.FormatUint(s.id, 10),
+		"route":              s.route,
+		"backend":            s.backend,
+		"listener":           s.listener,
+		"clientAddr":         s.clientAddr,
+		"user":               s.user,
+		"database":           s.database,
+		"start":              s.act.start.Format(time.RFC3339),
+		"lastActivity":       last.Format(time.RFC3339),
+		"state":              state,
+		"messagesFromClient": count(s.act.clientMessages),
+		"bytesFromClient":    count(s.act.clientBytes),
+		"messagesFromServer": count(s.act.serverMessages),
+		"bytesFromServer":    count(s.act.serverBytes),
+	}
+}
+
+// The session as reported in dogconf replies.  Sessions cannot be
+// configured, so everything about them is status.
+func (s *session) record() *dogconf.Record {
+	status := s.describe()
+	delete(status, "id")
+
+	return &dogconf.Record{
+		Kind:   dogconf.SessionKind,
+		Id:     strconv.FormatUint(s.id, 10),
+		Attrs:  map[string]string{},
+		Status: status,
+	}
+}
+
+// End the session at an administrator's request, telling the client
+// why as Postgres does when a backend is terminated.
+func (s *session) terminate() {
+	log.Printf("Terminating session %d on route %q\n", s.id, s.route)
+
+	s.client.sendLock.Lock()
+	sendError(s.client.MessageStream, "FATAL", "57P01",
+		"terminating connection: the proxy administrator "+
+			"ended the session")
+	s.client.sendLock.Unlock()
+
+	// The movers exit on their own once the connections are
+	// closed.
+	s.client.Close()
+	s.server.Close()
+}
+
+func (s *session) detaching() bool {
+	s.detachLock.Lock()
+	defer s.detachLock.Unlock()
+
+	return s.detachRequested
+}
+
+// Stop relaying the session so that it may be handed to another
+// process, if it is idle between transactions.  Returns nil if it
+// cannot be handed over, in which case it either carries on or, if
+// it stopped part way, ends.
+//
+// The movers are stopped by expiring the deadlines of both
+// connections, which is safe only while neither side is sending
+// anything: a message arriving at that very moment ends the session.
+func (s *session) detach() *handoff {
+	// Split and mirrored sessions have connections of dog's own,
+	// on top.
+	if !s.idle() || s.split != nil || s.mirror != nil {
+		return nil
+	}
+
+	if _, ok := rawConn(s.client.Conn); !ok {
+		return nil
+	}
+
+	if _, ok := rawConn(s.server.Conn); !ok {
+		return nil
+	}
+
+	s.detachLock.Lock()
+	if s.finished {
+		s.detachLock.Unlock()
+		return nil
+	}
+
+	s.detachRequested = true
+	s.detachLock.Unlock()
+
+	past := time.Unix(1, 0)
+	s.client.SetReadDeadline(past)
+	s.server.SetReadDeadline(past)
+
+	return <-s.detached
+}
+
+// Whether the server is waiting for the client between transactions.
+func (s *session) idle() bool {
+	s.act.Lock()
+	defer s.act.Unlock()
+
+	return s.act.txnStatus == 'I' && !s.act.idleSince.IsZero()
+}
+
+// Note that both movers have exited, completing any detachment in
+// progress.
+func (s *session) finish() {
+	s.detachLock.Lock()
+	s.finished = true
+	requested := s.detachRequested
+	s.detachLock.Unlock()
+
+	if !requested {
+		return
+	}
+
+	h, err := s.handoff()
+	if err != nil {
+		log.Printf("Could not hand over session %d, ending it: %v\n",
+			s.id, err)
+	} else {
+		log.Printf("Handing over session %d\n", s.id)
+	}
+
+	s.detached <- h
+
+	// Our copies of the connections are no longer needed.
+	s.client.Close()
+	s.server.Close()
+}
+
+// Duplicate the connections of a stopped session, provided it was
+// stopped cleanly.
+func (s *session) handoff() (*handoff, error) {
+	if !s.idle() || s.client.HasNext() || s.server.HasNext() {
+		return nil, fmt.Errorf("session became busy " +
+			"while being stopped")
+	}
+
+	cRaw, _ := rawConn(s.client.Conn)
+	sRaw, _ := rawConn(s.server.Conn)
+
+	cFile, err := cRaw.File()
+	if err != nil {
+		return nil, err
+	}
+
+	sFile, err := sRaw.File()
+	if err != nil {
+		cFile.Close()
+		return nil, err
+	}
+
+	s.act.Lock()
+	start := s.act.start
+	s.act.Unlock()
+
+	return &handoff{
+		Route:      s.route,
+		Backend:    s.backend,
+		Listener:   s.listener,
+		ClientAddr: s.clientAddr,
+		User:       s.user,
+		Database:   s.database,
+		Start:      start,
+		client:     cFile,
+		server:     sFile,
+	}, nil
+}
+
+// Take over a session handed over by the process dog was upgraded
+// from.
+func (p *proxy) adopt(h *handoff) {
+	defer h.client.Close()
+	defer h.server.Close()
+
+	cConn, err := net.FileConn(h.client)
+	if err != nil {
+		log.Printf("Could not adopt session: %v\n", err)
+		return
+	}
+
+	defer cConn.Close()
+
+	sConn, err := net.FileConn(h.server)
+	if err != nil {
+		log.Printf("Could not adopt session: %v\n", err)
+		return
+	}
+
+	defer sConn.Close()
+
+	ent := p.rt.entry(h.Route)
+	if ent == nil {
+		log.Printf("Could not adopt session from %v: route %q "+
+			"no longer exists\n", h.ClientAddr, h.Route)
+		return
+	}
+
+	if h.Backend == "" {
+		h.Backend = ent.addr
+	}
+
+	release, err := p.adm.acquire(ent.id, h.Backend, p.queueTimeout)
+	if err != nil {
+		log.Printf("Could not adopt session from %v: %v\n",
+			h.ClientAddr, err)
+		return
+	}
+
+	defer release()
+
+	log.Printf("Adopted session from %v on route %q\n",
+		h.ClientAddr, h.Route)
+
+	// Past startup, clients send typed messages just as servers
+	// do, so a server stream reads them as they come.
+	client := &ProxyPair{
+		MessageStream: femebe.NewServerMessageStream(
+			"Client", newBufWriteCon(cConn)),
+		Conn: cConn,
+	}
+
+	server := &ProxyPair{
+		MessageStream: femebe.NewServerMessageStream(
+			"Server", newBufWriteCon(sConn)),
+		Conn: sConn,
+	}
+
+	done := make(chan error)
+	sess := NewSimpleProxySession(done, client, server)
+	sess.route = h.Route
+	sess.backend = h.Backend
+	sess.listener = h.Listener
+	sess.clientAddr = h.ClientAddr
+	sess.user = h.User
+	sess.database = h.Database
+
+	// Only idle sessions are handed over.
+	sess.act.start = h.Start
+	sess.act.txnStatus = 'I'
+	sess.act.idleSince = time.Now()
+
+	p.relay(sess, done, p.timeouts.override(ent.timeouts))
+}
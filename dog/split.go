@@ -0,0 +1,507 @@
+package main
+
+import (
+	"expvar"
+	"femebe"
+	"femebe/pgproto"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Read/write splitting sends read-only work on a route to its
+// replicas, and everything else to its primary, the route's 'addr'.
+// It is enabled per route with 'splitReads'.  Replicas are taken in
+// turn, passing over any further behind than the route's 'maxLag', as
+// measured by the health checker.
+//
+// Read-only sessions are sent to a replica as a whole, the client
+// logging in to it directly.  Sessions are read-only when their user
+// is among the route's 'readOnlyUsers', or they start with
+// default_transaction_read_only on.
+//
+// Other sessions go to the primary, but each transaction that begins
+// with BEGIN READ ONLY or START TRANSACTION ... READ ONLY, sent as a
+// simple Query or in a Parse, is sent to a replica, over a second
+// connection that dog logs in to on the client's behalf with a
+// password from the passfile.  Transactions are only ever moved
+// between servers when the client is between them, with no response
+// outstanding and no batch of extended protocol messages awaiting its
+// Sync: a pipelined batch goes wholly to the server its first message
+// went to.
+//
+// Some state lives on the primary connection only, and would be
+// missing from a replica.  A session is pinned to the primary, never
+// to have transactions sent to replicas again, once it does any of:
+//
+//	creates a temporary table
+//	prepares a statement, through PREPARE or a named Parse
+//	changes a setting for the session, through SET or RESET
+//	listens for notifications, through LISTEN
+//	declares a cursor WITH HOLD
+//	takes a session-level advisory lock
+//
+// Statements prepared within a transaction sent to a replica exist
+// only there, and so should be prepared outside read-only
+// transactions.  Cancel requests reach only the primary.
+//
+// Splitting is turned off by patching 'splitReads' to 'f', which
+// unsets 'replicas', 'readOnlyUsers' and 'maxLag' along with it.
+
+var splitStats = expvar.NewMap("split")
+
+// Whether a session should be sent to a replica as a whole.
+func readOnlySession(sup *pgproto.Startup, ent *routingEntry) bool {
+	for _, user := range ent.readOnlyUsers {
+		if user == sup.Params["user"] {
+			return true
+		}
+	}
+
+	if isOn(sup.Params["default_transaction_read_only"]) {
+		return true
+	}
+
+	// As set through the options parameter, e.g. by PGOPTIONS
+	opts := strings.Fields(sup.Params["options"])
+	for i, opt := range opts {
+		if opt == "-c" && i+1 < len(opts) {
+			opt = opts[i+1]
+		}
+
+		opt = strings.TrimPrefix(opt, "--")
+		opt = strings.Replace(opt, "-", "_", -1)
+		if strings.HasPrefix(opt, "default_transaction_read_only=") &&
+			isOn(strings.SplitN(opt, "=", 2)[1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isOn(val string) bool {
+	switch strings.ToLower(val) {
+	case "on", "true", "yes", "1":
+		return true
+	}
+
+	return false
+}
+
+// Pick a replica of the route, in turn, from among those within its
+// maximum lag.  Returns false if there is none.
+func (p *proxy) pickReplica(ent *routingEntry) (string, bool) {
+	var eligible []string
+	for _, addr := range ent.replicas {
+		if p.health.eligible(addr, ent.maxLag) {
+			eligible = append(eligible, addr)
+		}
+	}
+
+	if len(eligible) == 0 {
+		splitStats.Add("noReplica", 1)
+		return "", false
+	}
+
+	n := atomic.AddUint32(&p.nextReplica, 1)
+	return eligible[int(n)%len(eligible)], true
+}
+
+// Reduce SQL to its statements, in upper case with single spaces and
+// without comments, for matching against.  String literals are not
+// respected, which at worst pins sessions needlessly.
+func sqlStatements(sql string) []string {
+	var out []byte
+	for i := 0; i < len(sql); i++ {
+		switch {
+		case strings.HasPrefix(sql[i:], "--"):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+
+			out = append(out, ' ')
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 3
+			}
+
+			out = append(out, ' ')
+		default:
+			out = append(out, sql[i])
+		}
+	}
+
+	var stmts []string
+	for _, stmt := range strings.Split(string(out), ";") {
+		stmt = strings.ToUpper(strings.Join(strings.Fields(stmt), " "))
+		if stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	return stmts
+}
+
+// Whether the first statement of sql begins a read-only transaction.
+func beginsReadOnly(sql string) bool {
+	stmts := sqlStatements(sql)
+	if len(stmts) == 0 {
+		return false
+	}
+
+	first := stmts[0]
+	return (strings.HasPrefix(first, "BEGIN") ||
+		strings.HasPrefix(first, "START TRANSACTION")) &&
+		strings.Contains(first+" ", " READ ONLY ")
+}
+
+// Why sql pins a session to the primary, or the empty string if it
+// does not.
+func pinReason(sql string) string {
+	for _, stmt := range sqlStatements(sql) {
+		words := strings.Fields(stmt)
+		switch {
+		case strings.HasPrefix(stmt, "CREATE TEMP") ||
+			strings.HasPrefix(stmt, "CREATE LOCAL TEMP") ||
+			strings.HasPrefix(stmt, "CREATE GLOBAL TEMP"):
+			return "temporary table"
+		case words[0] == "PREPARE" && !strings.HasPrefix(stmt,
+			"PREPARE TRANSACTION"):
+			return "prepared statement"
+		case words[0] == "SET" || words[0] == "RESET":
+			if len(words) > 1 && (words[1] == "LOCAL" ||
+				words[1] == "TRANSACTION" ||
+				words[1] == "CONSTRAINTS") {
+				continue
+			}
+
+			return "session setting"
+		case words[0] == "LISTEN":
+			return "LISTEN"
+		case words[0] == "DECLARE" && strings.Contains(stmt, " WITH HOLD"):
+			return "cursor WITH HOLD"
+		case strings.Contains(stmt, "PG_ADVISORY_LOCK") ||
+			strings.Contains(stmt, "PG_TRY_ADVISORY_LOCK"):
+			return "advisory lock"
+		}
+	}
+
+	return ""
+}
+
+// Decides which server each message from a client goes to, for a
+// session splitting its transactions between the primary and a
+// replica.
+type splitter struct {
+	sync.Mutex
+
+	p      *proxy
+	sess   *session
+	ent    *routingEntry
+	params map[string]string
+
+	client  *ProxyPair
+	primary *ProxyPair
+
+	// The replica connection, made upon the first read-only
+	// transaction, or nil
+	replica     *ProxyPair
+	replicaAddr string
+
+	// The server messages are currently going to
+	current *ProxyPair
+
+	// Queries, FunctionCalls and Syncs sent, less ReadyForQuerys
+	// received, and the transaction status of the last
+	// ReadyForQuery
+	pending   int
+	txnStatus byte
+
+	// Whether extended protocol messages have been sent that await
+	// a Sync.  The server is chosen by the first message of such a
+	// batch, and kept until its Sync is answered, lest a pipelined
+	// batch be split between servers.
+	batch bool
+
+	// Why the session is pinned to the primary, or empty
+	pinned string
+}
+
+// Build a session relaying the client's transactions to the primary,
+// or a replica of the route, as above.  The replica connection is
+// made on the client's behalf with the given startup parameters.
+func newSplitSession(errch chan error, client, primary *ProxyPair,
+	p *proxy, ent *routingEntry, params map[string]string) *session {
+	s := NewSimpleProxySession(errch, client, primary)
+
+	sp := &splitter{
+		p:       p,
+		sess:    s,
+		ent:     ent,
+		params:  params,
+		client:  client,
+		primary: primary,
+		current: primary,
+
+		// Awaiting the end of startup
+		pending: 1,
+	}
+
+	s.split = sp
+	s.ingress = sp.ingress(errch)
+	s.egress = sp.egress(primary, errch)
+
+	return s
+}
+
+// Relay messages from the client to whichever server they belong on.
+func (sp *splitter) ingress(errch chan error) func() {
+	return func() {
+		var err error
+
+		defer func() {
+			sp.client.Close()
+			sp.primary.Close()
+			sp.closeReplica()
+			errch <- err
+		}()
+
+		var m femebe.Message
+
+		for {
+			err = sp.client.Next(&m)
+			if err != nil {
+				return
+			}
+
+			sp.sess.fromClient(&m)
+			to := sp.route(&m)
+
+			to.sendLock.Lock()
+			err = to.Send(&m)
+			if err == nil && !sp.client.HasNext() {
+				err = to.Flush()
+			}
+			to.sendLock.Unlock()
+
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Relay messages from one server to the client.  Only the primary's
+// mover reports to errch: the replica connection may come and go.
+func (sp *splitter) egress(from *ProxyPair, errch chan error) func() {
+	return func() {
+		var err error
+
+		defer func() {
+			if from == sp.primary {
+				sp.client.Close()
+				sp.primary.Close()
+				errch <- err
+				return
+			}
+
+			// Losing the replica part way through a
+			// transaction loses the transaction, and so the
+			// session.
+			sp.Lock()
+			busy := sp.current == from &&
+				(sp.pending > 0 || sp.txnStatus != 'I')
+			if sp.replica == from {
+				sp.dropReplica()
+			}
+			sp.Unlock()
+
+			if busy {
+				log.Printf("Lost replica mid-transaction: %v\n",
+					err)
+				sp.client.Close()
+				sp.primary.Close()
+			}
+		}()
+
+		var m femebe.Message
+
+		for {
+			err = from.Next(&m)
+			if err != nil {
+				return
+			}
+
+			sp.sess.fromServer(&m)
+			sp.fromServer(&m)
+
+			sp.client.sendLock.Lock()
+			err = sp.client.Send(&m)
+			if err == nil && !from.HasNext() {
+				err = sp.client.Flush()
+			}
+			sp.client.sendLock.Unlock()
+
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Note the end of a response from a server.
+func (sp *splitter) fromServer(m *femebe.Message) {
+	if m.MsgType() != 'Z' {
+		return
+	}
+
+	payload, err := m.Force()
+	if err != nil || len(payload) < 1 {
+		return
+	}
+
+	sp.Lock()
+	defer sp.Unlock()
+
+	sp.pending--
+	sp.txnStatus = payload[0]
+}
+
+// Choose the server for a message from the client.
+func (sp *splitter) route(m *femebe.Message) *ProxyPair {
+	var sql string
+	payload, _ := m.Force()
+
+	switch m.MsgType() {
+	case 'Q':
+		sql, _ = readCString(payload)
+	case 'P':
+		var name string
+		name, payload = readCString(payload)
+		sql, _ = readCString(payload)
+
+		if name != "" {
+			sp.pin("prepared statement")
+		}
+	}
+
+	if reason := pinReason(sql); reason != "" {
+		sp.pin(reason)
+	}
+
+	sp.Lock()
+	between := sp.pending == 0 && !sp.batch && sp.txnStatus == 'I' &&
+		sql != ""
+	toReplica := between && sp.pinned == "" && beginsReadOnly(sql)
+	if between && sp.pinned != "" {
+		sp.dropReplica()
+	}
+	sp.Unlock()
+
+	// Connecting takes a while, so is done without the lock, which
+	// is safe as only this mover changes the replica.
+	var replica *ProxyPair
+	if toReplica {
+		replica = sp.connectReplica()
+	}
+
+	sp.Lock()
+	defer sp.Unlock()
+
+	// Between transactions, the next may go elsewhere.
+	if between {
+		sp.current = sp.primary
+		if replica != nil {
+			sp.current = replica
+			splitStats.Add("replicaTransactions", 1)
+		}
+	}
+
+	switch m.MsgType() {
+	case 'Q', 'F', 'S':
+		sp.pending++
+		sp.batch = false
+	case 'P', 'B', 'D', 'E', 'C', 'H':
+		sp.batch = true
+	}
+
+	return sp.current
+}
+
+// Pin the session to the primary.
+func (sp *splitter) pin(reason string) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	if sp.pinned != "" {
+		return
+	}
+
+	sp.pinned = reason
+	splitStats.Add("pinnedSessions", 1)
+	log.Printf("Pinning session on route %q to its primary: %v\n",
+		sp.ent.id, reason)
+}
+
+// The replica connection, made if necessary, or nil if none can be
+// made, in which case the primary serves.
+func (sp *splitter) connectReplica() *ProxyPair {
+	sp.Lock()
+	replica := sp.replica
+	sp.Unlock()
+
+	if replica != nil {
+		return replica
+	}
+
+	addr, ok := sp.p.pickReplica(sp.ent)
+	if !ok {
+		log.Printf("No replica of route %q is within its maximum "+
+			"lag, using the primary\n", sp.ent.id)
+		return nil
+	}
+
+	replica, err := sp.p.login(sp.ent).connect(addr, sp.params)
+	if err != nil {
+		log.Printf("Could not connect to replica %v, "+
+			"using the primary: %v\n", addr, err)
+		splitStats.Add("replicaFailures", 1)
+		return nil
+	}
+
+	sp.Lock()
+	sp.replica = replica
+	sp.replicaAddr = addr
+	sp.Unlock()
+
+	go sp.egress(replica, nil)()
+
+	return replica
+}
+
+// Close the replica connection, if any.  The caller must hold the
+// lock.
+func (sp *splitter) dropReplica() {
+	if sp.replica == nil {
+		return
+	}
+
+	sp.replica.Close()
+	if sp.current == sp.replica {
+		sp.current = sp.primary
+	}
+
+	sp.replica = nil
+}
+
+func (sp *splitter) closeReplica() {
+	sp.Lock()
+	defer sp.Unlock()
+
+	sp.dropReplica()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"femebe"
+	"testing"
+)
+
+func clientMessage(t byte, fields ...string) *femebe.Message {
+	var payload []byte
+	for _, f := range fields {
+		payload = append(payload, cString(f)...)
+	}
+
+	var m femebe.Message
+	m.InitFromBytes(t, payload)
+	return &m
+}
+
+func readyForQuery(status byte) *femebe.Message {
+	var m femebe.Message
+	m.InitFromBytes('Z', []byte{status})
+	return &m
+}
+
+// A splitter between two servers, with the replica connection already
+// made, and the session idle.
+func testSplitter() (sp *splitter, primary, replica *ProxyPair) {
+	primary, replica = &ProxyPair{}, &ProxyPair{}
+	sp = &splitter{
+		ent:       &routingEntry{id: "test"},
+		primary:   primary,
+		replica:   replica,
+		current:   primary,
+		txnStatus: 'I',
+	}
+
+	return sp, primary, replica
+}
+
+func TestSplitPipelinedBatch(t *testing.T) {
+	sp, _, replica := testSplitter()
+
+	batch := []*femebe.Message{
+		clientMessage('P', "", "BEGIN READ ONLY", "\x00\x00"),
+		clientMessage('B', "", ""),
+		clientMessage('E', "", ""),
+		clientMessage('P', "", "SELECT 1", "\x00\x00"),
+		clientMessage('B', "", ""),
+		clientMessage('E', "", ""),
+		clientMessage('S'),
+	}
+
+	for i, m := range batch {
+		if to := sp.route(m); to != replica {
+			t.Fatalf("Message %d (%c) not sent to the replica",
+				i, m.MsgType())
+		}
+	}
+
+	sp.fromServer(readyForQuery('T'))
+
+	// The transaction continues on the replica until it ends.
+	for _, sql := range []string{"SELECT 2", "COMMIT"} {
+		if to := sp.route(clientMessage('Q', sql)); to != replica {
+			t.Fatalf("%q not sent to the replica", sql)
+		}
+
+		sp.fromServer(readyForQuery('T'))
+	}
+}
+
+func TestSplitBatchStaysOnPrimary(t *testing.T) {
+	sp, primary, _ := testSplitter()
+
+	// A read-only transaction begun part way through a batch has
+	// to stay with the rest of it.
+	batch := []*femebe.Message{
+		clientMessage('P', "", "SELECT 1", "\x00\x00"),
+		clientMessage('B', "", ""),
+		clientMessage('E', "", ""),
+		clientMessage('P', "", "BEGIN READ ONLY", "\x00\x00"),
+		clientMessage('B', "", ""),
+		clientMessage('E', "", ""),
+		clientMessage('S'),
+	}
+
+	for i, m := range batch {
+		if to := sp.route(m); to != primary {
+			t.Fatalf("Message %d (%c) not sent to the primary",
+				i, m.MsgType())
+		}
+	}
+}
+
+func TestSplitBetweenBatches(t *testing.T) {
+	sp, primary, replica := testSplitter()
+
+	if to := sp.route(clientMessage('Q', "SELECT 1")); to != primary {
+		t.Fatal("Plain query not sent to the primary")
+	}
+
+	// The next transaction may go elsewhere only once the first
+	// is answered.
+	if to := sp.route(clientMessage('Q', "BEGIN READ ONLY")); to != primary {
+		t.Fatal("Pipelined query moved with a response outstanding")
+	}
+
+	sp.fromServer(readyForQuery('I'))
+	sp.fromServer(readyForQuery('I'))
+
+	if to := sp.route(clientMessage('Q', "BEGIN READ ONLY")); to != replica {
+		t.Fatal("Read-only transaction not sent to the replica")
+	}
+}
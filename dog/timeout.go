@@ -0,0 +1,192 @@
+package main
+
+import (
+	"femebe"
+	"log"
+	"sync"
+	"time"
+)
+
+// Timeouts governing the phases of a session once it has been routed.
+// Zero disables each.
+type sessionTimeouts struct {
+	// Connecting to the server
+	dial time.Duration
+
+	// Negotiating TLS with the server
+	tls time.Duration
+
+	// From sending the startup packet to the server until it is
+	// ready for the first query
+	auth time.Duration
+
+	// Waiting for the client while inside a transaction
+	idleInTransaction time.Duration
+
+	// Waiting for the client at all
+	idle time.Duration
+}
+
+// The route attributes overriding each timeout.  An override of '0'
+// disables the timeout on the route, whatever the proxy-wide default;
+// to inherit the default instead, the override is unset, by patching
+// it to the empty string.
+var timeoutAttrs = map[string]func(t *sessionTimeouts) *time.Duration{
+	"dialTimeout": func(t *sessionTimeouts) *time.Duration {
+		return &t.dial
+	},
+	"tlsTimeout": func(t *sessionTimeouts) *time.Duration {
+		return &t.tls
+	},
+	"authTimeout": func(t *sessionTimeouts) *time.Duration {
+		return &t.auth
+	},
+	"idleInTransactionTimeout": func(t *sessionTimeouts) *time.Duration {
+		return &t.idleInTransaction
+	},
+	"idleTimeout": func(t *sessionTimeouts) *time.Duration {
+		return &t.idle
+	},
+}
+
+// Apply the overrides of a route, keyed by attribute name, onto t.
+func (t sessionTimeouts) override(
+	overrides map[string]time.Duration) sessionTimeouts {
+	for name, d := range overrides {
+		*timeoutAttrs[name](&t) = d
+	}
+
+	return t
+}
+
+// How often running sessions are checked against their timeouts, and
+// so roughly how late they can be enforced.
+const watchdogInterval = time.Second
+
+// Tracks what a session is doing, for enforcing timeouts.
+type activity struct {
+	sync.Mutex
+
+	start time.Time
+
+	// When the server last became ready for a query, or zero if
+	// it has been given something to do since
+	idleSince time.Time
+
+	// The transaction status from the server's last
+	// ReadyForQuery, or zero before the first
+	txnStatus byte
+
+	// When a message was last relayed either way
+	last time.Time
+
+	// What has been relayed from each side, for reporting
+	clientMessages, clientBytes int64
+	serverMessages, serverBytes int64
+}
+
+// Note a message relayed from the client.
+func (a *activity) fromClient(m *femebe.Message) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.idleSince = time.Time{}
+	a.last = time.Now()
+	a.clientMessages++
+	a.clientBytes += int64(m.Size())
+}
+
+// Note a message relayed from the server.
+func (a *activity) fromServer(m *femebe.Message) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.last = time.Now()
+	a.serverMessages++
+	a.serverBytes += int64(m.Size())
+
+	if m.MsgType() != 'Z' {
+		return
+	}
+
+	payload, err := m.Force()
+	if err != nil || len(payload) < 1 {
+		return
+	}
+
+	a.idleSince = a.last
+	a.txnStatus = payload[0]
+}
+
+// Check the session's activity against its timeouts, returning the
+// SQLSTATE and message to end the session with if it has overrun
+// any, or an empty code otherwise.
+func (a *activity) overrun(t *sessionTimeouts,
+	now time.Time) (code string, msg string) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.txnStatus == 0 {
+		if t.auth > 0 && now.Sub(a.start) > t.auth {
+			return "57014", "canceling authentication " +
+				"due to timeout"
+		}
+
+		return "", ""
+	}
+
+	if a.idleSince.IsZero() {
+		return "", ""
+	}
+
+	idle := now.Sub(a.idleSince)
+	if a.txnStatus != 'I' && t.idleInTransaction > 0 &&
+		idle > t.idleInTransaction {
+		return "25P03", "terminating connection due to " +
+			"idle-in-transaction timeout"
+	}
+
+	if t.idle > 0 && idle > t.idle {
+		return "57P05", "terminating connection due to " +
+			"idle-session timeout"
+	}
+
+	return "", ""
+}
+
+// Enforce the authentication and idle timeouts of a session until
+// stop is closed.  A session overrunning any is sent an error and
+// disconnected.
+func (s *session) watchdog(t sessionTimeouts,
+	client, server *ProxyPair, stop <-chan struct{}) {
+	if t.auth == 0 && t.idleInTransaction == 0 && t.idle == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			code, msg := s.act.overrun(&t, now)
+			if code == "" {
+				continue
+			}
+
+			log.Printf("Ending session: %v\n", msg)
+
+			client.sendLock.Lock()
+			sendError(client.MessageStream, "FATAL", code, msg)
+			client.sendLock.Unlock()
+
+			// The movers exit on their own once the
+			// connections are closed.
+			client.Close()
+			server.Close()
+			return
+		}
+	}
+}
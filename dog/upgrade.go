@@ -0,0 +1,564 @@
+package main
+
+import (
+	"../dogconf"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Listening sockets can be handed to dog by systemd, following its
+// socket activation protocol, or by the process dog is upgraded from.
+// Either way, they wait in a socketPool until claimed by a listener,
+// or the administrative or metrics address, in place of opening a
+// socket of its own.
+
+type pooledSocket struct {
+	name string
+	ln   net.Listener
+}
+
+type socketPool struct {
+	sync.Mutex
+	socks []*pooledSocket
+}
+
+func newSocketPool() *socketPool {
+	return &socketPool{}
+}
+
+func (sp *socketPool) add(name string, ln net.Listener) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	sp.socks = append(sp.socks, &pooledSocket{name: name, ln: ln})
+}
+
+// Claim the socket named after the listener with the given id, or
+// else one bound to addr, opening a new socket only if there is
+// neither.  The administrative and metrics addresses are claimed with
+// an empty id.
+func (sp *socketPool) listen(id, addr string) (net.Listener, error) {
+	sp.Lock()
+	defer sp.Unlock()
+
+	for _, byName := range []bool{true, false} {
+		for i, ps := range sp.socks {
+			if (byName && id != "" && ps.name == id) ||
+				(!byName && sameAddr(addr, ps.ln)) {
+				sp.socks = append(sp.socks[:i], sp.socks[i+1:]...)
+				log.Printf("Using inherited socket %v for %v\n",
+					ps.ln.Addr(), addr)
+				return ps.ln, nil
+			}
+		}
+	}
+
+	return autoListen(addr)
+}
+
+// Close the sockets nothing has claimed, once configuration is
+// complete.
+func (sp *socketPool) closeUnclaimed() {
+	sp.Lock()
+	defer sp.Unlock()
+
+	for _, ps := range sp.socks {
+		log.Printf("Closing inherited socket %v (%q), "+
+			"which nothing claims\n", ps.ln.Addr(), ps.name)
+		closeShared(ps.ln)
+	}
+
+	sp.socks = nil
+}
+
+// Whether a socket is bound to addr, as written in dogconf or on the
+// command line.  Addresses that leave the port to the operating
+// system match nothing, as they cannot be told apart.
+func sameAddr(addr string, ln net.Listener) bool {
+	if strings.Contains(addr, "/") {
+		return ln.Addr().String() == addr
+	}
+
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	have, ok := ln.Addr().(*net.TCPAddr)
+	if err != nil || !ok || want.Port == 0 || want.Port != have.Port {
+		return false
+	}
+
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return have.IP == nil || have.IP.IsUnspecified()
+	}
+
+	return want.IP.Equal(have.IP)
+}
+
+// Close a socket that another process may still be using, leaving
+// any unix socket file in place for it.
+func closeShared(ln net.Listener) {
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	ln.Close()
+}
+
+// The first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// Take the sockets passed by systemd, if it started dog through
+// socket activation.  Sockets are named by FileDescriptorName=, which
+// may name the listener to use each; otherwise they are matched by
+// address.
+func inheritSystemdSockets(sp *socketPool) error {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return fmt.Errorf("bad LISTEN_FDS: %v", err)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Not for any children, such as upgrades, to misinterpret
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("socket %d from systemd: %v", i, err)
+		}
+
+		sp.add(name, ln)
+	}
+
+	return nil
+}
+
+// An upgrade hands everything over to a new process, running the
+// (presumably replaced) dog binary with the same arguments, over a
+// unix socket it inherits as file descriptor 3.  The old process
+// sends, in order:
+//
+//	one "socket" message per listening socket, with its descriptor
+//	one "record" message per dogconf object, with its OCN
+//	one "change" message per change ever made, oldest first
+//	a "state" message with the executor's OCN
+//
+// The new process takes over the sockets and objects, and replies
+// "ready" once accepting clients.  The old process then stops
+// accepting clients and sends one "session" message, with the
+// descriptors of the client and server connections, per idle session
+// it hands over, followed by "done".  It exits once every session it
+// kept has ended.
+//
+// The objects, rather than the configuration file, are carried over
+// so that changes made at run time survive the upgrade, with the same
+// OCNs.
+
+// Names the descriptor of the upgrade socket in the new process.
+const upgradeEnv = "DOG_UPGRADE_FD"
+
+type upgradeMsg struct {
+	Type string `json:"type"`
+
+	// For "socket"
+	Name string `json:"name,omitempty"`
+
+	// For "record" and "change"
+	Record *dogconf.Record `json:"record,omitempty"`
+
+	// For "change": "create", "patch" or "delete", when, and on
+	// whose behalf
+	Change string    `json:"change,omitempty"`
+	At     time.Time `json:"at,omitempty"`
+	Who    string    `json:"who,omitempty"`
+
+	// For "state"
+	Ocn uint64 `json:"ocn,omitempty"`
+
+	// For "session"
+	Session *handoff `json:"session,omitempty"`
+}
+
+// One end of the upgrade socket.
+type upgradeConn struct {
+	*net.UnixConn
+}
+
+func (uc *upgradeConn) send(m *upgradeMsg, files ...*os.File) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+
+	_, _, err = uc.WriteMsgUnix(b, oob, nil)
+	return err
+}
+
+// Receive the next message, along with any descriptors passed with
+// it.
+func (uc *upgradeConn) receive() (*upgradeMsg, []*os.File, error) {
+	b := make([]byte, 1<<16)
+	oob := make([]byte, syscall.CmsgSpace(2*4))
+
+	n, oobn, _, _, err := uc.ReadMsgUnix(b, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if n == 0 {
+		return nil, nil, fmt.Errorf("upgrade socket closed")
+	}
+
+	var files []*os.File
+	cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, cmsg := range cmsgs {
+		fds, err := syscall.ParseUnixRights(&cmsg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "passed"))
+		}
+	}
+
+	m := new(upgradeMsg)
+	if err := json.Unmarshal(b[:n], m); err != nil {
+		return nil, nil, err
+	}
+
+	return m, files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// Start the new process, returning our end of the upgrade socket.
+func startUpgrade() (*upgradeConn, *exec.Cmd, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX,
+		syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ours := os.NewFile(uintptr(fds[0]), "upgrade")
+	theirs := os.NewFile(uintptr(fds[1]), "upgrade")
+	defer ours.Close()
+	defer theirs.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Env = append(os.Environ(), upgradeEnv+"=3")
+
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	c, err := net.FileConn(ours)
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, nil, err
+	}
+
+	return &upgradeConn{c.(*net.UnixConn)}, cmd, nil
+}
+
+// Hand everything over to a new process, then drain and exit.  If the
+// new process fails to start, this one carries on as before.
+func (p *proxy) upgrade(ex *executor, handoffSessions bool) error {
+	uc, cmd, err := startUpgrade()
+	if err != nil {
+		return err
+	}
+
+	defer uc.Close()
+
+	// Hold off changes until the new process has the objects, and
+	// refuse them afterwards, as they would be lost.
+	ex.Lock()
+	defer ex.Unlock()
+
+	if err := p.sendState(uc, ex); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	m, _, err := uc.receive()
+	if err != nil || m.Type != "ready" {
+		cmd.Process.Kill()
+		return fmt.Errorf("new process did not become ready: %v", err)
+	}
+
+	ex.retired = true
+	ex.dropWatchers()
+
+	p.listeners.closeAll()
+	for _, ln := range []net.Listener{p.adminLn, p.httpLn, p.metricsLn} {
+		if ln != nil {
+			closeShared(ln)
+		}
+	}
+
+	handedOver := 0
+	if handoffSessions {
+		for _, s := range p.sessions.all() {
+			h := s.detach()
+			if h == nil {
+				continue
+			}
+
+			err := uc.send(&upgradeMsg{Type: "session", Session: h},
+				h.client, h.server)
+			h.client.Close()
+			h.server.Close()
+			if err != nil {
+				log.Printf("Could not hand over session %d: %v\n",
+					s.id, err)
+				continue
+			}
+
+			handedOver++
+		}
+	}
+
+	if err := uc.send(&upgradeMsg{Type: "done"}); err != nil {
+		log.Printf("Could not finish upgrade: %v\n", err)
+	}
+
+	log.Printf("Upgraded to process %d, handing over %d sessions\n",
+		cmd.Process.Pid, handedOver)
+
+	go p.drain()
+	return nil
+}
+
+func (p *proxy) sendState(uc *upgradeConn, ex *executor) error {
+	socks := p.listeners.sockets()
+
+	send := func(name string, ln net.Listener) error {
+		fl, ok := ln.(filer)
+		if !ok {
+			return fmt.Errorf("cannot pass on socket %v", ln.Addr())
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		return uc.send(&upgradeMsg{Type: "socket", Name: name}, f)
+	}
+
+	for id, ln := range socks {
+		if err := send(id, ln); err != nil {
+			return err
+		}
+	}
+
+	for _, ln := range []net.Listener{p.adminLn, p.httpLn, p.metricsLn} {
+		if ln == nil {
+			continue
+		}
+
+		if err := send("", ln); err != nil {
+			return err
+		}
+	}
+
+	for _, kind := range objectKinds {
+		for _, rec := range ex.table(kind).list() {
+			err := uc.send(&upgradeMsg{Type: "record", Record: rec})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, c := range ex.changes.changes {
+		err := uc.send(&upgradeMsg{Type: "change", Change: c.op,
+			Record: c.rec, At: c.at, Who: c.who})
+		if err != nil {
+			return err
+		}
+	}
+
+	return uc.send(&upgradeMsg{Type: "state", Ocn: ex.ocn})
+}
+
+// Wait for the sessions remaining after an upgrade to end, then exit.
+func (p *proxy) drain() {
+	for {
+		n := p.sessions.count()
+		if n == 0 {
+			log.Printf("Sessions drained; exiting\n")
+			os.Exit(0)
+		}
+
+		log.Printf("Draining %d sessions\n", n)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// The process dog is being upgraded from, as seen by the new process.
+type upgradeParent struct {
+	uc *upgradeConn
+
+	records []*dogconf.Record
+	changes []*change
+	ocn     uint64
+}
+
+// If dog is being started by an upgrade, take the sockets and objects
+// of the old process, returning nil otherwise.
+func inheritFromParent(sp *socketPool) (*upgradeParent, error) {
+	fd, err := strconv.Atoi(os.Getenv(upgradeEnv))
+	if err != nil {
+		return nil, nil
+	}
+
+	os.Unsetenv(upgradeEnv)
+
+	f := os.NewFile(uintptr(fd), "upgrade")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	up := &upgradeParent{uc: &upgradeConn{c.(*net.UnixConn)}}
+
+	for {
+		m, files, err := up.uc.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m.Type {
+		case "socket":
+			if len(files) != 1 {
+				closeFiles(files)
+				return nil, fmt.Errorf("socket %q passed "+
+					"without its descriptor", m.Name)
+			}
+
+			ln, err := net.FileListener(files[0])
+			files[0].Close()
+			if err != nil {
+				return nil, err
+			}
+
+			sp.add(m.Name, ln)
+		case "record":
+			up.records = append(up.records, m.Record)
+		case "change":
+			up.changes = append(up.changes, &change{op: m.Change,
+				rec: m.Record, at: m.At, who: m.Who})
+		case "state":
+			up.ocn = m.Ocn
+			return up, nil
+		default:
+			closeFiles(files)
+			return nil, fmt.Errorf("unexpected upgrade message %q",
+				m.Type)
+		}
+	}
+}
+
+// Tell the old process we are accepting clients, then adopt the
+// sessions it hands over.
+func (up *upgradeParent) ready(p *proxy) {
+	defer up.uc.Close()
+
+	if err := up.uc.send(&upgradeMsg{Type: "ready"}); err != nil {
+		log.Printf("Could not complete upgrade: %v\n", err)
+		return
+	}
+
+	for {
+		m, files, err := up.uc.receive()
+		if err != nil {
+			log.Printf("Could not receive sessions: %v\n", err)
+			return
+		}
+
+		switch m.Type {
+		case "session":
+			if len(files) != 2 || m.Session == nil {
+				closeFiles(files)
+				log.Printf("Session passed without " +
+					"its connections\n")
+				continue
+			}
+
+			m.Session.client = files[0]
+			m.Session.server = files[1]
+			go p.adopt(m.Session)
+		case "done":
+			return
+		default:
+			closeFiles(files)
+		}
+	}
+}
+
+// Upgrade upon SIGUSR2, as do many other servers.
+func handleUpgradeSignal(p *proxy, ex *executor, handoffSessions bool) {
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGUSR2)
+
+	go func() {
+		for _ = range sigch {
+			log.Printf("Upgrading\n")
+			if err := p.upgrade(ex, handoffSessions); err != nil {
+				log.Printf("Could not upgrade: %v\n", err)
+				continue
+			}
+
+			signal.Stop(sigch)
+			return
+		}
+	}()
+}
@@ -0,0 +1,53 @@
+// Verify the chain of a dog audit log, as written with -audit-log.
+//
+// Prints the number and hash of the last entry, which can be noted to
+// check later that the log has not been truncated since.
+package main
+
+import (
+	"../audit"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	head := flag.String("head", "",
+		"hash of an entry the log must contain, e.g. one noted "+
+			"at an earlier verification")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Printf("Usage: dogaudit [flags] LOG")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Could not open audit log: %v", err)
+	}
+
+	defer f.Close()
+
+	var found bool
+	last, err := audit.VerifyFunc(f, func(e *audit.Entry) {
+		found = found || e.Hash == *head
+	})
+	if err != nil {
+		log.Fatalf("Audit log does not verify: %v", err)
+	}
+
+	if *head != "" && !found {
+		log.Fatalf("Audit log does not contain the entry %v; "+
+			"it may have been truncated", *head)
+	}
+
+	if last == nil {
+		fmt.Println("empty")
+		return
+	}
+
+	fmt.Printf("%d %s\n", last.Seq, last.Hash)
+}
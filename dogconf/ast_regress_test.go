@@ -173,3 +173,38 @@ func TestExtraBrackets(t *testing.T) {
 	astRegressFail(t, "extra_brackets_target",
 		`[route ['bar' @ 137] [delete]]`)
 }
+
+func TestCreateRule(t *testing.T) {
+	astRegressFail(t, "create_rule",
+		`[rule 'office' [create [type='host', address='10.0.0.0/8',
+		    method='allow']]]`)
+}
+
+func TestUnknownKind(t *testing.T) {
+	astRegressFail(t, "unknown_kind", `[table all [get]]`)
+}
+
+func TestTerminateSession(t *testing.T) {
+	astRegressFail(t, "terminate_session", `[session '42' [terminate]]`)
+}
+
+func TestDrainRoute(t *testing.T) {
+	astRegressFail(t, "drain_route", `[route 'bar' @ 7 [drain]]`)
+}
+
+func TestWatch(t *testing.T) {
+	astRegressFail(t, "watch_since",
+		`[route all [watch [since='12']]]`)
+}
+
+func TestTransaction(t *testing.T) {
+	astRegressFail(t, "transaction",
+		`[begin [route 'a' @ 5 [patch [addr='h2:5432']]]
+		    [route 'b' @ 6 [delete]] commit]`)
+
+	astRegressFail(t, "nested_transaction",
+		`[begin [begin commit] commit]`)
+
+	astRegressFail(t, "unterminated_transaction",
+		`[begin [route 'a' @ 5 [delete]] end]`)
+}
@@ -0,0 +1,222 @@
+// Package client speaks dogconf to dog's administrative address, for
+// programs that manage routes.
+//
+// Requests are rendered with the same quoting dog reads them with, and
+// replies read back into dogconf.Records, so that callers need never
+// handle the bracketed syntax themselves.
+package client
+
+import (
+	"../../dogconf"
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// How to reach dog beyond its address.
+type Config struct {
+	// The bearer token to authenticate with, if any
+	Token string
+
+	// Connect over TLS with this configuration, if not nil, as
+	// needed when dog is run with -admin-tls-cert.  A client
+	// certificate in it authenticates the client.
+	TLS *tls.Config
+}
+
+// An error reply from dog, other than an OCN conflict.
+type Error struct {
+	// One of the dogconf.ErrCode constants
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dog: %v: %v", e.Code, e.Message)
+}
+
+// The OCN given with a request did not match that of its target, which
+// has changed since it was read.  The target should be read again, and
+// the request reconsidered.
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string {
+	return "dog: OCN conflict: " + e.Message
+}
+
+// Convert an error reply into one of this package's errors.
+func replyError(err error) error {
+	re, ok := err.(*dogconf.ReplyError)
+	if !ok {
+		return err
+	}
+
+	if re.Code == dogconf.ErrCodeConflict {
+		return &ConflictError{Message: re.Message}
+	}
+
+	return &Error{Code: re.Code, Message: re.Message}
+}
+
+// A connection to dog's administrative address.  Requests are made
+// one at a time, and may be made from several goroutines.
+type Client struct {
+	network, addr string
+	conf          Config
+
+	sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+	rr   *dogconf.ReplyReader
+}
+
+// Connect to dog's administrative address, e.g. ("unix",
+// "/run/dog/admin.sock").  The configuration may be nil.
+func Dial(network, addr string, conf *Config) (*Client, error) {
+	c := &Client{network: network, addr: addr}
+	if conf != nil {
+		c.conf = *conf
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	c.conn = conn
+	c.w = bufio.NewWriter(conn)
+	c.rr = dogconf.NewReplyReader(bufio.NewReader(conn))
+	return c, nil
+}
+
+// Open a connection as configured, authenticating if need be.
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := net.Dial(c.network, c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.conf.TLS != nil {
+		conn = tls.Client(conn, c.conf.TLS)
+	}
+
+	if c.conf.Token != "" {
+		_, err := fmt.Fprintf(conn, "bearer %v\n", c.conf.Token)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Send a request, rendered in dogconf, and read its reply.  Most
+// requests are better made with the methods for them, but this serves
+// for the rest, e.g. those on other kinds of object.
+func (c *Client) Do(req string) ([]*dogconf.Record, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, err := c.w.WriteString(req + "\n"); err != nil {
+		return nil, err
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	recs, err := c.rr.Next()
+	return recs, replyError(err)
+}
+
+// Render a target: a route, or every route if id is empty, at the
+// given OCN unless it is zero.
+func target(id string, ocn uint64) string {
+	if id == "" {
+		return "[route all"
+	}
+
+	t := "[route " + dogconf.QuoteStr(id)
+	if ocn != 0 {
+		t += " @ " + strconv.FormatUint(ocn, 10)
+	}
+
+	return t
+}
+
+// Render attributes as a dogconf property list, refusing any names
+// that would not be read back as such.
+func props(attrs map[string]string) (string, error) {
+	for name := range attrs {
+		if !dogconf.IsIdent(name) {
+			return "", fmt.Errorf("dog: bad attribute name %q",
+				name)
+		}
+	}
+
+	return dogconf.FormatProps(attrs), nil
+}
+
+// The one record a request on one object is answered with.
+func one(recs []*dogconf.Record, err error) (*dogconf.Record, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recs) != 1 {
+		return nil, fmt.Errorf("dog: expected one record in "+
+			"reply, got %v", len(recs))
+	}
+
+	return recs[0], nil
+}
+
+// Create a route, returning it as created.
+func (c *Client) CreateRoute(id string,
+	attrs map[string]string) (*dogconf.Record, error) {
+	p, err := props(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return one(c.Do(target(id, 0) + " [create " + p + "]]"))
+}
+
+// Change attributes of a route, which must be at the given OCN,
+// returning it as changed.  A *ConflictError is returned if it is not.
+func (c *Client) PatchRoute(id string, ocn uint64,
+	attrs map[string]string) (*dogconf.Record, error) {
+	p, err := props(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return one(c.Do(target(id, ocn) + " [patch " + p + "]]"))
+}
+
+// Every route, ordered by id.
+func (c *Client) GetRoutes() ([]*dogconf.Record, error) {
+	return c.Do(target("", 0) + " [get]]")
+}
+
+// One route.
+func (c *Client) GetRoute(id string) (*dogconf.Record, error) {
+	return one(c.Do(target(id, 0) + " [get]]"))
+}
+
+// Delete a route, which must be at the given OCN.  A *ConflictError
+// is returned if it is not.
+func (c *Client) DeleteRoute(id string, ocn uint64) error {
+	_, err := c.Do(target(id, ocn) + " [delete]]")
+	return err
+}
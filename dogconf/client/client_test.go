@@ -0,0 +1,232 @@
+package client
+
+import (
+	"../../dogconf"
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A stand-in for dog, answering each request it expects in turn with
+// a canned reply.
+type fakeDog struct {
+	t  *testing.T
+	ln net.Listener
+
+	// Requests expected on each connection, in the order they
+	// are made, with the replies to them
+	conns [][][2]string
+
+	// The bearer token expected, if any
+	token string
+
+	done chan struct{}
+}
+
+func newFakeDog(t *testing.T, token string, conns ...[][2]string) *fakeDog {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "admin.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd := &fakeDog{t: t, ln: ln, conns: conns, token: token,
+		done: make(chan struct{})}
+	go fd.serve()
+	return fd
+}
+
+func (fd *fakeDog) addr() string {
+	return fd.ln.Addr().String()
+}
+
+func (fd *fakeDog) serve() {
+	defer close(fd.done)
+
+	for _, exchanges := range fd.conns {
+		conn, err := fd.ln.Accept()
+		if err != nil {
+			fd.t.Error(err)
+			return
+		}
+
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		if fd.token != "" {
+			line, err := br.ReadString('\n')
+			if err != nil || line != "bearer "+fd.token+"\n" {
+				fd.t.Errorf("Expected bearer token, got %q, %v",
+					line, err)
+				return
+			}
+		}
+
+		p := dogconf.NewParser("", br)
+		for _, ex := range exchanges {
+			if _, err := p.Next(); err != nil {
+				fd.t.Errorf("Could not parse request: %v", err)
+				return
+			}
+
+			if p.Text() != ex[0] {
+				fd.t.Errorf("Expected request %q, got %q",
+					ex[0], p.Text())
+			}
+
+			io.WriteString(conn, ex[1])
+		}
+	}
+}
+
+func (fd *fakeDog) close() {
+	fd.ln.Close()
+	<-fd.done
+	os.RemoveAll(filepath.Dir(fd.addr()))
+}
+
+func TestRoutes(t *testing.T) {
+	fd := newFakeDog(t, "tok", [][2]string{
+		{"[route 'it''s' [create [addr='a:1', dbnameIn='x']]]",
+			"[ok\n [route 'it''s' @ 3 [addr='a:1', dbnameIn='x']]]\n"},
+		{"[route 'it''s' @ 2 [patch [lock='t']]]",
+			"[error [code='conflict', message='stale']]\n"},
+		{"[route 'it''s' @ 3 [patch [lock='t']]]",
+			"[ok\n [route 'it''s' @ 4 [addr='a:1', lock='t']]]\n"},
+		{"[route all [get]]",
+			"[ok\n [route 'a' @ 1 [addr='a:1'] [active='0']]\n" +
+				" [route 'b' @ 2 [addr='b:1'] [active='2']]]\n"},
+		{"[route 'nope' [get]]",
+			"[error [code='notfound', message='1:8: no']]\n"},
+		{"[route 'it''s' @ 4 [delete]]", "[ok]\n"},
+	})
+	defer fd.close()
+
+	c, err := Dial("unix", fd.addr(), &Config{Token: "tok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	rec, err := c.CreateRoute("it's",
+		map[string]string{"addr": "a:1", "dbnameIn": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Id != "it's" || rec.Ocn != 3 || rec.Attrs["addr"] != "a:1" {
+		t.Errorf("Unexpected record %v", rec)
+	}
+
+	_, err = c.PatchRoute("it's", 2, map[string]string{"lock": "t"})
+	if _, ok := err.(*ConflictError); !ok {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+
+	rec, err = c.PatchRoute("it's", 3, map[string]string{"lock": "t"})
+	if err != nil || rec.Ocn != 4 {
+		t.Errorf("Unexpected patch result %v, %v", rec, err)
+	}
+
+	// Rejected before anything is sent
+	_, err = c.PatchRoute("it's", 4, map[string]string{"a='b'": "c"})
+	if err == nil {
+		t.Error("Expected a bad attribute name to be rejected")
+	}
+
+	recs, err := c.GetRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recs) != 2 || recs[1].Id != "b" ||
+		recs[1].Status["active"] != "2" {
+		t.Errorf("Unexpected routes %v", recs)
+	}
+
+	_, err = c.GetRoute("nope")
+	if e, ok := err.(*Error); !ok || e.Code != dogconf.ErrCodeNotFound {
+		t.Errorf("Expected a notfound error, got %v", err)
+	}
+
+	if err := c.DeleteRoute("it's", 4); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	fd := newFakeDog(t, "",
+		// The client's own connection, left unused
+		[][2]string{},
+		[][2]string{{"[route all [watch]]",
+			"[ok\n [route 'a' @ 1 [addr='a:1']]]\n" +
+				"[synced @ 5]\n" +
+				"[patch [route 'a' @ 6 [addr='a:2']]]\n" +
+				"[delete [route 'a' @ 7 []]]\n" +
+				"[error [code='conflict', message='cut off']]\n"}},
+		[][2]string{{"[route 'a' [watch [since='7']]]",
+			"[ok]\n[synced @ 7]\n"}})
+	defer fd.close()
+
+	c, err := Dial("unix", fd.addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The watch has a connection of its own.
+	c.Close()
+
+	w, err := c.Watch("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.Records) != 1 || w.Records[0].Id != "a" {
+		t.Errorf("Unexpected snapshot %v", w.Records)
+	}
+
+	for _, expected := range []Change{{Op: "synced", Ocn: 5},
+		{Op: "patch", Ocn: 6}, {Op: "delete", Ocn: 7}} {
+		ch, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ch.Op != expected.Op || ch.Ocn != expected.Ocn ||
+			w.Ocn != ch.Ocn {
+			t.Errorf("Expected %v @ %v, got %+v",
+				expected.Op, expected.Ocn, ch)
+		}
+	}
+
+	if _, err := w.Next(); !isConflict(err) {
+		t.Errorf("Expected to be cut off, got %v", err)
+	}
+
+	w.Close()
+
+	w, err = c.Watch("a", w.Ocn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	if ch, err := w.Next(); err != nil || ch.Op != "synced" || ch.Ocn != 7 {
+		t.Errorf("Expected synced @ 7, got %+v, %v", ch, err)
+	}
+}
+
+func isConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
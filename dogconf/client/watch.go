@@ -0,0 +1,88 @@
+package client
+
+import (
+	"../../dogconf"
+	"bufio"
+	"net"
+	"strconv"
+)
+
+// One change to a route, as told to a Watcher.
+type Change struct {
+	// "create", "patch" or "delete"; or "synced", once the
+	// watcher has caught up to the changes made so far
+	Op string
+
+	// The route as it became, or, if deleted, without attributes;
+	// nil if synced
+	Record *dogconf.Record
+
+	// The OCN of the change, or that caught up to
+	Ocn uint64
+}
+
+// Follows changes to routes over a connection of its own.
+type Watcher struct {
+	conn net.Conn
+	rr   *dogconf.ReplyReader
+
+	// The routes as they were when the watch began, unless it
+	// resumed
+	Records []*dogconf.Record
+
+	// The OCN of the last change told of, to resume from with
+	// Watch should the watcher be cut off
+	Ocn uint64
+}
+
+// Watch for changes to one route, or to every route if id is empty.
+// If since is zero, the watch begins with the routes as they are, in
+// Records; otherwise, it resumes after the change with that OCN.
+func (c *Client) Watch(id string, since uint64) (*Watcher, error) {
+	req := target(id, 0) + " [watch"
+	if since != 0 {
+		req += " [since=" + dogconf.QuoteStr(
+			strconv.FormatUint(since, 10)) + "]"
+	}
+
+	req += "]]\n"
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		conn: conn,
+		rr:   dogconf.NewReplyReader(bufio.NewReader(conn)),
+		Ocn:  since,
+	}
+
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if w.Records, err = w.rr.Next(); err != nil {
+		conn.Close()
+		return nil, replyError(err)
+	}
+
+	return w, nil
+}
+
+// Wait for the next change.  A watcher that falls behind is cut off
+// with a *ConflictError, and may resume from its Ocn.
+func (w *Watcher) Next() (*Change, error) {
+	op, rec, ocn, err := w.rr.NextChange()
+	if err != nil {
+		return nil, replyError(err)
+	}
+
+	w.Ocn = ocn
+	return &Change{Op: op, Record: rec, Ocn: ocn}, nil
+}
+
+func (w *Watcher) Close() error {
+	return w.conn.Close()
+}
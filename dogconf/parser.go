@@ -27,22 +27,92 @@ patch a route:
  [route 'my-very-long-server-identifier-maybe-a-uuid' @ 5
    [patch [lock='t']]] 
 
+stop mirroring a route, an empty value unsetting an optional attribute:
+
+ [route 'route-id' @ 6 [patch [mirror='']]]
+
 delete a route:
 
  [route 'my-very-long-server-identifier-maybe-a-uuid' @ 5 [delete]]
 
+limit the connections made to a backend, across all routes:
+
+ [backend '123.123.123.123:5432' [create [maxConnections='50']]]
+
+add an access rule, admitting clients from a network:
+
+ [rule 'office' [create [order='10', type='hostssl',
+   address='10.0.0.0/8', database='all', user='all', method='allow']]]
+
+accept clients on another address, requiring TLS:
+
+ [listener 'public' [create [addr='0.0.0.0:5432', tls='require',
+   tlsCert='/etc/dog/server.crt', tlsKey='/etc/dog/server.key']]]
+
+list the sessions running through dog, or get one:
+
+ [session all [get]]
+
+ [session '42' [get]]
+
+end every session of a route, or just one:
+
+ [route 'route-id' [terminate]]
+
+ [session '42' [terminate]]
+
+refuse new sessions to a route, ending each existing one as it goes
+idle:
+
+ [route 'route-id' @ 5 [drain]]
+
+follow the routes, or one route, as they change, resuming after the
+change with a given OCN:
+
+ [route all [watch]]
+
+ [route 'route-id' [watch [since='12']]]
+
+list every version a route has had, and put a route back as it was at
+an earlier version, as a new version:
+
+ [route 'route-id' [history]]
+
+ [route 'route-id' @ 9 [revert [to='5']]]
+
+apply several changes to routes together, or not at all, e.g. when
+failing over:
+
+ [begin
+   [route 'primary' @ 5 [patch [addr='10.0.0.2:5432']]]
+   [route 'replica' @ 6 [patch [addr='10.0.0.1:5432']]]
+ commit]
+
+see what a change to a route would do, without making it:
+
+ [route 'route-id' @ 5 [explain [patch [addr='10.0.0.2:5432']]]]
+
+get every route as it is, in order of id, each with the 'create'
+request that would make it again as its 'create' status:
+
+ [route all [dump]]
+
 */
 
 /*
 
 grammar:
 
-<request>    ::= "[" "route" <route-spec> "[" <command> "]" "]"
+<request>    ::= "[" <kind> <route-spec> "[" <command> "]" "]"
+               | "[" "begin" <request>* "commit" "]"
+<kind>       ::= "route" | "rule" | "backend" | "listener" | "session"
 <route-spec> ::= "all" | <route-id>
 <route-id>   ::= <identifier> "@" <ocn> | <identifier>
 <command>    ::= <list-cmd> "[" <patch-list> "]" | <bare-cmd>
-<bare-cmd>   ::= "get" | "delete"
-<list-cmd>   ::= "patch" | "create"
+               | "explain" "[" <command> "]"
+<bare-cmd>   ::= "get" | "delete" | "terminate" | "drain" | "watch"
+               | "history" | "dump"
+<list-cmd>   ::= "patch" | "create" | "watch" | "revert"
 <patch-list> ::= <patch> | <patch-list> "," <patch>
 <patch>      ::= <identifier> "=" <value>
 <value>      ::= <str-lit>
@@ -80,45 +150,136 @@ type ErrScanner struct {
 	Scanner     *Scanner
 }
 
-func ParseRequest(r io.Reader) (rs *RequestSyntax, err error) {
-	var s = new(Scanner)
-	s.Init(r)
-
-	// Convert only ErrScanner panics into regular return values.
-	defer func() {
-		if x := recover(); x != nil {
-			if e, ok := x.(ErrScanner); ok {
-				rs = nil
-				err = e
-			} else {
-				panic(x)
-			}
-		}
-	}()
+// Parses a stream of requests one at a time, such as a configuration
+// file or an administrative connection.  Since the underlying Scanner
+// buffers its input, the same Parser must be used for every request
+// read from a given stream.
+type Parser struct {
+	s Scanner
+
+	// What has been read of the stream, from the start of the
+	// last request on
+	src *recorder
+
+	// Offset of the start of the last request
+	start int
+}
+
+// Keeps what is read through it, so the source text of requests can
+// be recovered.
+type recorder struct {
+	r io.Reader
+
+	// Read from the stream, starting at offset base
+	buf  []byte
+	base int
+}
+
+func (rec *recorder) Read(b []byte) (int, error) {
+	n, err := rec.r.Read(b)
+	rec.buf = append(rec.buf, b[:n]...)
+	return n, err
+}
+
+// Forget what was read before the given offset.
+func (rec *recorder) discard(offset int) {
+	if n := offset - rec.base; n > 0 {
+		rec.buf = append(rec.buf[:0], rec.buf[n:]...)
+		rec.base = offset
+	}
+}
+
+// The text read between two offsets, the earlier of which must not
+// have been discarded.
+func (rec *recorder) text(from, to int) string {
+	to -= rec.base
+	if to > len(rec.buf) {
+		to = len(rec.buf)
+	}
+
+	return string(rec.buf[from-rec.base : to])
+}
+
+// Create a Parser reading from r.  The name is used as the filename
+// in the positions of any tokens produced, and may be empty.
+func NewParser(name string, r io.Reader) *Parser {
+	p := new(Parser)
+	p.src = &recorder{r: r}
+	p.s.Init(p.src)
+	p.s.Filename = name
 
 	// Set up error handler for scanner.  This must be done
 	// *after* Init() on the Scanner, or else it'll be overwritten
 	// into oblivion.
-	s.Error = func(s *Scanner, msg string) {
-		// Blow up the entire scanning process if something
-		// goes awry, at the very first incident.  It could be
-		// useful to continue and accrue the errors rather
-		// than blow up immediately, but future errors in the
-		// lexer after a failed lex are questionable at best.
-		pos := s.Position
-		if !pos.IsValid() {
-			pos = s.Pos()
+	p.s.Error = scanPanic
+
+	return p
+}
+
+// Parse the next request in the stream, returning io.EOF if the
+// stream ends cleanly between requests.
+//
+// After any other error, the position of the Parser in the stream is
+// undefined, and it should not be used again.
+func (p *Parser) Next() (rs *RequestSyntax, err error) {
+	defer recoverScan(&err)
+
+	if p.s.Peek().Type == EOF {
+		return nil, io.EOF
+	}
+
+	// Peeking has left the position of the request's first token
+	// in the Scanner.
+	p.start = p.s.Offset
+	p.src.discard(p.start)
+
+	return parseRequest(&p.s)
+}
+
+// The source text of the request last returned by Next, exactly as
+// read, or as much of it as was read before an error.
+func (p *Parser) Text() string {
+	return p.src.text(p.start, p.s.Pos().Offset)
+}
+
+func ParseRequest(r io.Reader) (rs *RequestSyntax, err error) {
+	p := NewParser("", r)
+	defer recoverScan(&err)
+
+	return parseRequest(&p.s)
+}
+
+// Convert only ErrScanner panics into regular return values.  This
+// must be deferred directly for recover() to have any effect.
+func recoverScan(err *error) {
+	if x := recover(); x != nil {
+		if e, ok := x.(ErrScanner); ok {
+			*err = e
+		} else {
+			panic(x)
 		}
+	}
+}
 
-		embellished := fmt.Sprintf("%s: %s", pos, msg)
-		panic(ErrScanner{
-			error:       errors.New(embellished),
-			BaseMessage: msg,
-			Scanner:     s,
-		})
+// Error handler installed into the Scanner, panicking with an
+// ErrScanner to be caught by recoverScan.
+func scanPanic(s *Scanner, msg string) {
+	// Blow up the entire scanning process if something
+	// goes awry, at the very first incident.  It could be
+	// useful to continue and accrue the errors rather
+	// than blow up immediately, but future errors in the
+	// lexer after a failed lex are questionable at best.
+	pos := s.Position
+	if !pos.IsValid() {
+		pos = s.Pos()
 	}
 
-	return parseRequest(s)
+	embellished := fmt.Sprintf("%s: %s", pos, msg)
+	panic(ErrScanner{
+		error:       errors.New(embellished),
+		BaseMessage: msg,
+		Scanner:     s,
+	})
 }
 
 func parseRequest(s *Scanner) (rs *RequestSyntax, err error) {
@@ -127,12 +288,19 @@ func parseRequest(s *Scanner) (rs *RequestSyntax, err error) {
 		return nil, err
 	}
 
-	tok, err := expect(s, Ident)
+	kind, err := expect(s, Ident)
 	if err != nil {
 		return nil, err
 	}
-	if tok.Lexeme != "route" {
-		return nil, fmt.Errorf("Expected 'route', got %v", tok)
+
+	switch kind.Lexeme {
+	case "route", "rule", "backend", "listener", "session":
+	case "begin":
+		return parseTransaction(s, kind)
+	default:
+		return nil, fmt.Errorf("Expected 'route', 'rule', "+
+			"'backend', 'listener', 'session' or 'begin', got %v",
+			kind)
 	}
 
 	spec, err := parseRouteSpec(s)
@@ -151,7 +319,44 @@ func parseRequest(s *Scanner) (rs *RequestSyntax, err error) {
 		return nil, err
 	}
 
-	return &RequestSyntax{Spec: spec, Action: action}, nil
+	return &RequestSyntax{Kind: kind, Spec: spec, Action: action}, nil
+}
+
+// Parses the requests of a transaction up to and including the
+// closing "commit ]", the "[ begin" having been read.
+func parseTransaction(s *Scanner, begin *Token) (*RequestSyntax, error) {
+	rs := &RequestSyntax{Begin: begin}
+
+	for s.Peek().Type == LBrace {
+		req, err := parseRequest(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if req.Begin != nil {
+			return nil, fmt.Errorf("Transactions cannot be "+
+				"nested, got %v", req.Begin)
+		}
+
+		rs.Requests = append(rs.Requests, req)
+	}
+
+	commit, err := expect(s, Ident)
+	if err != nil {
+		return nil, err
+	}
+
+	if commit.Lexeme != "commit" {
+		return nil, fmt.Errorf("Expected a request or 'commit', "+
+			"got %v", commit)
+	}
+
+	_, err = expect(s, RBrace)
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
 }
 
 func parseRouteSpec(s *Scanner) (SpecSyntax, error) {
@@ -236,9 +441,52 @@ func parseAction(s *Scanner) (a ActionSyntax, err error) {
 	case "delete":
 		a = &DeleteActionSyntax{Blamer: tok, DeleteToken: tok}
 		goto out
+	case "terminate":
+		a = &TerminateActionSyntax{Blamer: tok, TerminateToken: tok}
+		goto out
+	case "drain":
+		a = &DrainActionSyntax{Blamer: tok, DrainToken: tok}
+		goto out
+	case "watch":
+		// The properties are optional.
+		var props map[*Token]*Token
+		if s.Peek().Type == LBrace {
+			props, err = parseProps(s)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		a = &WatchActionSyntax{Blamer: tok, WatchProps: props}
+		goto out
+	case "history":
+		a = &HistoryActionSyntax{Blamer: tok, HistoryToken: tok}
+		goto out
+	case "dump":
+		a = &DumpActionSyntax{Blamer: tok, DumpToken: tok}
+		goto out
+	case "revert":
+		props, err := parseProps(s)
+		if err != nil {
+			return nil, err
+		}
+
+		a = &RevertActionSyntax{Blamer: tok, RevertProps: props}
+		goto out
+	case "explain":
+		// The action to be explained follows, bracketed like
+		// any other.
+		action, err := parseAction(s)
+		if err != nil {
+			return nil, err
+		}
+
+		a = &ExplainActionSyntax{Blamer: tok, Action: action}
+		goto out
 	default:
 		return nil, fmt.Errorf("Expected 'patch', 'create', "+
-			"'get', or 'delete'; got %v", tok)
+			"'get', 'delete', 'terminate', 'drain', 'watch', "+
+			"'history', 'revert', 'explain' or 'dump'; got %v", tok)
 	}
 
 	panic("Switch does not cover all cases when it should")
@@ -288,26 +536,10 @@ func parseProps(s *Scanner) (map[*Token]*Token, error) {
 			return nil, err
 		}
 
-		// Check validity of property keys being set.  This is
-		// a convenience afforded by the fact that property
-		// lists are only used by one construct in dogconf, so
-		// it's possible to do some checking of the keys at
-		// parse-time.  If this code needs be made
-		// multi-purpose, it is best for validity-checking
-		// code to move to the semantic analyzer.
-		switch k := keyTok.Lexeme; k {
-		case "addr", "lock", "dbnameIn", "dbnameRewritten":
-			_, present := props[keyTok]
-			if !present {
-				props[keyTok] = valTok
-			} else {
-				return nil, fmt.Errorf("Duplicate key '%v' "+
-					" in patch request", keyTok)
-			}
-		default:
-			return nil, fmt.Errorf("Unknown key '%v': expected "+
-				"'addr', 'lock', 'user', or 'password'", keyTok)
-		}
+		// The validity of the keys depends on the kind of
+		// object being targeted, so checking them (and for
+		// duplicates) is left to the semantic analyzer.
+		props[keyTok] = valTok
 
 		allowComma = true
 	}
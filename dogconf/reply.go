@@ -0,0 +1,376 @@
+// Replies to dogconf requests
+//
+// Replies are written in the same bracketed syntax as requests, so
+// they can be read with the same Scanner.
+package dogconf
+
+/*
+
+a successful reply, carrying any records affected or requested:
+
+ [ok [route 'bar' @ 5 [addr='123.123.123.125:5445', lock='f']]]
+
+records may carry a second property list, reporting their run-time
+status rather than attributes that can be set:
+
+ [ok [backend 'h:5432' @ 2 [maxConnections='50'] [active='50', queued='3']]]
+
+a failure:
+
+ [error [code='conflict', message='1:8: ...']]
+
+a 'watch' is answered with an ok reply, then follows with each change
+as it is made, after marking the OCN the watcher has caught up to:
+
+ [synced @ 12]
+ [patch [route 'bar' @ 13 [addr='123.123.123.126:5445', lock='f']]]
+ [delete [route 'bar' @ 14 []]]
+
+grammar:
+
+<reply>   ::= "[" "ok" <record>* "]" | "[" "error" <props> "]"
+<event>   ::= "[" <change> <record> "]" | "[" "synced" "@" <ocn> "]"
+<change>  ::= "create" | "patch" | "delete"
+<record>  ::= "[" <kind> <str-lit> <version> <props> <status> "]"
+<props>   ::= "[" <patch-list> "]" | "[" "]"
+<status>  ::= <props> | ""
+<version> ::= "@" <ocn> | ""
+
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Codes classifying the errors that can be replied with
+const (
+	// The request could not be parsed
+	ErrCodeSyntax = "syntax"
+
+	// The request was parsed, but is meaningless, e.g. a 'patch'
+	// without an OCN
+	ErrCodeSemantic = "semantic"
+
+	// The OCN given does not match the current one of the target
+	ErrCodeConflict = "conflict"
+
+	// The target does not exist
+	ErrCodeNotFound = "notfound"
+
+	// The target of a 'create' already exists
+	ErrCodeExists = "exists"
+
+	// The request cannot be applied to the current state, e.g. two
+	// routes for the same database
+	ErrCodeInvalid = "invalid"
+
+	// The client is not permitted to make the request
+	ErrCodeDenied = "denied"
+)
+
+// One object as reported in a reply, such as a route.
+type Record struct {
+	Kind Kind
+	Id   string
+
+	// Omitted from the rendered form when zero, for records that
+	// are not versioned.
+	Ocn uint64
+
+	Attrs map[string]string
+
+	// Read-only run-time status, e.g. the number of sessions, if
+	// any is reported for this kind of record.
+	Status map[string]string
+}
+
+// Render the record, with its attributes in sorted order so that the
+// output is deterministic.
+func (r *Record) String() string {
+	var buf bytes.Buffer
+
+	buf.WriteString("[" + string(r.Kind) + " " + QuoteStr(r.Id))
+	if r.Ocn != 0 {
+		buf.WriteString(" @ " + strconv.FormatUint(r.Ocn, 10))
+	}
+
+	buf.WriteString(" " + FormatProps(r.Attrs))
+	if len(r.Status) > 0 {
+		buf.WriteString(" " + FormatProps(r.Status))
+	}
+
+	buf.WriteString("]")
+
+	return buf.String()
+}
+
+// Render a property list, e.g. [a='b', c='d'], in sorted order.
+func FormatProps(props map[string]string) string {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + QuoteStr(props[k])
+	}
+
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// Render the request that would create an object as a record has it,
+// e.g. [route 'x' [create [addr='h:5432']]], with its attributes in
+// sorted order.  Its OCN and status are left behind.
+func FormatCreate(rec *Record) string {
+	return "[" + string(rec.Kind) + " " + QuoteStr(rec.Id) +
+		" [create " + FormatProps(rec.Attrs) + "]]"
+}
+
+// The inverse of stripStr: surround str with quotes, escaping any
+// quotes within it.
+func QuoteStr(str string) string {
+	return "'" + strings.Replace(str, "'", "''", -1) + "'"
+}
+
+// Write a successful reply carrying the given records, one per line.
+func WriteReply(w io.Writer, recs []*Record) error {
+	var buf bytes.Buffer
+
+	buf.WriteString("[ok")
+	for i := range recs {
+		buf.WriteString("\n " + recs[i].String())
+	}
+	buf.WriteString("]\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Write an error reply, classified by one of the ErrCode constants.
+func WriteError(w io.Writer, code string, err error) error {
+	_, werr := io.WriteString(w, "[error "+FormatProps(map[string]string{
+		"code":    code,
+		"message": err.Error(),
+	})+"]\n")
+
+	return werr
+}
+
+// Write one change followed by a watch: the record as it became, or,
+// if deleted, without attributes, at the OCN of the deletion.
+func WriteChange(w io.Writer, change string, rec *Record) error {
+	_, err := io.WriteString(w, "["+change+" "+rec.String()+"]\n")
+	return err
+}
+
+// Write that a watch has caught up to the change with the given OCN.
+func WriteSynced(w io.Writer, ocn uint64) error {
+	_, err := io.WriteString(w,
+		"[synced @ "+strconv.FormatUint(ocn, 10)+"]\n")
+	return err
+}
+
+// An error reply, as read by a ReplyReader.
+type ReplyError struct {
+	// One of the ErrCode constants
+	Code    string
+	Message string
+}
+
+func (e *ReplyError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Reads the replies written by WriteReply and WriteError, and the
+// changes following the reply to a watch, from a stream, for clients.
+// As with a Parser, the same ReplyReader must be used for every reply
+// read from a given stream.
+type ReplyReader struct {
+	s Scanner
+}
+
+func NewReplyReader(r io.Reader) *ReplyReader {
+	rr := new(ReplyReader)
+	rr.s.Init(r)
+	rr.s.Error = scanPanic
+
+	return rr
+}
+
+// Read the next reply: the records it carries, or the error, as a
+// *ReplyError.  Any other error means the stream could not be read,
+// or did not hold a reply.
+func (rr *ReplyReader) Next() (recs []*Record, err error) {
+	defer recoverScan(&err)
+
+	s := &rr.s
+	if _, err := expect(s, LBrace); err != nil {
+		return nil, err
+	}
+
+	tok, err := expect(s, Ident)
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok.Lexeme {
+	case "ok":
+		for s.Peek().Type == LBrace {
+			rec, err := parseRecord(s)
+			if err != nil {
+				return nil, err
+			}
+
+			recs = append(recs, rec)
+		}
+	case "error":
+		props, err := parseProps(s)
+		if err != nil {
+			return nil, err
+		}
+
+		attrs := propStrings(props)
+		err = &ReplyError{Code: attrs["code"], Message: attrs["message"]}
+		if _, rerr := expect(s, RBrace); rerr != nil {
+			return nil, rerr
+		}
+
+		return nil, err
+	default:
+		return nil, fmt.Errorf("Expected 'ok' or 'error', got %v", tok)
+	}
+
+	if _, err := expect(s, RBrace); err != nil {
+		return nil, err
+	}
+
+	return recs, nil
+}
+
+// Read the next change following the reply to a watch: what was done,
+// and the record as it became, or, if op is "synced", the OCN the
+// watch has caught up to, without a record.  A watch that is cut off
+// ends with an error reply, returned as a *ReplyError.
+func (rr *ReplyReader) NextChange() (op string, rec *Record, ocn uint64,
+	err error) {
+	defer recoverScan(&err)
+
+	s := &rr.s
+	if _, err := expect(s, LBrace); err != nil {
+		return "", nil, 0, err
+	}
+
+	tok, err := expect(s, Ident)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	switch tok.Lexeme {
+	case "synced":
+		if _, err := expect(s, At); err != nil {
+			return "", nil, 0, err
+		}
+
+		tok, err := expect(s, Int)
+		if err != nil {
+			return "", nil, 0, err
+		}
+
+		if ocn, err = strconv.ParseUint(tok.Lexeme, 10, 64); err != nil {
+			return "", nil, 0, err
+		}
+	case "error":
+		props, err := parseProps(s)
+		if err != nil {
+			return "", nil, 0, err
+		}
+
+		attrs := propStrings(props)
+		err = &ReplyError{Code: attrs["code"], Message: attrs["message"]}
+		if _, rerr := expect(s, RBrace); rerr != nil {
+			return "", nil, 0, rerr
+		}
+
+		return "", nil, 0, err
+	default:
+		if rec, err = parseRecord(s); err != nil {
+			return "", nil, 0, err
+		}
+
+		ocn = rec.Ocn
+	}
+
+	if _, err := expect(s, RBrace); err != nil {
+		return "", nil, 0, err
+	}
+
+	return tok.Lexeme, rec, ocn, nil
+}
+
+// Parse one record, as rendered by Record.String.
+func parseRecord(s *Scanner) (*Record, error) {
+	if _, err := expect(s, LBrace); err != nil {
+		return nil, err
+	}
+
+	kind, err := expect(s, Ident)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := expect(s, String)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &Record{Kind: Kind(kind.Lexeme), Id: stripStr(id.Lexeme)}
+	if s.Peek().Type == At {
+		s.Scan()
+		ocn, err := expect(s, Int)
+		if err != nil {
+			return nil, err
+		}
+
+		rec.Ocn, err = strconv.ParseUint(ocn.Lexeme, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	props, err := parseProps(s)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.Attrs = propStrings(props)
+	if s.Peek().Type == LBrace {
+		status, err := parseProps(s)
+		if err != nil {
+			return nil, err
+		}
+
+		rec.Status = propStrings(status)
+	}
+
+	if _, err := expect(s, RBrace); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func propStrings(props map[*Token]*Token) map[string]string {
+	strs := make(map[string]string, len(props))
+	for k, v := range props {
+		strs[k.Lexeme] = stripStr(v.Lexeme)
+	}
+
+	return strs
+}
@@ -0,0 +1,232 @@
+package dogconf
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestWriteReply(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := WriteReply(&buf, []*Record{
+		{Kind: RouteKind, Id: "it's", Ocn: 5,
+			Attrs: map[string]string{"lock": "f", "addr": "a:1"}},
+		{Kind: RuleKind, Id: "r", Attrs: map[string]string{}},
+		{Kind: BackendKind, Id: "h:1", Ocn: 7,
+			Attrs:  map[string]string{"maxConnections": "2"},
+			Status: map[string]string{"queued": "1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[ok\n" +
+		" [route 'it''s' @ 5 [addr='a:1', lock='f']]\n" +
+		" [rule 'r' []]\n" +
+		" [backend 'h:1' @ 7 [maxConnections='2'] [queued='1']]]\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := WriteError(&buf, ErrCodeConflict, errors.New("it's stale"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[error [code='conflict', message='it''s stale']]\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestFormatCreate(t *testing.T) {
+	recs := []*Record{
+		{Kind: RouteKind, Id: "it's", Ocn: 5,
+			Attrs: map[string]string{"addr": "a:1",
+				"dbnameIn": "o'neil's [db], \"x\"\n\u00e9t\u00e9",
+				"lock":     "f"},
+			Status: map[string]string{"active": "3"}},
+		{Kind: RouteKind, Id: "", Attrs: map[string]string{
+			"addr": "''", "dbnameIn": "]]"}},
+	}
+
+	expected := "[route 'it''s' [create [addr='a:1', " +
+		"dbnameIn='o''neil''s [db], \"x\"\n\u00e9t\u00e9', " +
+		"lock='f']]]"
+	if s := FormatCreate(recs[0]); s != expected {
+		t.Errorf("Expected %q, got %q", expected, s)
+	}
+
+	// Read back, each is the request that made it.
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		buf.WriteString(FormatCreate(rec) + "\n")
+	}
+
+	p := NewParser("", &buf)
+	for _, rec := range recs {
+		req, err := p.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := Analyze(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cd, ok := d.(*CreateDirective)
+		if !ok || cd.Kind != rec.Kind || cd.What != rec.Id ||
+			len(cd.Attrs) != len(rec.Attrs) {
+			t.Errorf("Expected to create %v, got %#v", rec, d)
+			continue
+		}
+
+		for k, v := range rec.Attrs {
+			if cd.Attrs[k] != v {
+				t.Errorf("Expected %v=%q, got %q",
+					k, v, cd.Attrs[k])
+			}
+		}
+	}
+}
+
+func TestParserStream(t *testing.T) {
+	p := NewParser("stream", bytes.NewBufferString(
+		"[route all [get]]\n[rule 'r' [get]]\n"))
+
+	for _, kind := range []string{"route", "rule"} {
+		req, err := p.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if req.Kind.Lexeme != kind {
+			t.Errorf("Expected kind %v, got %v", kind, req.Kind)
+		}
+	}
+
+	if _, err := p.Next(); err == nil || err.Error() != "EOF" {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestParserText(t *testing.T) {
+	p := NewParser("", bytes.NewBufferString(
+		"  [route 'a' [get]]\n[begin\n [route 'b' @ 2 [delete]]\n"+
+			"commit]  [route 'it''s' [get"))
+
+	for _, expected := range []string{
+		"[route 'a' [get]]",
+		"[begin\n [route 'b' @ 2 [delete]]\ncommit]",
+	} {
+		if _, err := p.Next(); err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Text() != expected {
+			t.Errorf("Expected text %q, got %q", expected, p.Text())
+		}
+	}
+
+	if _, err := p.Next(); err == nil {
+		t.Fatal("Expected an error for an unterminated request")
+	}
+
+	if expected := "[route 'it''s' [get"; p.Text() != expected {
+		t.Errorf("Expected text %q, got %q", expected, p.Text())
+	}
+}
+
+func TestWriteChange(t *testing.T) {
+	var buf bytes.Buffer
+
+	if err := WriteSynced(&buf, 12); err != nil {
+		t.Fatal(err)
+	}
+
+	err := WriteChange(&buf, "delete", &Record{Kind: RouteKind,
+		Id: "bar", Ocn: 14, Attrs: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[synced @ 12]\n[delete [route 'bar' @ 14 []]]\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestReplyReader(t *testing.T) {
+	var buf bytes.Buffer
+
+	recs := []*Record{
+		{Kind: RouteKind, Id: "it's", Ocn: 5,
+			Attrs: map[string]string{"lock": "f", "addr": "a:1"}},
+		{Kind: RuleKind, Id: "r", Attrs: map[string]string{}},
+		{Kind: BackendKind, Id: "h:1", Ocn: 7,
+			Attrs:  map[string]string{"maxConnections": "2"},
+			Status: map[string]string{"queued": "1"}},
+	}
+
+	WriteReply(&buf, recs)
+	WriteError(&buf, ErrCodeConflict, errors.New("it's stale"))
+	WriteReply(&buf, nil)
+	WriteSynced(&buf, 12)
+	WriteChange(&buf, "patch", recs[0])
+	WriteError(&buf, ErrCodeConflict, errors.New("cut off"))
+
+	rr := NewReplyReader(&buf)
+
+	got, err := rr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(recs) {
+		t.Fatalf("Expected %v records, got %v", len(recs), len(got))
+	}
+
+	for i := range recs {
+		if got[i].String() != recs[i].String() {
+			t.Errorf("Expected %v, got %v", recs[i], got[i])
+		}
+	}
+
+	_, err = rr.Next()
+	if re, ok := err.(*ReplyError); !ok || re.Code != ErrCodeConflict ||
+		re.Message != "it's stale" {
+		t.Errorf("Expected a conflict error reply, got %v", err)
+	}
+
+	if got, err := rr.Next(); err != nil || len(got) != 0 {
+		t.Errorf("Expected an empty reply, got %v, %v", got, err)
+	}
+
+	op, rec, ocn, err := rr.NextChange()
+	if err != nil || op != "synced" || rec != nil || ocn != 12 {
+		t.Errorf("Expected synced @ 12, got %v %v @ %v, %v",
+			op, rec, ocn, err)
+	}
+
+	op, rec, ocn, err = rr.NextChange()
+	if err != nil || op != "patch" || ocn != 5 ||
+		rec.String() != recs[0].String() {
+		t.Errorf("Expected patch of %v, got %v %v @ %v, %v",
+			recs[0], op, rec, ocn, err)
+	}
+
+	_, _, _, err = rr.NextChange()
+	if _, ok := err.(*ReplyError); !ok {
+		t.Errorf("Expected an error reply, got %v", err)
+	}
+
+	if _, err := rr.Next(); err == nil {
+		t.Error("Expected an error at the end of the stream")
+	}
+}
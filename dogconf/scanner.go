@@ -96,6 +96,19 @@ func (t *Token) String() string {
 
 }
 
+// Whether str would be scanned as a single identifier, as attribute
+// names are.
+func IsIdent(str string) bool {
+	for i, ch := range str {
+		if !(ch == '_' || unicode.IsLetter(ch) ||
+			(i > 0 && unicode.IsDigit(ch))) {
+			return false
+		}
+	}
+
+	return str != ""
+}
+
 func IsWhitespace(ch rune) bool {
 	return ch == '\t' || ch == '\n' || ch == '\r' || ch == ' '
 }
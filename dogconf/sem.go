@@ -7,6 +7,11 @@ package dogconf
 
 import (
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Returned when a wrong-in-all-situations type of target is included
@@ -20,24 +25,690 @@ type ErrBadTarget struct {
 func semErrf(blam Blamer, format string, args ...interface{}) error {
 	return fmt.Errorf("%s: %s",
 		blam.Blame().Pos,
-		fmt.Sprintf(format, args))
+		fmt.Sprintf(format, args...))
+}
+
+// Checks one attribute value, returning it in canonical form.
+type attrCheck func(val string) (string, error)
+
+// The attributes that may be set on each kind of object, and how to
+// check their values.
+var kindAttrs = map[Kind]map[string]attrCheck{
+	RouteKind: {
+		"addr":            checkNonEmpty,
+		"lock":            checkBool,
+		"dbnameIn":        checkNonEmpty,
+		"dbnameRewritten": checkNonEmpty,
+		"maxConnections":  checkCount,
+
+		// Overrides of the proxy-wide timeouts, unset to fall
+		// back to them
+		"dialTimeout":              optional(checkDuration),
+		"tlsTimeout":               optional(checkDuration),
+		"authTimeout":              optional(checkDuration),
+		"idleInTransactionTimeout": optional(checkDuration),
+		"idleTimeout":              optional(checkDuration),
+
+		// Whether to send servers a PROXY protocol header
+		// identifying the client, and of which version
+		"proxyProtocol": checkOneOf("none", "v1", "v2"),
+
+		// Sending read-only transactions and users to
+		// replicas, given as a comma-separated list of
+		// addresses
+		"splitReads":    checkBool,
+		"replicas":      optional(checkNonEmpty),
+		"readOnlyUsers": optional(checkNonEmpty),
+
+		// How far behind the primary replicas may fall before
+		// they are no longer sent reads
+		"maxLag": optional(checkDuration),
+
+		// Candidate hosts, as a comma-separated list of
+		// addresses, among which dog keeps 'addr' pointing at
+		// one in the given role
+		"hosts": optional(checkNonEmpty),
+		"role":  checkOneOf("primary", "standby", "any"),
+
+		// Another server to copy sessions to, and whether to
+		// copy only simple Queries of SELECTs
+		"mirror":            optional(checkNonEmpty),
+		"mirrorSelectsOnly": checkBool,
+
+		// Another server to send a percentage of new sessions
+		// to, and whether to send users or client addresses
+		// the same way each time
+		"canary":        optional(checkNonEmpty),
+		"canaryPercent": checkPercent,
+		"canarySticky":  checkOneOf("none", "user", "address"),
+	},
+	RuleKind: {
+		"order":    checkInt,
+		"type":     checkOneOf("local", "host", "hostssl", "hostnossl"),
+		"database": checkNonEmpty,
+		"user":     checkNonEmpty,
+		"address":  checkAddress,
+		"method":   checkOneOf("allow", "reject"),
+		"listener": checkNonEmpty,
+	},
+	BackendKind: {
+		"maxConnections": checkCount,
+	},
+	ListenerKind: {
+		"addr":          checkNonEmpty,
+		"proxyProtocol": checkBool,
+		"tls":           checkOneOf("disable", "allow", "require"),
+		"tlsCert":       checkNonEmpty,
+		"tlsKey":        checkNonEmpty,
+	},
+}
+
+// Attributes that only mean anything alongside another, and so are
+// unset along with it, or when it is turned off.
+var kindDependents = map[Kind]map[string][]string{
+	RouteKind: {
+		"splitReads": {"replicas", "readOnlyUsers", "maxLag"},
+		"replicas":   {"maxLag"},
+		"hosts":      {"role"},
+		"mirror":     {"mirrorSelectsOnly"},
+		"canary":     {"canaryPercent", "canarySticky"},
+	},
+}
+
+// The attributes that must be supplied when creating each kind of
+// object.
+var kindRequired = map[Kind][]string{
+	RouteKind:    {"addr"},
+	RuleKind:     {"type", "method"},
+	ListenerKind: {"addr"},
+}
+
+func checkNonEmpty(val string) (string, error) {
+	if val == "" {
+		return "", fmt.Errorf("must not be empty")
+	}
+
+	return val, nil
+}
+
+// Optional attributes may be given an empty value, which unsets them.
+func optional(check attrCheck) attrCheck {
+	return func(val string) (string, error) {
+		if val == "" {
+			return "", nil
+		}
+
+		return check(val)
+	}
+}
+
+// Booleans are canonicalized to 't' and 'f', as Postgres does.
+func checkBool(val string) (string, error) {
+	switch strings.ToLower(val) {
+	case "t", "true", "on", "yes", "1":
+		return "t", nil
+	case "f", "false", "off", "no", "0":
+		return "f", nil
+	}
+
+	return "", fmt.Errorf("expected a boolean")
+}
+
+func checkInt(val string) (string, error) {
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return "", fmt.Errorf("expected an integer")
+	}
+
+	return strconv.Itoa(i), nil
+}
+
+// Counts are non-negative integers, where zero usually means there is
+// no limit.
+func checkCount(val string) (string, error) {
+	i, err := strconv.Atoi(val)
+	if err != nil || i < 0 {
+		return "", fmt.Errorf("expected a non-negative integer")
+	}
+
+	return strconv.Itoa(i), nil
+}
+
+// Percentages run from 0 to 100, and may have fractions.
+func checkPercent(val string) (string, error) {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f < 0 || f > 100 {
+		return "", fmt.Errorf("expected a percentage from 0 to 100")
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64), nil
+}
+
+// Durations are written as in Go, e.g. '1m30s'; zero means there is
+// no timeout.
+func checkDuration(val string) (string, error) {
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return "", fmt.Errorf("expected a duration, e.g. '30s'")
+	}
+
+	return d.String(), nil
+}
+
+func checkOneOf(allowed ...string) attrCheck {
+	return func(val string) (string, error) {
+		for _, a := range allowed {
+			if val == a {
+				return val, nil
+			}
+		}
+
+		return "", fmt.Errorf("expected one of %v", quoteList(allowed))
+	}
+}
+
+// Addresses are either 'all' or a network in CIDR notation.
+func checkAddress(val string) (string, error) {
+	if val == "all" {
+		return val, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(val)
+	if err != nil {
+		return "", fmt.Errorf("expected 'all' or a CIDR address")
+	}
+
+	return ipNet.String(), nil
+}
+
+// Render a list of words as, e.g., 'a', 'b', 'c'
+func quoteList(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = "'" + w + "'"
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+// The actions each kind accepts.
+var kindActions = map[Kind][]string{
+	RouteKind: {"get", "create", "patch", "delete", "terminate",
+		"drain", "watch", "history", "revert", "explain", "dump"},
+	RuleKind:     {"get", "create", "patch", "delete"},
+	BackendKind:  {"get", "create", "patch", "delete"},
+	ListenerKind: {"get", "create", "patch", "delete"},
+	SessionKind:  {"get", "terminate"},
+}
+
+// Every kind of object, in the order they are documented.
+func Kinds() []Kind {
+	return []Kind{RouteKind, RuleKind, BackendKind, ListenerKind,
+		SessionKind}
+}
+
+// The actions a kind of object accepts, e.g. for completion.
+func Actions(kind Kind) []string {
+	return append([]string(nil), kindActions[kind]...)
+}
+
+// The attributes that may be set on a kind of object, sorted.
+func Attributes(kind Kind) []string {
+	names := make([]string, 0, len(kindAttrs[kind]))
+	for name := range kindAttrs[kind] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
 }
 
 func Analyze(req *RequestSyntax) (Directive, error) {
-	switch req.Action.(type) {
+	if req.Begin != nil {
+		return analyzeTransaction(req)
+	}
+
+	kind := Kind(req.Kind.Lexeme)
+
+	tok := req.Action.(Blamer).Blame()
+	found := false
+	for _, name := range kindActions[kind] {
+		found = found || name == tok.Lexeme
+	}
+
+	if !found {
+		return nil, semErrf(tok, "Cannot '%v' a %v: expected %v",
+			tok.Lexeme, kind, quoteList(kindActions[kind]))
+	}
+
+	switch a := req.Action.(type) {
 	case *PatchActionSyntax:
-		return nil, nil
+		return analyzePatch(kind, req, a)
 	case *CreateActionSyntax:
-		//		return analyzeCreate(req, a)
-		return nil, nil
+		return analyzeCreate(kind, req, a)
 	case *GetActionSyntax:
-		//		return analyzeGet(req, a)
-		return nil, nil
+		return analyzeGet(kind, req, a)
 	case *DeleteActionSyntax:
-		//		return analyzeDelete(req, a)
-		return nil, nil
+		return analyzeDelete(kind, req, a)
+	case *TerminateActionSyntax:
+		return analyzeTerminate(kind, req, a)
+	case *DrainActionSyntax:
+		return analyzeDrain(kind, req, a)
+	case *WatchActionSyntax:
+		return analyzeWatch(kind, req, a)
+	case *HistoryActionSyntax:
+		return analyzeHistory(kind, req, a)
+	case *DumpActionSyntax:
+		return analyzeDump(kind, req, a)
+	case *RevertActionSyntax:
+		return analyzeRevert(kind, req, a)
+	case *ExplainActionSyntax:
+		return analyzeExplain(kind, req, a)
 	}
 
 	panic(fmt.Errorf("Attempting to semantically analyze "+
 		"un-enumerated action type %T", req.Action))
 }
+
+// Only changes to routes can be made in transactions, for now.
+func analyzeTransaction(req *RequestSyntax) (Directive, error) {
+	d := &TransactionDirective{Blamer: req.Begin}
+
+	for _, sub := range req.Requests {
+		tok := sub.Action.(Blamer).Blame()
+		switch {
+		case Kind(sub.Kind.Lexeme) != RouteKind:
+			return nil, semErrf(sub.Kind, "Only routes can be "+
+				"changed in a transaction, not a %v",
+				sub.Kind.Lexeme)
+		case tok.Lexeme != "create" && tok.Lexeme != "patch" &&
+			tok.Lexeme != "delete":
+			return nil, semErrf(tok, "Cannot '%v' in a "+
+				"transaction: expected 'create', 'patch' or "+
+				"'delete'", tok.Lexeme)
+		}
+
+		sd, err := Analyze(sub)
+		if err != nil {
+			return nil, err
+		}
+
+		d.Directives = append(d.Directives, sd)
+	}
+
+	return d, nil
+}
+
+func analyzePatch(kind Kind, req *RequestSyntax,
+	a *PatchActionSyntax) (Directive, error) {
+	target, err := analyzeTarget(req.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := target.(*TargetOcn)
+	if !ok {
+		return nil, ErrBadTarget{semErrf(req.Spec,
+			"'patch' requires a target with an OCN")}
+	}
+
+	attrs, err := analyzeAttrs(kind, a.PatchProps)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, deps := range kindDependents[kind] {
+		if val, ok := attrs[name]; !ok || (val != "" && val != "f") {
+			continue
+		}
+
+		for _, dep := range deps {
+			if _, ok := attrs[dep]; !ok {
+				attrs[dep] = ""
+			}
+		}
+	}
+
+	return &PatchDirective{Blamer: a.Blamer, Kind: kind,
+		TargetOcn: *t, Attrs: attrs}, nil
+}
+
+func analyzeCreate(kind Kind, req *RequestSyntax,
+	a *CreateActionSyntax) (Directive, error) {
+	target, err := analyzeTarget(req.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := target.(*TargetOne)
+	if !ok {
+		return nil, ErrBadTarget{semErrf(req.Spec,
+			"'create' requires a single target without an OCN")}
+	}
+
+	attrs, err := analyzeAttrs(kind, a.CreateProps)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unset is as good as not given.
+	for name, val := range attrs {
+		if val == "" {
+			delete(attrs, name)
+		}
+	}
+
+	for _, name := range kindRequired[kind] {
+		if _, ok := attrs[name]; !ok {
+			return nil, semErrf(a, "Creating a %v requires "+
+				"attribute '%v'", kind, name)
+		}
+	}
+
+	return &CreateDirective{Blamer: a.Blamer, Kind: kind,
+		TargetOne: *t, Attrs: attrs}, nil
+}
+
+func analyzeGet(kind Kind, req *RequestSyntax,
+	a *GetActionSyntax) (Directive, error) {
+	target, err := analyzeTarget(req.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := target.(*TargetOcn); ok {
+		return nil, ErrBadTarget{semErrf(req.Spec,
+			"'get' does not accept a target with an OCN")}
+	}
+
+	if err := checkSessionId(kind, target); err != nil {
+		return nil, err
+	}
+
+	return &GetDirective{Blamer: a.Blamer, Kind: kind,
+		Target: target}, nil
+}
+
+func analyzeDelete(kind Kind, req *RequestSyntax,
+	a *DeleteActionSyntax) (Directive, error) {
+	target, err := analyzeTarget(req.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := target.(*TargetOne); ok {
+		return nil, ErrBadTarget{semErrf(req.Spec,
+			"'delete' requires 'all' or a target with an OCN")}
+	}
+
+	return &DeleteDirective{Blamer: a.Blamer, Kind: kind,
+		Target: target}, nil
+}
+
+func analyzeTerminate(kind Kind, req *RequestSyntax,
+	a *TerminateActionSyntax) (Directive, error) {
+	target, err := analyzeTarget(req.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := target.(*TargetOcn); ok {
+		return nil, ErrBadTarget{semErrf(req.Spec,
+			"'terminate' does not accept a target with an OCN")}
+	}
+
+	if err := checkSessionId(kind, target); err != nil {
+		return nil, err
+	}
+
+	return &TerminateDirective{Blamer: a.Blamer, Kind: kind,
+		Target: target}, nil
+}
+
+func analyzeDrain(kind Kind, req *RequestSyntax,
+	a *DrainActionSyntax) (Directive, error) {
+	target, err := analyzeTarget(req.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := target.(*TargetOcn)
+	if !ok {
+		return nil, ErrBadTarget{semErrf(req.Spec,
+			"'drain' requires a target with an OCN")}
+	}
+
+	return &DrainDirective{Blamer: a.Blamer, Kind: kind,
+		TargetOcn: *t}, nil
+}
+
+// The properties that may qualify a 'watch'.
+var watchProps = map[string]attrCheck{
+	"since": checkOcnValue,
+}
+
+func analyzeWatch(kind Kind, req *RequestSyntax,
+	a *WatchActionSyntax) (Directive, error) {
+	target, err := analyzeTarget(req.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := target.(*TargetOcn); ok {
+		return nil, ErrBadTarget{semErrf(req.Spec,
+			"'watch' does not accept a target with an OCN; "+
+				"resume with 'since' instead")}
+	}
+
+	props, err := analyzeProps("'watch'", watchProps, a.WatchProps)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &WatchDirective{Blamer: a.Blamer, Kind: kind, Target: target}
+	if since, ok := props["since"]; ok {
+		d.Resume = true
+		d.Since, _ = strconv.ParseUint(since, 10, 64)
+	}
+
+	return d, nil
+}
+
+func analyzeHistory(kind Kind, req *RequestSyntax,
+	a *HistoryActionSyntax) (Directive, error) {
+	target, err := analyzeTarget(req.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := target.(*TargetOcn); ok {
+		return nil, ErrBadTarget{semErrf(req.Spec,
+			"'history' does not accept a target with an OCN")}
+	}
+
+	return &HistoryDirective{Blamer: a.Blamer, Kind: kind,
+		Target: target}, nil
+}
+
+func analyzeDump(kind Kind, req *RequestSyntax,
+	a *DumpActionSyntax) (Directive, error) {
+	target, err := analyzeTarget(req.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := target.(*TargetAll); !ok {
+		return nil, ErrBadTarget{semErrf(req.Spec,
+			"'dump' only accepts 'all' as a target")}
+	}
+
+	return &DumpDirective{Blamer: a.Blamer, Kind: kind}, nil
+}
+
+// The properties of a 'revert', all required.
+var revertProps = map[string]attrCheck{
+	"to": checkOcnValue,
+}
+
+func analyzeRevert(kind Kind, req *RequestSyntax,
+	a *RevertActionSyntax) (Directive, error) {
+	target, err := analyzeTarget(req.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := target.(*TargetOcn)
+	if !ok {
+		return nil, ErrBadTarget{semErrf(req.Spec,
+			"'revert' requires a target with an OCN")}
+	}
+
+	props, err := analyzeProps("'revert'", revertProps, a.RevertProps)
+	if err != nil {
+		return nil, err
+	}
+
+	to, ok := props["to"]
+	if !ok {
+		return nil, semErrf(a, "'revert' requires 'to', the OCN "+
+			"of the version to revert to")
+	}
+
+	d := &RevertDirective{Blamer: a.Blamer, Kind: kind, TargetOcn: *t}
+	d.To, _ = strconv.ParseUint(to, 10, 64)
+	if d.To >= d.Ocn {
+		return nil, semErrf(a, "Can only revert to an earlier "+
+			"version than OCN %v", d.Ocn)
+	}
+
+	return d, nil
+}
+
+// Only the changes that could be made in a transaction can be
+// explained, for now.
+func analyzeExplain(kind Kind, req *RequestSyntax,
+	a *ExplainActionSyntax) (Directive, error) {
+	tok := a.Action.(Blamer).Blame()
+	switch tok.Lexeme {
+	case "create", "patch", "delete":
+	default:
+		return nil, semErrf(tok, "Cannot explain '%v': expected "+
+			"'create', 'patch' or 'delete'", tok.Lexeme)
+	}
+
+	d, err := Analyze(&RequestSyntax{Kind: req.Kind, Spec: req.Spec,
+		Action: a.Action})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExplainDirective{Blamer: a.Blamer, Directive: d}, nil
+}
+
+func checkOcnValue(val string) (string, error) {
+	ocn, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("expected an OCN")
+	}
+
+	return strconv.FormatUint(ocn, 10), nil
+}
+
+// Sessions are identified by the number dog gives each.
+func checkSessionId(kind Kind, target Target) error {
+	t, ok := target.(*TargetOne)
+	if !ok || kind != SessionKind {
+		return nil
+	}
+
+	if _, err := strconv.ParseUint(t.What, 10, 64); err != nil {
+		return semErrf(t, "Invalid session id %q", t.What)
+	}
+
+	return nil
+}
+
+// Convert the syntax of a target specification into its semantic
+// counterpart, interpreting the quoted identifier and OCN.
+func analyzeTarget(spec SpecSyntax) (Target, error) {
+	switch s := spec.(type) {
+	case *TargetAllSpecSyntax:
+		return &TargetAll{Blamer: s.Target}, nil
+	case *TargetOneSpecSyntax:
+		return &TargetOne{Blamer: s.What,
+			What: stripStr(s.What.Lexeme)}, nil
+	case *TargetOcnSpecSyntax:
+		ocn, err := strconv.ParseUint(s.Ocn.Lexeme, 0, 64)
+		if err != nil {
+			return nil, semErrf(s.Ocn, "Invalid OCN %v",
+				s.Ocn.Lexeme)
+		}
+
+		var out TargetOcn
+		out.Blamer = s.What
+		out.What = stripStr(s.What.Lexeme)
+		out.Ocn = ocn
+		return &out, nil
+	}
+
+	panic(fmt.Errorf("Attempting to semantically analyze "+
+		"un-enumerated target type %T", spec))
+}
+
+// Check property keys and values against those allowed for the kind
+// of object being targeted, producing a mapping from attribute name
+// to canonicalized value.
+func analyzeAttrs(kind Kind, props map[*Token]*Token) (
+	map[string]string, error) {
+	return analyzeProps(string(kind), kindAttrs[kind], props)
+}
+
+// Check properties against those allowed for what is described,
+// e.g. a kind of object.
+func analyzeProps(what string, allowed map[string]attrCheck,
+	props map[*Token]*Token) (map[string]string, error) {
+	// Visit the properties in the order they were written, so the
+	// first of any duplicated keys is not the one blamed.
+	keys := make([]*Token, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Sort(byOffset(keys))
+
+	attrs := make(map[string]string)
+	for _, k := range keys {
+		check, ok := allowed[k.Lexeme]
+		if !ok {
+			names := make([]string, 0, len(allowed))
+			for name := range allowed {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			return nil, semErrf(k, "Unknown key '%v' for %v: "+
+				"expected %v", k.Lexeme, what, quoteList(names))
+		}
+
+		if _, present := attrs[k.Lexeme]; present {
+			return nil, semErrf(k, "Duplicate key '%v'", k.Lexeme)
+		}
+
+		v := props[k]
+		val, err := check(stripStr(v.Lexeme))
+		if err != nil {
+			return nil, semErrf(v, "Bad value for '%v': %v",
+				k.Lexeme, err)
+		}
+
+		attrs[k.Lexeme] = val
+	}
+
+	return attrs, nil
+}
+
+// Sorts tokens by their position in the source.
+type byOffset []*Token
+
+func (t byOffset) Len() int           { return len(t) }
+func (t byOffset) Less(i, j int) bool { return t[i].Pos.Offset < t[j].Pos.Offset }
+func (t byOffset) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
@@ -155,3 +155,218 @@ func TestSemQuoting(t *testing.T) {
 	semRegressFail(t, "quoting",
 		`[route '!xp' @ 5 [patch [dbnameIn='x'',"',lock='true']]]`)
 }
+
+func TestSemCreateRule(t *testing.T) {
+	semRegressFail(t, "create_rule",
+		`[rule 'office' [create [order='10', type='hostssl',
+		    address='10.1.2.3/8', database='all', user='all',
+		    method='allow']]]`)
+}
+
+func TestSemPatchNoOcn(t *testing.T) {
+	// Patching without an OCN is a race, and hence forbidden
+	semRegressFail(t, "patch_no_ocn",
+		`[route 'bar' [patch [addr='123.123.123.125:5445']]]`)
+}
+
+func TestSemDeleteNoOcn(t *testing.T) {
+	semRegressFail(t, "delete_no_ocn", `[route 'bar' [delete]]`)
+}
+
+func TestSemBadAttrs(t *testing.T) {
+	// Keys valid for routes are not valid for rules
+	semRegressFail(t, "unknown_key",
+		`[rule 'r' [create [type='local', method='allow', addr='x']]]`)
+
+	semRegressFail(t, "duplicate_key",
+		`[route 'bar' @ 1 [patch [addr='a:1', addr='b:2']]]`)
+
+	semRegressFail(t, "bad_value",
+		`[rule 'r' @ 3 [patch [method='trust']]]`)
+
+	semRegressFail(t, "missing_required",
+		`[rule 'r' [create [type='local']]]`)
+}
+
+func TestSemBackend(t *testing.T) {
+	semRegressFail(t, "create_backend",
+		`[backend '10.0.0.1:5432' [create [maxConnections='20']]]`)
+
+	semRegressFail(t, "negative_limit",
+		`[route 'bar' @ 3 [patch [maxConnections='-1']]]`)
+}
+
+func TestSemTimeouts(t *testing.T) {
+	semRegressFail(t, "timeouts",
+		`[route 'bar' @ 3 [patch [dialTimeout='1500ms',
+		    idleTimeout='0', idleInTransactionTimeout='1h']]]`)
+
+	semRegressFail(t, "bad_timeout",
+		`[route 'bar' @ 3 [patch [authTimeout='soon']]]`)
+
+	semRegressFail(t, "timeout_inherit",
+		`[route 'bar' @ 4 [patch [idleTimeout='', dialTimeout='0']]]`)
+}
+
+func TestSemProxyProtocol(t *testing.T) {
+	semRegressFail(t, "proxy_protocol",
+		`[route 'bar' @ 3 [patch [proxyProtocol='v2']]]`)
+
+	semRegressFail(t, "bad_proxy_protocol",
+		`[route 'bar' @ 3 [patch [proxyProtocol='v3']]]`)
+}
+
+func TestSemListener(t *testing.T) {
+	semRegressFail(t, "create_listener",
+		`[listener 'public' [create [addr='0.0.0.0:5432',
+		    tls='require', tlsCert='server.crt', tlsKey='server.key',
+		    proxyProtocol='on']]]`)
+
+	semRegressFail(t, "listener_no_addr",
+		`[listener 'public' [create [tls='allow']]]`)
+}
+
+func TestSemSplitReads(t *testing.T) {
+	semRegressFail(t, "split_reads",
+		`[route 'bar' @ 3 [patch [splitReads='yes',
+		    replicas='10.0.0.2:5432,10.0.0.3:5432',
+		    readOnlyUsers='reporting']]]`)
+
+	semRegressFail(t, "split_reads_off",
+		`[route 'bar' @ 4 [patch [splitReads='off']]]`)
+
+	semRegressFail(t, "read_only_users_off",
+		`[route 'bar' @ 4 [patch [readOnlyUsers='']]]`)
+}
+
+func TestSemMaxLag(t *testing.T) {
+	semRegressFail(t, "max_lag",
+		`[route 'bar' @ 3 [patch [maxLag='90s']]]`)
+
+	semRegressFail(t, "bad_max_lag",
+		`[route 'bar' @ 3 [patch [maxLag='-5s']]]`)
+
+	semRegressFail(t, "max_lag_unset",
+		`[route 'bar' @ 4 [patch [maxLag='']]]`)
+
+	semRegressFail(t, "replicas_unset",
+		`[route 'bar' @ 4 [patch [replicas='']]]`)
+}
+
+func TestSemDiscovery(t *testing.T) {
+	semRegressFail(t, "discovery",
+		`[route 'bar' [create [addr='db1:5432',
+		    hosts='db1:5432,db2:5432,db3:5432', role='primary']]]`)
+
+	semRegressFail(t, "bad_role",
+		`[route 'bar' @ 3 [patch [role='leader']]]`)
+
+	semRegressFail(t, "discovery_off",
+		`[route 'bar' @ 4 [patch [hosts='']]]`)
+}
+
+func TestSemMirror(t *testing.T) {
+	semRegressFail(t, "mirror",
+		`[route 'bar' @ 3 [patch [mirror='db-next:5432',
+		    mirrorSelectsOnly='on']]]`)
+
+	semRegressFail(t, "mirror_off",
+		`[route 'bar' @ 4 [patch [mirror='']]]`)
+}
+
+func TestSemCanary(t *testing.T) {
+	semRegressFail(t, "canary",
+		`[route 'bar' @ 3 [patch [canary='db-new:5432',
+		    canaryPercent='2.50', canarySticky='user']]]`)
+
+	semRegressFail(t, "bad_canary_percent",
+		`[route 'bar' @ 3 [patch [canaryPercent='110']]]`)
+
+	semRegressFail(t, "canary_off",
+		`[route 'bar' @ 4 [patch [canary='']]]`)
+}
+
+func TestSemTerminate(t *testing.T) {
+	semRegressFail(t, "terminate_route", `[route 'bar' [terminate]]`)
+	semRegressFail(t, "terminate_session", `[session '42' [terminate]]`)
+	semRegressFail(t, "terminate_at",
+		`[route 'bar' @ 3 [terminate]]`)
+	semRegressFail(t, "bad_session_id", `[session 'bar' [terminate]]`)
+	semRegressFail(t, "patch_session",
+		`[session '42' @ 3 [patch [addr='x']]]`)
+}
+
+func TestSemDrain(t *testing.T) {
+	semRegressFail(t, "drain_route", `[route 'bar' @ 7 [drain]]`)
+	semRegressFail(t, "drain_no_ocn", `[route 'bar' [drain]]`)
+	semRegressFail(t, "drain_rule", `[rule 'office' @ 7 [drain]]`)
+}
+
+func TestSemGetSession(t *testing.T) {
+	semRegressFail(t, "get_session", `[session '42' [get]]`)
+	semRegressFail(t, "get_all_sessions", `[session all [get]]`)
+	semRegressFail(t, "get_session_bad_id", `[session '-1' [get]]`)
+}
+
+func TestSemWatch(t *testing.T) {
+	semRegressFail(t, "watch_all", `[route all [watch]]`)
+	semRegressFail(t, "watch_since",
+		`[route 'bar' [watch [since='12']]]`)
+	semRegressFail(t, "watch_at", `[route 'bar' @ 12 [watch]]`)
+	semRegressFail(t, "watch_bad_since",
+		`[route all [watch [since='soon']]]`)
+	semRegressFail(t, "watch_bad_key",
+		`[route all [watch [until='12']]]`)
+	semRegressFail(t, "watch_rule", `[rule all [watch]]`)
+}
+
+func TestSemTransaction(t *testing.T) {
+	semRegressFail(t, "transaction",
+		`[begin [route 'a' @ 5 [patch [addr='h2:5432']]]
+		    [route 'b' [create [addr='h1:5432']]] commit]`)
+
+	semRegressFail(t, "empty_transaction", `[begin commit]`)
+
+	semRegressFail(t, "transaction_bad_member",
+		`[begin [route 'a' @ 5 [patch [addr='h2:5432']]]
+		    [route 'b' [patch [addr='h1:5432']]] commit]`)
+
+	semRegressFail(t, "transaction_get",
+		`[begin [route all [get]] commit]`)
+
+	semRegressFail(t, "transaction_rule",
+		`[begin [rule 'r' @ 3 [delete]] commit]`)
+}
+
+func TestSemHistory(t *testing.T) {
+	semRegressFail(t, "history", `[route 'bar' [history]]`)
+	semRegressFail(t, "history_at", `[route 'bar' @ 4 [history]]`)
+	semRegressFail(t, "revert", `[route 'bar' @ 9 [revert [to='5']]]`)
+	semRegressFail(t, "revert_no_ocn", `[route 'bar' [revert [to='5']]]`)
+	semRegressFail(t, "revert_no_to", `[route 'bar' @ 9 [revert []]]`)
+	semRegressFail(t, "revert_later",
+		`[route 'bar' @ 9 [revert [to='9']]]`)
+}
+
+func TestSemExplain(t *testing.T) {
+	semRegressFail(t, "explain_patch",
+		`[route 'bar' @ 5 [explain [patch [lock='t']]]]`)
+	semRegressFail(t, "explain_delete_all",
+		`[route all [explain [delete]]]`)
+	semRegressFail(t, "explain_no_ocn",
+		`[route 'bar' [explain [patch [lock='t']]]]`)
+	semRegressFail(t, "explain_bad_attr",
+		`[route 'bar' @ 5 [explain [patch [lock='maybe']]]]`)
+	semRegressFail(t, "explain_drain",
+		`[route 'bar' @ 5 [explain [drain]]]`)
+	semRegressFail(t, "explain_explain",
+		`[route 'bar' @ 5 [explain [explain [delete]]]]`)
+	semRegressFail(t, "explain_rule",
+		`[rule 'office' @ 5 [explain [delete]]]`)
+}
+
+func TestSemDump(t *testing.T) {
+	semRegressFail(t, "dump", `[route all [dump]]`)
+	semRegressFail(t, "dump_one", `[route 'bar' [dump]]`)
+	semRegressFail(t, "dump_rule", `[rule all [dump]]`)
+}
@@ -3,13 +3,30 @@
 // For mechanics, see sem.go
 package dogconf
 
+// The kind of object a directive operates upon, as named by the
+// first identifier of a request.
+type Kind string
+
+const (
+	RouteKind    Kind = "route"
+	RuleKind     Kind = "rule"
+	BackendKind  Kind = "backend"
+	ListenerKind Kind = "listener"
+
+	// Sessions are not configured, but are reported and may be
+	// ended, identified by the number dog gives each.
+	SessionKind Kind = "session"
+)
+
 // Union of types that describe a kind of target for an action
 type Target interface {
 	Blamer
 }
 
 // Targets everything.  Useful with delete and get.
-type TargetAll TargetAllSpecSyntax
+type TargetAll struct {
+	Blamer
+}
 
 // Targets a specific record, regardless of OCN -- hence, subject to
 // race conditions.
@@ -22,37 +39,117 @@ type TargetOne struct {
 // version, as to be able to raise optimistic concurrency violations
 // when there is a version/ocn mismatch.
 type TargetOcn struct {
-	Blamer
 	TargetOne
 	Ocn uint64
 }
 
 // Toplevel emission from semantic analysis: a single semantically
 // analyzed action to be interpreted by the executor.
+//
+// Every directive blames the token of its action, e.g. 'patch'.
 type Directive interface {
 	Blamer
 }
 
 type PatchDirective struct {
 	Blamer
+	Kind Kind
 	TargetOcn
-	Attrs map[*Token]Token
+
+	// Attributes to be changed, already checked for validity.
+	// Those with empty values are to be unset.
+	Attrs map[string]string
 }
 
 type CreateDirective struct {
+	Blamer
+	Kind Kind
 	TargetOne
-	Attrs map[*Token]Token
+
+	// Attributes of the new record, already checked for validity.
+	Attrs map[string]string
 }
 
 type DeleteDirective struct {
+	Blamer
+	Kind Kind
+
 	// Only valid targets for delete: 'all' and targets with ocn.
-	Target
+	Target Target
 }
 
 type GetDirective struct {
+	Blamer
+	Kind Kind
+
 	// Only valid targets for get: 'all' and targets without ocn
-	Target
+	Target Target
+}
+
+type TerminateDirective struct {
+	Blamer
+	Kind Kind
+
+	// Only valid targets for terminate: 'all' and targets without
+	// ocn.  Terminating 'all' of a route ends the sessions of every
+	// route.
+	Target Target
+}
+
+type DrainDirective struct {
+	Blamer
+	Kind Kind
+	TargetOcn
 }
 
-type AttrChange struct {
+type WatchDirective struct {
+	Blamer
+	Kind Kind
+
+	// Only valid targets for watch: 'all' and targets without ocn
+	Target Target
+
+	// Whether to resume after the change with OCN Since, rather
+	// than start from the current state
+	Resume bool
+	Since  uint64
+}
+
+// Directives to be applied together or not at all.  Blames the
+// 'begin' token.
+type TransactionDirective struct {
+	Blamer
+	Directives []Directive
+}
+
+type HistoryDirective struct {
+	Blamer
+	Kind Kind
+
+	// Only valid targets for history: 'all' and targets without
+	// ocn
+	Target Target
+}
+
+// Every object of a kind, as one consistent whole, and only as far
+// as it could be created again: the only valid target is 'all'.
+type DumpDirective struct {
+	Blamer
+	Kind Kind
+}
+
+type RevertDirective struct {
+	Blamer
+	Kind Kind
+	TargetOcn
+
+	// The OCN of the earlier version to put back
+	To uint64
+}
+
+// A change to be worked out against the objects as they are, and
+// reported, rather than made.  Blames the 'explain' token.
+type ExplainDirective struct {
+	Blamer
+	Directive Directive
 }
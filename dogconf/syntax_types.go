@@ -2,10 +2,18 @@ package dogconf
 
 // Toplevel production of the AST
 type RequestSyntax struct {
+	// Kind of object targeted, like "route" or "rule"
+	Kind *Token
+
 	Spec SpecSyntax
 
 	// Action like "get", "delete", et al
 	Action ActionSyntax
+
+	// Set instead of the above for a transaction: the 'begin'
+	// token, and the requests to be applied together
+	Begin    *Token
+	Requests []*RequestSyntax
 }
 
 // Unifies the types for all forms of specifying the target of an
@@ -35,7 +43,7 @@ type TargetOcnSpecSyntax struct {
 }
 
 // Unifies the types for all "actions", e.g. get, create, patch,
-// delete
+// delete, terminate
 type ActionSyntax interface{}
 
 type PatchActionSyntax struct {
@@ -65,3 +73,52 @@ type DeleteActionSyntax struct {
 	// To hold token information for error reporting.
 	DeleteToken *Token
 }
+
+type TerminateActionSyntax struct {
+	Blamer
+
+	// To hold token information for error reporting.
+	TerminateToken *Token
+}
+
+type DrainActionSyntax struct {
+	Blamer
+
+	// To hold token information for error reporting.
+	DrainToken *Token
+}
+
+type WatchActionSyntax struct {
+	Blamer
+
+	// Properties qualifying the watch, or nil if none were given.
+	WatchProps map[*Token]*Token
+}
+
+type HistoryActionSyntax struct {
+	Blamer
+
+	// To hold token information for error reporting.
+	HistoryToken *Token
+}
+
+type DumpActionSyntax struct {
+	Blamer
+
+	// To hold token information for error reporting.
+	DumpToken *Token
+}
+
+type RevertActionSyntax struct {
+	Blamer
+
+	// Properties naming the version to revert to.
+	RevertProps map[*Token]*Token
+}
+
+type ExplainActionSyntax struct {
+	Blamer
+
+	// The action to be explained rather than taken.
+	Action ActionSyntax
+}
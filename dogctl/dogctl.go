@@ -0,0 +1,321 @@
+// A command-line client for dog's administrative address.
+//
+// Given a request as arguments, dogctl sends it and prints the reply:
+//
+//	dogctl -addr /run/dog/admin.sock '[route all [get]]'
+//
+// Given -f, it sends each request in a script file in turn, stopping at
+// the first to fail.  Given neither, it reads requests interactively,
+// continuing a request over as many lines as its brackets are open.
+//
+// The routes are written out by 'dump' as the requests that would create
+// them again, e.g. to be kept as a configuration for dog -config:
+//
+//	dogctl '[route all [dump]]' > routes.dogconf
+//
+// The exit status tells how a request failed, for scripts to act on:
+// 2 if it could not be parsed, 3 if it made no sense, 4 if its OCN was
+// stale, 5 if dog could not be reached, and 1 for anything else.
+package main
+
+import (
+	"../dogconf"
+	"../dogconf/client"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+const (
+	exitFailed     = 1
+	exitSyntax     = 2
+	exitSemantic   = 3
+	exitConflict   = 4
+	exitConnection = 5
+	exitUsage      = 64
+)
+
+// A request could not be parsed locally.
+type syntaxError struct {
+	error
+}
+
+// The exit status for an error in running a request.
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *syntaxError:
+		return exitSyntax
+	case *client.ConflictError:
+		return exitConflict
+	case *client.Error:
+		switch e.Code {
+		case dogconf.ErrCodeSyntax:
+			return exitSyntax
+		case dogconf.ErrCodeSemantic:
+			return exitSemantic
+		}
+
+		return exitFailed
+	}
+
+	// Anything else is the connection failing.
+	return exitConnection
+}
+
+type ctl struct {
+	c   *client.Client
+	out io.Writer
+
+	// Print replies as dogconf records rather than tables
+	raw bool
+}
+
+// Run each request in text, stopping at the first to fail.
+func (ct *ctl) runText(name, text string) error {
+	p := dogconf.NewParser(name, strings.NewReader(text))
+	for {
+		req, err := p.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return &syntaxError{err}
+		}
+
+		if err := ct.run(req, p.Text()); err != nil {
+			return err
+		}
+	}
+}
+
+// Run one request, given both parsed and as text, printing its reply.
+func (ct *ctl) run(req *dogconf.RequestSyntax, text string) error {
+	// Watches are followed until the connection ends.  Anything
+	// else, including requests that do not analyze, is left to
+	// dog to answer.
+	d, _ := dogconf.Analyze(req)
+	if w, ok := d.(*dogconf.WatchDirective); ok {
+		return ct.watch(w)
+	}
+
+	recs, err := ct.c.Do(text)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := d.(*dogconf.DumpDirective); ok {
+		for _, rec := range recs {
+			fmt.Fprintln(ct.out, rec.Status["create"])
+		}
+
+		return nil
+	}
+
+	if ct.raw {
+		for _, rec := range recs {
+			fmt.Fprintln(ct.out, rec)
+		}
+
+		return nil
+	}
+
+	writeTable(ct.out, recs)
+	return nil
+}
+
+// Follow a watch, printing each change as it is told of, until the
+// watch is cut off or interrupted.
+func (ct *ctl) watch(d *dogconf.WatchDirective) error {
+	var id string
+	if t, ok := d.Target.(*dogconf.TargetOne); ok {
+		id = t.What
+	}
+
+	var since uint64
+	if d.Resume {
+		since = d.Since
+	}
+
+	w, err := ct.c.Watch(id, since)
+	if err != nil {
+		return err
+	}
+
+	defer w.Close()
+
+	// Interrupting a watch ends it, rather than dogctl.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	interrupted := make(chan struct{})
+	go func() {
+		select {
+		case <-sigs:
+			close(interrupted)
+			w.Close()
+		case <-stop:
+		}
+	}()
+
+	if ct.raw {
+		for _, rec := range w.Records {
+			fmt.Fprintln(ct.out, rec)
+		}
+	} else if since == 0 {
+		writeTable(ct.out, w.Records)
+	}
+
+	for {
+		ch, err := w.Next()
+		select {
+		case <-interrupted:
+			return nil
+		default:
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if ch.Record == nil {
+			fmt.Fprintf(ct.out, "%v @ %v\n", ch.Op, ch.Ocn)
+		} else {
+			fmt.Fprintf(ct.out, "%v %v\n", ch.Op, ch.Record)
+		}
+	}
+}
+
+// The TLS configuration asked for, if any.
+func tlsConfig(ca, cert, key string) (*tls.Config, error) {
+	if ca == "" && cert == "" {
+		return nil, nil
+	}
+
+	conf := &tls.Config{}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %v", ca)
+		}
+	}
+
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.Certificates = []tls.Certificate{pair}
+	}
+
+	return conf, nil
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("dogctl: ")
+
+	addr := flag.String("addr", os.Getenv("DOG_ADMIN"),
+		"dog's administrative address: a unix socket path, or "+
+			"host:port (default $DOG_ADMIN)")
+	token := flag.String("token", os.Getenv("DOG_TOKEN"),
+		"bearer token to authenticate with (default $DOG_TOKEN)")
+	tlsCA := flag.String("tls-ca", "",
+		"connect over TLS, verifying dog against this CA")
+	tlsCert := flag.String("tls-cert", "",
+		"client certificate to authenticate with over TLS")
+	tlsKey := flag.String("tls-key", "",
+		"key of the client certificate")
+	tlsName := flag.String("tls-name", "",
+		"name to expect in dog's certificate, if not its host")
+	script := flag.String("f", "",
+		"run the requests in this file, or - for standard input")
+	raw := flag.Bool("raw", false,
+		"print replies as dogconf records rather than tables")
+	flag.Usage = func() {
+		log.Printf("Usage: dogctl [flags] [REQUEST]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *addr == "" || (*script != "" && flag.NArg() > 0) {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	conf := &client.Config{Token: *token}
+
+	var err error
+	conf.TLS, err = tlsConfig(*tlsCA, *tlsCert, *tlsKey)
+	if err != nil {
+		log.Printf("Could not set up TLS: %v", err)
+		os.Exit(exitUsage)
+	}
+
+	if conf.TLS != nil {
+		conf.TLS.ServerName = *tlsName
+	}
+
+	network := "tcp"
+	if strings.Contains(*addr, "/") {
+		network = "unix"
+	}
+
+	if conf.TLS != nil && conf.TLS.ServerName == "" && network == "tcp" {
+		conf.TLS.ServerName, _, _ = net.SplitHostPort(*addr)
+	}
+
+	c, err := client.Dial(network, *addr, conf)
+	if err != nil {
+		log.Printf("Could not connect to dog: %v", err)
+		os.Exit(exitConnection)
+	}
+
+	defer c.Close()
+
+	ct := &ctl{c: c, out: os.Stdout, raw: *raw}
+	switch {
+	case flag.NArg() > 0:
+		err = ct.runText("", strings.Join(flag.Args(), " "))
+	case *script != "":
+		var text []byte
+		if *script == "-" {
+			text, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			text, err = ioutil.ReadFile(*script)
+		}
+
+		if err != nil {
+			log.Printf("Could not read script: %v", err)
+			os.Exit(exitUsage)
+		}
+
+		err = ct.runText(*script, string(text))
+	default:
+		err = ct.repl()
+	}
+
+	if err != nil {
+		log.Print(err)
+		c.Close()
+		os.Exit(exitCode(err))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"../dogconf"
+	"../dogconf/client"
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestIncomplete(t *testing.T) {
+	for _, c := range []struct {
+		text       string
+		incomplete bool
+	}{
+		{"", false},
+		{"[route all [get]]", false},
+		{"[route all [get]", true},
+		{"[route 'x'\n  [get]", true},
+		{"[route 'x' [create [addr='a:1']]]", false},
+		{"[route 'x' [create [addr='a:1", true},
+		{"[route 'x' [create [dbnameIn=']]]", true},
+		{"[route 'x' [create [dbnameIn=']]]']]]", false},
+		{"[route 'it''s' [get]]", false},
+		{"[begin [route 'x' @ 1 [delete]]", true},
+		{"[begin [route 'x' @ 1 [delete]] commit]", false},
+	} {
+		if got := incomplete(c.text); got != c.incomplete {
+			t.Errorf("incomplete(%q) = %v, expected %v",
+				c.text, got, c.incomplete)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{&syntaxError{errors.New("bad")}, exitSyntax},
+		{&client.Error{Code: dogconf.ErrCodeSyntax}, exitSyntax},
+		{&client.Error{Code: dogconf.ErrCodeSemantic}, exitSemantic},
+		{&client.ConflictError{}, exitConflict},
+		{&client.Error{Code: dogconf.ErrCodeNotFound}, exitFailed},
+		{&client.Error{Code: dogconf.ErrCodeDenied}, exitFailed},
+		{errors.New("connection reset"), exitConnection},
+	} {
+		if got := exitCode(c.err); got != c.code {
+			t.Errorf("exitCode(%#v) = %v, expected %v",
+				c.err, got, c.code)
+		}
+	}
+
+	// The codes are documented, for scripts to rely on.
+	codes := []int{exitFailed, exitSyntax, exitSemantic, exitConflict,
+		exitConnection}
+	if !reflect.DeepEqual(codes, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("Exit codes changed to %v", codes)
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		recs     []*dogconf.Record
+		expected string
+	}{
+		{"empty", nil, "ok\n"},
+		{"routes", []*dogconf.Record{
+			{Kind: dogconf.RouteKind, Id: "a", Ocn: 3,
+				Attrs:  map[string]string{"lock": "f", "addr": "h:1"},
+				Status: map[string]string{"active": "2"}},
+			{Kind: dogconf.RouteKind, Id: "it's", Ocn: 12,
+				Attrs: map[string]string{"addr": "h:2",
+					"dbnameIn": "a b"}},
+		}, "" +
+			"ROUTE    OCN  addr  dbnameIn  lock  active\n" +
+			"a        3    h:1   ''        f     2\n" +
+			"'it''s'  12   h:2   'a b'     ''    ''\n"},
+		{"mixed", []*dogconf.Record{
+			{Kind: dogconf.RouteKind, Id: "a", Ocn: 3,
+				Attrs: map[string]string{"addr": "h:1"}},
+			{Kind: dogconf.BackendKind, Id: "h:1",
+				Attrs: map[string]string{"maxConnections": "5"}},
+		}, "" +
+			"KIND     ID   OCN  addr  maxConnections\n" +
+			"route    a    3    h:1   ''\n" +
+			"backend  h:1       ''    5\n"},
+	} {
+		var buf bytes.Buffer
+		writeTable(&buf, c.recs)
+		if buf.String() != c.expected {
+			t.Errorf("%v: expected\n%v\ngot\n%v", c.name,
+				c.expected, buf.String())
+		}
+	}
+}
+
+func TestHistoryEntry(t *testing.T) {
+	for _, c := range [][2]string{
+		{"[route all [get]]", "[route all [get]]"},
+		{"  [route   'x'\n\t[get]]\n", "[route 'x' [get]]"},
+		{"[route 'x' @ 1 [patch [dbnameIn='a  b']]]",
+			"[route 'x' @ 1 [patch [dbnameIn='a  b']]]"},
+		{"[route 'it''s  x'\n  [patch [dbnameIn='a\tb',  lock='t']]]",
+			"[route 'it''s  x' [patch [dbnameIn='a\tb', lock='t']]]"},
+	} {
+		if got := historyEntry(c[0]); got != c[1] {
+			t.Errorf("historyEntry(%q) = %q, expected %q",
+				c[0], got, c[1])
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	for _, c := range []struct {
+		text  string
+		word  string
+		cands []string
+	}{
+		{"[ro", "ro", []string{"route "}},
+		{"[route 'x' [ge", "ge", []string{"get "}},
+		{"[route 'x' @ 1 [patch [lo", "lo", []string{"lock="}},
+		{"[route 'x' @ 1 [explain [pa", "pa", []string{"patch "}},
+		{"[begin [route 'x' @ 1 [de", "de", []string{"delete "}},
+		{"[route 'x' [create [addr='lo", "lo", nil},
+	} {
+		word, cands := complete(c.text)
+		if word != c.word || !reflect.DeepEqual(cands, c.cands) {
+			t.Errorf("complete(%q) = %q, %q; expected %q, %q",
+				c.text, word, cands, c.word, c.cands)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"../dogconf"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Entries kept in the history file beyond this are forgotten.
+const historyMax = 1000
+
+const replHelp = `Enter dogconf requests, e.g.
+
+	[route all [get]]
+	[route 'x' @ 3 [patch [addr='127.0.0.1:5432']]]
+
+A request continues over as many lines as its brackets are open.  Tab
+completes kinds, actions and attribute names; ^C abandons a request, or
+stops a watch.  'quit' or ^D leaves.
+`
+
+// Read requests interactively and run them, until the input ends.
+// Failed requests are reported and the next one read, unless the
+// connection to dog is lost.
+func (ct *ctl) repl() error {
+	ed := newLineEditor(os.Stdin, os.Stdout)
+
+	histFile := os.Getenv("HOME")
+	if histFile != "" {
+		histFile = filepath.Join(histFile, ".dogctl_history")
+	}
+
+	if ed.tty {
+		loadHistory(ed, histFile)
+		fmt.Fprintln(ct.out, "Type 'help' for help.")
+	}
+
+	// Lines of a request that has yet to be closed
+	var lines []string
+	ed.complete = func(before string) (string, []string) {
+		return complete(strings.Join(append(lines, before), "\n"))
+	}
+
+	for {
+		prompt := "dog> "
+		if len(lines) > 0 {
+			prompt = "...> "
+		}
+
+		line, err := ed.readLine(prompt)
+		if err == errInterrupt {
+			lines = nil
+			continue
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if len(lines) == 0 {
+			switch strings.TrimSpace(line) {
+			case "":
+				continue
+			case "quit", "exit":
+				return nil
+			case "help":
+				fmt.Fprint(ct.out, replHelp)
+				continue
+			}
+		}
+
+		lines = append(lines, line)
+		text := strings.Join(lines, "\n")
+		if incomplete(text) {
+			continue
+		}
+
+		lines = nil
+		if ed.tty {
+			// The file holds an entry a line, so cannot
+			// keep those with newlines in literals.
+			entry := historyEntry(text)
+			if ed.addHistory(entry) &&
+				!strings.Contains(entry, "\n") {
+				saveHistory(histFile, entry)
+			}
+		}
+
+		err = ct.runText("", text)
+		if exitCode(err) == exitConnection {
+			return err
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+}
+
+// Whether text ends within a request, with brackets or a string still
+// open.
+func incomplete(text string) bool {
+	var open bool
+
+	var s dogconf.Scanner
+	s.Init(strings.NewReader(text))
+	s.Error = func(*dogconf.Scanner, string) {
+		// Only an unterminated string is an error to the
+		// Scanner.
+		open = true
+	}
+
+	depth := 0
+	for tok := s.Scan(); tok.Type != dogconf.EOF; tok = s.Scan() {
+		switch tok.Type {
+		case dogconf.LBrace:
+			depth++
+		case dogconf.RBrace:
+			depth--
+		}
+	}
+
+	return open || depth > 0
+}
+
+// A request as kept in the history, on one line: runs of whitespace
+// are reduced to a space, except within string literals, which are
+// kept as typed.
+func historyEntry(text string) string {
+	var out []rune
+	var quoted, space bool
+	for _, ch := range strings.TrimSpace(text) {
+		switch {
+		case ch == '\'':
+			quoted = !quoted
+		case !quoted && dogconf.IsWhitespace(ch):
+			space = true
+			continue
+		}
+
+		if space {
+			out = append(out, ' ')
+			space = false
+		}
+
+		out = append(out, ch)
+	}
+
+	return string(out)
+}
+
+// The word before the end of text, and the words that could complete
+// it where it stands in a request: a kind after the opening bracket,
+// an action after the target, or after 'explain', and attribute names
+// in the attributes given to create or patch.
+func complete(text string) (string, []string) {
+	end := len(text)
+	start := strings.LastIndexFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}) + 1
+	word := text[start:end]
+
+	var s dogconf.Scanner
+	s.Init(strings.NewReader(text[:start]))
+
+	var inString bool
+	s.Error = func(*dogconf.Scanner, string) {
+		inString = true
+	}
+
+	var (
+		depth  int
+		inTx   bool
+		kind   dogconf.Kind
+		action string
+		prev   dogconf.TokenType
+
+		// Whether the action is within an 'explain'
+		explained bool
+	)
+
+	for tok := s.Scan(); tok.Type != dogconf.EOF; tok = s.Scan() {
+		switch tok.Type {
+		case dogconf.LBrace:
+			depth++
+		case dogconf.RBrace:
+			depth--
+		case dogconf.Ident:
+			if prev != dogconf.LBrace {
+				break
+			}
+
+			switch {
+			case depth == 1:
+				inTx = tok.Lexeme == "begin"
+				kind, action = dogconf.Kind(tok.Lexeme), ""
+			case depth == 2 && inTx:
+				kind, action = dogconf.Kind(tok.Lexeme), ""
+			case depth == 2, depth == 3 && inTx:
+				action = tok.Lexeme
+			case depth == 3 && action == "explain":
+				// The change explained stands in for it.
+				action = tok.Lexeme
+				explained = true
+			}
+		}
+
+		prev = tok.Type
+	}
+
+	if inString {
+		return word, nil
+	}
+
+	reqDepth := depth
+	if inTx || explained {
+		reqDepth--
+	}
+
+	var cands []string
+	switch {
+	case prev == dogconf.LBrace && reqDepth == 1:
+		for _, k := range dogconf.Kinds() {
+			cands = append(cands, string(k)+" ")
+		}
+
+		if depth == 1 {
+			cands = append(cands, "begin ")
+		}
+	case prev == dogconf.LBrace && reqDepth == 2:
+		for _, a := range dogconf.Actions(kind) {
+			cands = append(cands, a+" ")
+		}
+	case prev == dogconf.LBrace && reqDepth == 3 && action == "explain":
+		cands = []string{"create ", "patch ", "delete "}
+	case (prev == dogconf.LBrace || prev == dogconf.Comma) &&
+		reqDepth == 3 && (action == "create" || action == "patch"):
+		for _, a := range dogconf.Attributes(kind) {
+			cands = append(cands, a+"=")
+		}
+	case prev == dogconf.RBrace && inTx && depth == 1:
+		cands = append(cands, "commit")
+	}
+
+	var matches []string
+	for _, cand := range cands {
+		if strings.HasPrefix(cand, word) {
+			matches = append(matches, cand)
+		}
+	}
+
+	return word, matches
+}
+
+func loadHistory(ed *lineEditor, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		ed.addHistory(sc.Text())
+	}
+
+	n := len(ed.history)
+	if n <= historyMax {
+		return
+	}
+
+	// Trim the file, lest it grow without end.
+	ed.history = ed.history[n-historyMax:]
+	ioutil.WriteFile(path,
+		[]byte(strings.Join(ed.history, "\n")+"\n"), 0600)
+}
+
+func saveHistory(path, entry string) {
+	if path == "" {
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintln(f, entry)
+	f.Close()
+}
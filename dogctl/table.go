@@ -0,0 +1,99 @@
+package main
+
+import (
+	"../dogconf"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Write records as a table, one row each, with a column for every
+// attribute and status any of them has: attributes first, then status,
+// each in sorted order.  Records of several kinds are given a column
+// for their kind.
+func writeTable(w io.Writer, recs []*dogconf.Record) {
+	if len(recs) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	var mixed bool
+	attrs := make(map[string]bool)
+	status := make(map[string]bool)
+	for _, rec := range recs {
+		mixed = mixed || rec.Kind != recs[0].Kind
+		for k := range rec.Attrs {
+			attrs[k] = true
+		}
+
+		for k := range rec.Status {
+			status[k] = true
+		}
+	}
+
+	attrCols := sortedKeys(attrs)
+	statusCols := sortedKeys(status)
+
+	var head []string
+	if mixed {
+		head = append(head, "KIND")
+	}
+
+	head = append(head, strings.ToUpper(string(recs[0].Kind)), "OCN")
+	if mixed {
+		head[1] = "ID"
+	}
+
+	head = append(head, attrCols...)
+	head = append(head, statusCols...)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(head, "\t"))
+
+	for _, rec := range recs {
+		var row []string
+		if mixed {
+			row = append(row, string(rec.Kind))
+		}
+
+		ocn := ""
+		if rec.Ocn != 0 {
+			ocn = fmt.Sprint(rec.Ocn)
+		}
+
+		row = append(row, cell(rec.Id), ocn)
+		for _, k := range attrCols {
+			row = append(row, cell(rec.Attrs[k]))
+		}
+
+		for _, k := range statusCols {
+			row = append(row, cell(rec.Status[k]))
+		}
+
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	tw.Flush()
+}
+
+// A value as shown in a table: quoted, as in dogconf, if it would
+// otherwise be mistaken for something else or upset the columns.
+func cell(val string) string {
+	if val == "" || strings.ContainsAny(val, " \t\n'") {
+		return dogconf.QuoteStr(val)
+	}
+
+	return val
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The line being edited was abandoned with ^C.
+var errInterrupt = errors.New("interrupted")
+
+// Reads lines from a terminal with enough editing to be comfortable:
+// moving and deleting within the line, recalling earlier lines, and
+// completing words.  Lines are read plainly from anything other than a
+// terminal, without prompts, as they are on platforms without support
+// for terminals, see terminal_linux.go.
+type lineEditor struct {
+	in  *os.File
+	r   *bufio.Reader
+	out *os.File
+	tty bool
+
+	// Lines entered so far, oldest first
+	history []string
+
+	// The words that could complete the text before the cursor,
+	// and the part of that text they would replace.  Each may end
+	// with whatever should follow it, e.g. a space.
+	complete func(before string) (word string, cands []string)
+}
+
+func newLineEditor(in, out *os.File) *lineEditor {
+	return &lineEditor{
+		in:  in,
+		r:   bufio.NewReader(in),
+		out: out,
+		tty: isTerminal(in.Fd()),
+	}
+}
+
+// Add a line to the history, unless it is empty or repeats the last,
+// reporting whether it was.
+func (ed *lineEditor) addHistory(line string) bool {
+	n := len(ed.history)
+	if line == "" || (n > 0 && ed.history[n-1] == line) {
+		return false
+	}
+
+	ed.history = append(ed.history, line)
+	return true
+}
+
+// Read a line, without its newline.  Returns io.EOF at the end of
+// input, or, on a terminal, on ^D in an empty line; and errInterrupt
+// on ^C.
+func (ed *lineEditor) readLine(prompt string) (string, error) {
+	if !ed.tty {
+		line, err := ed.r.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	restore, err := makeRaw(ed.in.Fd())
+	if err != nil {
+		return "", err
+	}
+
+	defer restore()
+
+	e := &edit{ed: ed, prompt: prompt, hist: len(ed.history)}
+	e.refresh()
+	for {
+		ch, _, err := ed.r.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch ch {
+		case '\r', '\n':
+			ed.out.WriteString("\n")
+			return string(e.buf), nil
+		case 3: // ^C
+			ed.out.WriteString("^C\n")
+			return "", errInterrupt
+		case 4: // ^D
+			if len(e.buf) == 0 {
+				ed.out.WriteString("\n")
+				return "", io.EOF
+			}
+
+			e.delete(e.pos, e.pos+1)
+		case 1: // ^A
+			e.pos = 0
+		case 5: // ^E
+			e.pos = len(e.buf)
+		case 2: // ^B
+			e.move(-1)
+		case 6: // ^F
+			e.move(1)
+		case 8, 127: // ^H, backspace
+			e.delete(e.pos-1, e.pos)
+		case 11: // ^K
+			e.delete(e.pos, len(e.buf))
+		case 21: // ^U
+			e.delete(0, e.pos)
+		case 23: // ^W
+			start := e.pos
+			for start > 0 && unicode.IsSpace(e.buf[start-1]) {
+				start--
+			}
+
+			for start > 0 && !unicode.IsSpace(e.buf[start-1]) {
+				start--
+			}
+
+			e.delete(start, e.pos)
+		case 16: // ^P
+			e.recall(-1)
+		case 14: // ^N
+			e.recall(1)
+		case 12: // ^L
+			ed.out.WriteString("\x1b[H\x1b[2J")
+		case '\t':
+			e.completeWord()
+		case 27: // ESC
+			e.escape()
+		default:
+			if unicode.IsPrint(ch) {
+				e.insert(string(ch))
+			}
+		}
+
+		e.refresh()
+	}
+}
+
+// The state of a line being edited.
+type edit struct {
+	ed     *lineEditor
+	prompt string
+	buf    []rune
+	pos    int
+
+	// The history entry shown, or len(history) for the line being
+	// entered, which is kept in line while another is shown
+	hist int
+	line []rune
+}
+
+// Redraw the line, leaving the cursor in place.
+func (e *edit) refresh() {
+	s := "\r" + e.prompt + string(e.buf) + "\x1b[K"
+	if n := len(e.buf) - e.pos; n > 0 {
+		s += "\x1b[" + strconv.Itoa(n) + "D"
+	}
+
+	e.ed.out.WriteString(s)
+}
+
+func (e *edit) move(n int) {
+	e.pos += n
+	if e.pos < 0 {
+		e.pos = 0
+	} else if e.pos > len(e.buf) {
+		e.pos = len(e.buf)
+	}
+}
+
+func (e *edit) insert(s string) {
+	rs := []rune(s)
+	buf := make([]rune, 0, len(e.buf)+len(rs))
+	buf = append(buf, e.buf[:e.pos]...)
+	buf = append(buf, rs...)
+	e.buf = append(buf, e.buf[e.pos:]...)
+	e.pos += len(rs)
+}
+
+// Delete the runes from start up to end, as far as they exist.
+func (e *edit) delete(start, end int) {
+	if start < 0 {
+		start = 0
+	}
+
+	if end > len(e.buf) {
+		end = len(e.buf)
+	}
+
+	if start >= end {
+		return
+	}
+
+	e.buf = append(e.buf[:start], e.buf[end:]...)
+	e.pos = start
+}
+
+// Show the entry n before or after the one shown, if any.
+func (e *edit) recall(n int) {
+	history := e.ed.history
+	hist := e.hist + n
+	if hist < 0 || hist > len(history) {
+		return
+	}
+
+	if e.hist == len(history) {
+		e.line = e.buf
+	}
+
+	e.hist = hist
+	if hist == len(history) {
+		e.buf = e.line
+	} else {
+		e.buf = []rune(history[hist])
+	}
+
+	e.pos = len(e.buf)
+}
+
+// Act on the rest of an escape sequence, as sent by the arrow keys
+// and their like.
+func (e *edit) escape() {
+	r := e.ed.r
+	if ch, _, err := r.ReadRune(); err != nil ||
+		(ch != '[' && ch != 'O') {
+		return
+	}
+
+	var param string
+	for {
+		ch, _, err := r.ReadRune()
+		if err != nil {
+			return
+		}
+
+		if ch >= '0' && ch <= '9' || ch == ';' {
+			param += string(ch)
+			continue
+		}
+
+		switch {
+		case ch == 'A':
+			e.recall(-1)
+		case ch == 'B':
+			e.recall(1)
+		case ch == 'C':
+			e.move(1)
+		case ch == 'D':
+			e.move(-1)
+		case ch == 'H', ch == '~' && (param == "1" || param == "7"):
+			e.pos = 0
+		case ch == 'F', ch == '~' && (param == "4" || param == "8"):
+			e.pos = len(e.buf)
+		case ch == '~' && param == "3":
+			e.delete(e.pos, e.pos+1)
+		}
+
+		return
+	}
+}
+
+// Complete the word before the cursor as far as it can be, listing
+// the candidates if they differ beyond that.
+func (e *edit) completeWord() {
+	if e.ed.complete == nil {
+		return
+	}
+
+	word, cands := e.ed.complete(string(e.buf[:e.pos]))
+	if len(cands) == 0 {
+		e.ed.out.WriteString("\a")
+		return
+	}
+
+	prefix := cands[0]
+	for _, cand := range cands[1:] {
+		for !strings.HasPrefix(cand, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	if len(prefix) > len(word) {
+		e.insert(prefix[len(word):])
+		return
+	}
+
+	names := make([]string, len(cands))
+	for i, cand := range cands {
+		names[i] = strings.TrimRight(cand, " =")
+	}
+
+	e.ed.out.WriteString("\n" + strings.Join(names, "  ") + "\n")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Terminals are driven through termios, with ioctls only Linux has
+// under these names.
+
+func getTermios(fd uintptr) (*syscall.Termios, error) {
+	var t syscall.Termios
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd,
+		syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	if e != 0 {
+		return nil, e
+	}
+
+	return &t, nil
+}
+
+func setTermios(fd uintptr, t *syscall.Termios) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd,
+		syscall.TCSETS, uintptr(unsafe.Pointer(t)))
+	if e != 0 {
+		return e
+	}
+
+	return nil
+}
+
+func isTerminal(fd uintptr) bool {
+	_, err := getTermios(fd)
+	return err == nil
+}
+
+// Take each key as it is pressed, without echo or signals; output is
+// still translated, so that \n starts a new line.  Returns a function
+// putting the terminal back as it was.
+func makeRaw(fd uintptr) (func(), error) {
+	orig, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *orig
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO | syscall.ISIG |
+		syscall.IEXTEN
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := setTermios(fd, &raw); err != nil {
+		return nil, err
+	}
+
+	return func() { setTermios(fd, orig) }, nil
+}